@@ -0,0 +1,435 @@
+package seeker_fs
+
+// This file contains the Builder type, which constructs a SeekerFS one file at
+// a time, rather than by copying an existing fs.FS.
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Holds a file, directory, or symbolic link that has been added to a Builder.
+type builderEntry struct {
+	// The entry's header. Its NameOffset is only set once its name has been
+	// written by Finish. The same goes for directories' DataOffset and Size.
+	header *File
+	// The entry's name and extra metadata, which are written by Finish.
+	name  string
+	extra *fileExtra
+	// Shared by a regular file and every hard link to it. Nil if no links to
+	// the file have been added.
+	link *builderLink
+	// The entries in a directory, keyed by name. Nil if this isn't a
+	// directory.
+	children map[string]*builderEntry
+	// True if the directory was added using AddDir, rather than being
+	// created implicitly as the parent of another entry.
+	explicit bool
+}
+
+// Holds the ID shared by a regular file and its hard links.
+type builderLink struct {
+	// The offset of the first of the links' names to be written, which is
+	// used as their ID. Zero until then.
+	fileID uint64
+}
+
+// Wraps an io.Reader, counting the number of bytes that have been read.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(data []byte) (int, error) {
+	n, e := r.r.Read(data)
+	r.n += int64(n)
+	return n, e
+}
+
+// Used to create a SeekerFS without a source fs.FS, by adding each file,
+// directory, and symbolic link individually. Create a Builder using
+// NewBuilder, and call Finish once everything has been added. Each regular
+// file's content is written to the output as soon as it's added, but the
+// names and headers of every file are kept in memory until Finish is called.
+// The output is a streaming image; see CreateSeekerFSStream.
+type Builder struct {
+	queue *outputQueue
+	// The root directory.
+	root *builderEntry
+	// Set once Finish has been called, after which nothing else can be added.
+	finished bool
+}
+
+// Returns a new Builder writing to the given output, which must initially be
+// empty. The settings may be nil to use the defaults. The Deduplicate setting
+// isn't supported, as files' content can only be read once. The root
+// directory's modification time is the image's creation time, unless it's
+// changed using AddDir(".", ...).
+func NewBuilder(output io.Writer, settings *CreateFSSettings) (*Builder,
+	error) {
+	if settings == nil {
+		settings = &CreateFSSettings{}
+	}
+	if settings.Deduplicate {
+		return nil, fmt.Errorf("Deduplication isn't supported by the Builder")
+	}
+	queue := newOutputQueue(nil, &appendOnlyWriter{w: output}, settings)
+	queue.streaming = true
+	e := queue.checkEntryLimits(0)
+	if e != nil {
+		return nil, fmt.Errorf("Error adding root directory: %w", e)
+	}
+	e = queue.writeStreamHeader()
+	if e != nil {
+		return nil, e
+	}
+	modTime := settings.CreationTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	return &Builder{
+		queue: queue,
+		root: newBuilderDir(".", fs.ModeDir|0755, modTime, &fileExtra{},
+			true),
+	}, nil
+}
+
+// Returns a new directory entry for a Builder, with the given metadata.
+func newBuilderDir(name string, mode fs.FileMode, modTime time.Time,
+	extra *fileExtra, explicit bool) *builderEntry {
+	extra.modTimeNsec = uint32(modTime.Nanosecond())
+	return &builderEntry{
+		header:   newFileHeader(name, mode, modTime),
+		name:     name,
+		extra:    extra,
+		children: make(map[string]*builderEntry),
+		explicit: explicit,
+	}
+}
+
+// Returns the directory that will contain the entry at the given path, along
+// with the entry's name and depth. Creates any missing parent directories,
+// using the given modification time and 0755 permissions. Returns an error if
+// the path is invalid or one of its parents isn't a directory.
+func (b *Builder) getParentDir(path string, modTime time.Time) (*builderEntry,
+	string, int, error) {
+	if b.finished {
+		return nil, "", 0, fmt.Errorf("The Builder has already been finished")
+	}
+	if !fs.ValidPath(path) || (path == ".") {
+		return nil, "", 0, fmt.Errorf("Invalid path %q: %w", path,
+			fs.ErrInvalid)
+	}
+	components := strings.Split(path, "/")
+	dir := b.root
+	for i, name := range components[0 : len(components)-1] {
+		child := dir.children[name]
+		if child == nil {
+			e := b.queue.checkEntryLimits(i + 1)
+			if e != nil {
+				return nil, "", 0, fmt.Errorf("Failed adding parent "+
+					"directory of %s: %w", path, e)
+			}
+			child = newBuilderDir(name, fs.ModeDir|0755, modTime,
+				&fileExtra{}, false)
+			dir.children[name] = child
+		}
+		if child.children == nil {
+			return nil, "", 0, fmt.Errorf("A parent of %s isn't a "+
+				"directory: %w", path, fs.ErrInvalid)
+		}
+		dir = child
+	}
+	return dir, components[len(components)-1], len(components), nil
+}
+
+// Returns the parent directory and name for a new regular file or symbolic
+// link at the given path, after checking that the path isn't already in use
+// and counting the new entry towards the limits in the Builder's settings.
+func (b *Builder) getNewEntryParent(path string,
+	modTime time.Time) (*builderEntry, string, error) {
+	dir, name, depth, e := b.getParentDir(path, modTime)
+	if e != nil {
+		return nil, "", e
+	}
+	if dir.children[name] != nil {
+		return nil, "", fmt.Errorf("Can't add %s: %w", path, fs.ErrExist)
+	}
+	e = b.queue.checkEntryLimits(depth)
+	if e != nil {
+		return nil, "", fmt.Errorf("Failed adding %s: %w", path, e)
+	}
+	return dir, name, nil
+}
+
+// Adds a regular file at the given path, with content read from the given
+// reader until EOF. The mode may only contain permission bits (including the
+// setuid, setgid, and sticky bits). Any parent directories that haven't been
+// added yet are created with 0755 permissions and the same modification time
+// as the file.
+func (b *Builder) AddFile(path string, mode fs.FileMode, modTime time.Time,
+	content io.Reader) error {
+	return b.addFile(path, mode, modTime, content, &fileExtra{})
+}
+
+// Implements AddFile, additionally storing any metadata in the given extra
+// record. The extra record's content-related fields are overwritten.
+func (b *Builder) addFile(path string, mode fs.FileMode, modTime time.Time,
+	content io.Reader, extra *fileExtra) error {
+	if mode.Type() != 0 {
+		return fmt.Errorf("Invalid mode for regular file %s: %s", path, mode)
+	}
+	dir, name, e := b.getNewEntryParent(path, modTime)
+	if e != nil {
+		return e
+	}
+	extra.modTimeNsec = uint32(modTime.Nanosecond())
+	source := &countingReader{r: content}
+	dataOffset, e := b.queue.writeContent(source, -1, extra)
+	if e != nil {
+		return fmt.Errorf("Failed writing content of %s: %w", path, e)
+	}
+	if source.n == 0 {
+		// Be consistent with CreateSeekerFS, which doesn't write empty
+		// files' content.
+		dataOffset = 0
+		extra.copyContentInfo(&fileExtra{})
+	}
+	header := newFileHeader(name, mode, modTime)
+	header.Size = uint64(source.n)
+	header.DataOffset = uint64(dataOffset)
+	dir.children[name] = &builderEntry{
+		header: header,
+		name:   name,
+		extra:  extra,
+	}
+	b.queue.LogStatus("Added %s OK (%d bytes).\n", path, source.n)
+	return nil
+}
+
+// Adds a symbolic link at the given path, pointing to the given target. As
+// with AddFile, any missing parent directories are created.
+func (b *Builder) AddSymlink(path, target string, modTime time.Time) error {
+	return b.addSymlink(path, target, modTime, &fileExtra{})
+}
+
+// Implements AddSymlink, additionally storing any metadata in the given extra
+// record.
+func (b *Builder) addSymlink(path, target string, modTime time.Time,
+	extra *fileExtra) error {
+	if target == "" {
+		return fmt.Errorf("Symbolic link %s has an empty target", path)
+	}
+	dir, name, e := b.getNewEntryParent(path, modTime)
+	if e != nil {
+		return e
+	}
+	dataOffset, e := b.queue.writeDataAndGetLocation([]byte(target))
+	if e != nil {
+		return fmt.Errorf("Failed writing target of %s: %w", path, e)
+	}
+	extra.modTimeNsec = uint32(modTime.Nanosecond())
+	header := newFileHeader(name, fs.ModeSymlink|0777, modTime)
+	header.Size = uint64(len(target))
+	header.DataOffset = uint64(dataOffset)
+	dir.children[name] = &builderEntry{
+		header: header,
+		name:   name,
+		extra:  extra,
+	}
+	b.queue.LogStatus("Added symbolic link %s OK.\n", path)
+	return nil
+}
+
+// Returns the entry that was added at the given path, or an error if no entry
+// exists there.
+func (b *Builder) getEntry(path string) (*builderEntry, error) {
+	if !fs.ValidPath(path) {
+		return nil, fmt.Errorf("Invalid path %q: %w", path, fs.ErrInvalid)
+	}
+	if path == "." {
+		return b.root, nil
+	}
+	entry := b.root
+	for _, name := range strings.Split(path, "/") {
+		entry = entry.children[name]
+		if entry == nil {
+			return nil, fmt.Errorf("%s hasn't been added: %w", path,
+				fs.ErrNotExist)
+		}
+	}
+	return entry, nil
+}
+
+// Adds a hard link to the regular file at the target path, which must already
+// have been added. The link shares the target's content, metadata, and ID.
+func (b *Builder) addHardLink(path, target string) error {
+	existing, e := b.getEntry(target)
+	if e != nil {
+		return fmt.Errorf("Bad target for hard link %s: %w", path, e)
+	}
+	if (existing.children != nil) ||
+		(fs.FileMode(existing.header.Mode).Type() != 0) {
+		return fmt.Errorf("Hard link %s's target, %s, isn't a regular file",
+			path, target)
+	}
+	dir, name, e := b.getNewEntryParent(path,
+		time.Unix(int64(existing.header.ModTime), 0))
+	if e != nil {
+		return e
+	}
+	if existing.link == nil {
+		existing.link = &builderLink{}
+	}
+	header := *existing.header
+	header.ShortName = [8]byte{}
+	copy(header.ShortName[:], []byte(name))
+	header.NameSize = uint64(len(name))
+	extra := *existing.extra
+	dir.children[name] = &builderEntry{
+		header: &header,
+		name:   name,
+		extra:  &extra,
+		link:   existing.link,
+	}
+	b.queue.LogStatus("%s is a hard link to %s.\n", path, target)
+	return nil
+}
+
+// Adds a directory at the given path. The mode may only contain permission
+// bits and fs.ModeDir. A directory that was already created as the parent of
+// another entry may be added, in which case its mode and modification time are
+// updated. Passing "." as the path sets the root directory's mode and
+// modification time.
+func (b *Builder) AddDir(path string, mode fs.FileMode,
+	modTime time.Time) error {
+	return b.addDir(path, mode, modTime, &fileExtra{})
+}
+
+// Implements AddDir, additionally storing any metadata in the given extra
+// record.
+func (b *Builder) addDir(path string, mode fs.FileMode, modTime time.Time,
+	extra *fileExtra) error {
+	if (mode.Type() &^ fs.ModeDir) != 0 {
+		return fmt.Errorf("Invalid mode for directory %s: %s", path, mode)
+	}
+	mode |= fs.ModeDir
+	if b.finished {
+		return fmt.Errorf("The Builder has already been finished")
+	}
+	if path == "." {
+		root := newBuilderDir(".", mode, modTime, extra, true)
+		root.children = b.root.children
+		b.root = root
+		return nil
+	}
+	parent, name, depth, e := b.getParentDir(path, modTime)
+	if e != nil {
+		return e
+	}
+	existing := parent.children[name]
+	if existing != nil {
+		if existing.explicit || (existing.children == nil) {
+			return fmt.Errorf("Can't add directory %s: %w", path, fs.ErrExist)
+		}
+	} else {
+		e = b.queue.checkEntryLimits(depth)
+		if e != nil {
+			return fmt.Errorf("Failed adding directory %s: %w", path, e)
+		}
+	}
+	dir := newBuilderDir(name, mode, modTime, extra, true)
+	if existing != nil {
+		dir.children = existing.children
+	}
+	parent.children[name] = dir
+	return nil
+}
+
+// Writes the name and extra metadata of the given entry, updating its header.
+// If the entry is a hard link, and none of the other links' names have been
+// written yet, its name's offset becomes the ID shared by all of the links.
+func (b *Builder) writeEntryName(entry *builderEntry) error {
+	if entry.link != nil {
+		if entry.link.fileID == 0 {
+			nameOffset, e := b.queue.seekToEnd()
+			if e != nil {
+				return e
+			}
+			entry.link.fileID = uint64(nameOffset)
+		}
+		entry.extra.hasFileID = true
+		entry.extra.fileID = entry.link.fileID
+	}
+	return b.queue.writeNameAndExtra(entry.header, entry.name, entry.extra)
+}
+
+// Writes the given directory's name, followed by the names of its entries
+// (recursively, for subdirectories), followed by the headers of its entries.
+// Returns the directory's header.
+func (b *Builder) writeDir(dir *builderEntry, path string) (*File, error) {
+	e := b.writeEntryName(dir)
+	if e != nil {
+		return nil, fmt.Errorf("Failed writing name of dir %s: %w", path, e)
+	}
+	if len(dir.children) == 0 {
+		return dir.header, nil
+	}
+	names := make([]string, 0, len(dir.children))
+	for name := range dir.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	headers := make([]File, len(names))
+	for i, name := range names {
+		child := dir.children[name]
+		childPath := joinPath(path, name)
+		if child.children != nil {
+			childHeader, e := b.writeDir(child, childPath)
+			if e != nil {
+				return nil, e
+			}
+			headers[i] = *childHeader
+			continue
+		}
+		e = b.writeEntryName(child)
+		if e != nil {
+			return nil, fmt.Errorf("Failed writing name of %s: %w",
+				childPath, e)
+		}
+		headers[i] = *child.header
+	}
+	dataOffset, e := b.queue.writeDataAndGetLocation(headers)
+	if e != nil {
+		return nil, fmt.Errorf("Failed writing entries of dir %s: %w", path,
+			e)
+	}
+	dir.header.DataOffset = uint64(dataOffset)
+	dir.header.Size = uint64(len(headers))
+	return dir.header, nil
+}
+
+// Implements Finish, returning the image's header, which was written as the
+// footer.
+func (b *Builder) finish() (*ImageHeader, error) {
+	if b.finished {
+		return nil, fmt.Errorf("The Builder has already been finished")
+	}
+	b.finished = true
+	rootHeader, e := b.writeDir(b.root, ".")
+	if e != nil {
+		return nil, e
+	}
+	return b.queue.writeStreamFooter(rootHeader)
+}
+
+// Writes the names and headers of every file and directory that has been
+// added, along with the image's footer, completing the image. Nothing else can
+// be added after this has been called.
+func (b *Builder) Finish() error {
+	_, e := b.finish()
+	return e
+}
@@ -0,0 +1,236 @@
+package seeker_fs
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// Loads the image written to the given buffer by a Builder, and validates it.
+func loadBuiltFS(t *testing.T, output *bytes.Buffer) *SeekerFS {
+	raw := output.Bytes()
+	sfs, e := LoadSeekerFSReaderAt(bytes.NewReader(raw), int64(len(raw)))
+	if e != nil {
+		t.Logf("Failed loading FS created by Builder: %s\n", e)
+		t.FailNow()
+	}
+	e = sfs.Validate()
+	if e != nil {
+		t.Logf("Validating FS created by Builder failed: %s\n", e)
+		t.FailNow()
+	}
+	return sfs
+}
+
+func TestBuilder(t *testing.T) {
+	var output bytes.Buffer
+	b, e := NewBuilder(&output, &CreateFSSettings{
+		Compression:          CompressionDeflate,
+		CompressionChunkSize: 1024,
+		StatusLog:            &testLogger{t},
+	})
+	if e != nil {
+		t.Logf("Failed creating Builder: %s\n", e)
+		t.FailNow()
+	}
+	check := func(e error) {
+		if e != nil {
+			t.Logf("Failed adding to Builder: %s\n", e)
+			t.FailNow()
+		}
+	}
+	modTime := time.Unix(1234567890, 123456789)
+	compressible := strings.Repeat("Compressible content. ", 1000)
+	random := make([]byte, 3000)
+	rand.New(rand.NewSource(1337)).Read(random)
+	check(b.AddFile("a.txt", 0644, modTime, strings.NewReader("Hi")))
+	check(b.AddFile("empty.txt", 0600, modTime, strings.NewReader("")))
+	check(b.AddFile("dir/sub/compressible.txt", 0644, modTime,
+		strings.NewReader(compressible)))
+	check(b.AddFile("dir/random.bin", 0644, modTime,
+		bytes.NewReader(random)))
+	check(b.AddFile("dir/random_chunk.bin", 0644, modTime,
+		bytes.NewReader(random[0:1000])))
+	check(b.AddSymlink("dir/link", "sub/compressible.txt", modTime))
+	// Explicitly adding an implicitly-created directory should update it.
+	check(b.AddDir("dir", 0700, modTime))
+	check(b.AddDir("empty_dir", fs.ModeDir|0755, modTime))
+	check(b.AddDir(".", 0750, modTime))
+
+	// Check some invalid additions.
+	e = b.AddFile("a.txt", 0644, modTime, strings.NewReader("Again"))
+	if !errors.Is(e, fs.ErrExist) {
+		t.Logf("Didn't get expected error when adding a file twice: %v\n", e)
+		t.FailNow()
+	}
+	t.Logf("Got expected error when adding a file twice: %s\n", e)
+	e = b.AddDir("dir", 0755, modTime)
+	if !errors.Is(e, fs.ErrExist) {
+		t.Logf("Didn't get expected error when adding a dir twice: %v\n", e)
+		t.FailNow()
+	}
+	t.Logf("Got expected error when adding a dir twice: %s\n", e)
+	e = b.AddFile("a.txt/b.txt", 0644, modTime, strings.NewReader(""))
+	if e == nil {
+		t.Logf("Didn't get expected error when adding a file to a file\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error when adding a file to a file: %s\n", e)
+	e = b.AddFile("../bad.txt", 0644, modTime, strings.NewReader(""))
+	if !errors.Is(e, fs.ErrInvalid) {
+		t.Logf("Didn't get expected error when adding an invalid path\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error when adding an invalid path: %s\n", e)
+	e = b.AddFile("dir_mode.txt", fs.ModeDir|0644, modTime,
+		strings.NewReader(""))
+	if e == nil {
+		t.Logf("Didn't get expected error when adding a file with a " +
+			"directory's mode\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error when adding a file with a bad mode: %s\n", e)
+
+	e = b.Finish()
+	if e != nil {
+		t.Logf("Failed finishing Builder: %s\n", e)
+		t.FailNow()
+	}
+	e = b.AddFile("late.txt", 0644, modTime, strings.NewReader(""))
+	if e == nil {
+		t.Logf("Didn't get expected error when adding after Finish()\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error when adding after Finish(): %s\n", e)
+
+	sfs := loadBuiltFS(t, &output)
+	e = fstest.TestFS(sfs, "a.txt", "empty.txt", "dir/sub/compressible.txt",
+		"dir/random.bin", "dir/random_chunk.bin", "dir/link", "empty_dir")
+	if e != nil {
+		t.Logf("TestFS failed on FS created by Builder: %s\n", e)
+		t.FailNow()
+	}
+	expectedContent := map[string]string{
+		"a.txt":                    "Hi",
+		"empty.txt":                "",
+		"dir/sub/compressible.txt": compressible,
+		"dir/random.bin":           string(random),
+		"dir/random_chunk.bin":     string(random[0:1000]),
+		"dir/link":                 compressible,
+	}
+	for path, expected := range expectedContent {
+		data, e := fs.ReadFile(sfs, path)
+		if e != nil {
+			t.Logf("Failed reading %s: %s\n", path, e)
+			t.FailNow()
+		}
+		if string(data) != expected {
+			t.Logf("Got incorrect content for %s\n", path)
+			t.FailNow()
+		}
+	}
+	target, e := sfs.ReadLink("dir/link")
+	if e != nil {
+		t.Logf("Failed reading link: %s\n", e)
+		t.FailNow()
+	}
+	if target != "sub/compressible.txt" {
+		t.Logf("Got incorrect link target: %s\n", target)
+		t.FailNow()
+	}
+
+	expectedModes := map[string]fs.FileMode{
+		".":         fs.ModeDir | 0750,
+		"a.txt":     0644,
+		"empty.txt": 0600,
+		"dir":       fs.ModeDir | 0700,
+		"dir/sub":   fs.ModeDir | 0755,
+		"empty_dir": fs.ModeDir | 0755,
+	}
+	for path, expected := range expectedModes {
+		info, e := fs.Stat(sfs, path)
+		if e != nil {
+			t.Logf("Failed getting info for %s: %s\n", path, e)
+			t.FailNow()
+		}
+		if info.Mode() != expected {
+			t.Logf("Got incorrect mode for %s: %s\n", path, info.Mode())
+			t.FailNow()
+		}
+		if !info.ModTime().Equal(modTime) {
+			t.Logf("Got incorrect mod time for %s: %s\n", path,
+				info.ModTime())
+			t.FailNow()
+		}
+	}
+}
+
+func TestBuilderLimits(t *testing.T) {
+	_, e := NewBuilder(&bytes.Buffer{}, &CreateFSSettings{
+		Deduplicate: true,
+	})
+	if e == nil {
+		t.Logf("Didn't get expected error when enabling deduplication\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error when enabling deduplication: %s\n", e)
+
+	var output bytes.Buffer
+	b, e := NewBuilder(&output, &CreateFSSettings{
+		MaxOutputSize:   1000,
+		MaxTotalEntries: 4,
+	})
+	if e != nil {
+		t.Logf("Failed creating Builder: %s\n", e)
+		t.FailNow()
+	}
+	modTime := time.Unix(0, 0)
+	e = b.AddFile("big.txt", 0644, modTime,
+		strings.NewReader(strings.Repeat("!", 1000)))
+	if e == nil {
+		t.Logf("Didn't get expected error when exceeding the size limit\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error when exceeding the size limit: %s\n", e)
+	if output.Len() > 1000 {
+		t.Logf("Wrote %d bytes, past the size limit\n", output.Len())
+		t.FailNow()
+	}
+
+	// The root, the directory, and the first file count as three entries.
+	output.Reset()
+	b, e = NewBuilder(&output, &CreateFSSettings{
+		MaxTotalEntries: 3,
+	})
+	if e != nil {
+		t.Logf("Failed creating Builder: %s\n", e)
+		t.FailNow()
+	}
+	e = b.AddFile("dir/a.txt", 0644, modTime, strings.NewReader("a"))
+	if e != nil {
+		t.Logf("Failed adding file: %s\n", e)
+		t.FailNow()
+	}
+	e = b.AddFile("dir/b.txt", 0644, modTime, strings.NewReader("b"))
+	if e == nil {
+		t.Logf("Didn't get expected error when exceeding the entry limit\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error when exceeding the entry limit: %s\n", e)
+	e = b.Finish()
+	if e != nil {
+		t.Logf("Failed finishing Builder: %s\n", e)
+		t.FailNow()
+	}
+	sfs := loadBuiltFS(t, &output)
+	e = fstest.TestFS(sfs, "dir/a.txt")
+	if e != nil {
+		t.Logf("TestFS failed on FS created by Builder: %s\n", e)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,192 @@
+package seeker_fs
+
+// This file contains an optional cache of directory entries and long names,
+// which avoids reading and decoding the same data every time a path is
+// resolved. It's enabled by passing the WithCache option when loading an FS.
+import (
+	"container/list"
+	"sync"
+)
+
+// The number of consecutive File structs in each block of directory entries
+// stored in the cache.
+const cacheBlockEntries = 64
+
+// Identifies a block of directory entries or a long name in the cache.
+type cacheKey struct {
+	// True if the entry holds a long name rather than a block of File structs.
+	isName bool
+	// The absolute offset of the data in the data stream.
+	offset uint64
+	// The number of File structs or bytes in the name.
+	count uint64
+}
+
+// Holds a single block of directory entries or long name in the cache.
+type cacheEntry struct {
+	key cacheKey
+	// The decoded directory entries. Will be nil if key.isName is true.
+	files []File
+	// The long name. Only valid if key.isName is true.
+	name string
+}
+
+// Returns the number of bytes the entry counts towards the cache's size.
+func (c *cacheEntry) size() uint64 {
+	if c.key.isName {
+		return uint64(len(c.name))
+	}
+	return uint64(len(c.files)) * fileStructSize
+}
+
+// A bounded LRU cache of directory entries and names. Safe for concurrent use,
+// and shared by every Sub() view of an FS.
+type entryCache struct {
+	lock sync.Mutex
+	// The maximum total size of the cached data, in bytes.
+	maxSize uint64
+	// The current total size of the cached data, in bytes.
+	size uint64
+	// Maps keys to elements of lru.
+	entries map[cacheKey]*list.Element
+	// Holds a *cacheEntry for every entry in the cache, with the most
+	// recently used at the front.
+	lru *list.List
+	// The number of lookups that did and didn't find their data in the cache.
+	hits   uint64
+	misses uint64
+}
+
+func newEntryCache(maxSize uint64) *entryCache {
+	return &entryCache{
+		maxSize: maxSize,
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Returns the cached entry with the given key, or nil if it isn't cached.
+func (c *entryCache) get(key cacheKey) *cacheEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element := c.entries[key]
+	if element == nil {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	c.lru.MoveToFront(element)
+	return element.Value.(*cacheEntry)
+}
+
+// Adds the entry to the cache, evicting the least recently used entries to
+// make room for it. Does nothing if the entry is larger than the cache.
+func (c *entryCache) add(entry *cacheEntry) {
+	size := entry.size()
+	if size > c.maxSize {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries[entry.key] != nil {
+		// Another goroutine added the same entry since we checked for it.
+		return
+	}
+	for (c.size + size) > c.maxSize {
+		oldest := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, oldest.key)
+		c.size -= oldest.size()
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += size
+}
+
+// Returns the entry at index n in directory f, which must be a valid index,
+// loading the block of entries containing it into the cache if necessary.
+func (c *entryCache) getDirEntry(f *File, p *SeekerFS, n int) (*File,
+	error) {
+	start := (uint64(n) / cacheBlockEntries) * cacheBlockEntries
+	end := start + cacheBlockEntries
+	if end > f.Size {
+		end = f.Size
+	}
+	key := cacheKey{
+		offset: f.DataOffset + start*fileStructSize,
+		count:  end - start,
+	}
+	entry := c.get(key)
+	if entry == nil {
+		files, e := readDirFiles(f, p, start, end)
+		if e != nil {
+			return nil, e
+		}
+		entry = &cacheEntry{key: key, files: files}
+		c.add(entry)
+	}
+	// Return a copy, so the cached entry can't be modified.
+	toReturn := entry.files[uint64(n)-start]
+	return &toReturn, nil
+}
+
+// Returns the long name of f, which must not be stored entirely in its
+// ShortName, reading it into the cache if necessary.
+func (c *entryCache) getFileName(f *File, p *SeekerFS) (string, error) {
+	key := cacheKey{
+		isName: true,
+		offset: f.NameOffset,
+		count:  f.NameSize,
+	}
+	entry := c.get(key)
+	if entry == nil {
+		name, e := p.getBytes(f.NameOffset, f.NameSize)
+		if e != nil {
+			return "", e
+		}
+		entry = &cacheEntry{key: key, name: string(name)}
+		c.add(entry)
+	}
+	return entry.name, nil
+}
+
+// Enables a cache of directory entries and long file names, which speeds up
+// repeatedly resolving paths in the same directories. The cache holds up to
+// maxSize bytes of data, discarding the least recently used data when it's
+// full. The cache is shared by every Sub() view of the FS. See CacheStats.
+func WithCache(maxSize uint64) LoadOption {
+	return func(s *loadSettings) {
+		s.cacheSize = maxSize
+	}
+}
+
+// Contains statistics about an FS's cache. Returned by SeekerFS.CacheStats.
+type CacheStats struct {
+	// The number of lookups that found their data in the cache.
+	Hits uint64
+	// The number of lookups that needed to read their data from the image.
+	Misses uint64
+	// The number of blocks of directory entries and names in the cache.
+	Entries int
+	// The total size of the cached data, in bytes.
+	Size uint64
+	// The maximum size of the cached data, as passed to WithCache.
+	MaxSize uint64
+}
+
+// Returns statistics about the FS's cache, which are shared with every Sub()
+// view of the FS. Returns all zeros if the FS was loaded without the
+// WithCache option.
+func (p *SeekerFS) CacheStats() CacheStats {
+	c := p.cache
+	if c == nil {
+		return CacheStats{}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return CacheStats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Entries: c.lru.Len(),
+		Size:    c.size,
+		MaxSize: c.maxSize,
+	}
+}
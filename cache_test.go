@@ -0,0 +1,132 @@
+package seeker_fs
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+// Returns the raw image of an FS containing a directory with many entries,
+// each with a long name, along with the names.
+func createCacheTestImage(t *testing.T) ([]byte, []string) {
+	mapFS := fstest.MapFS{}
+	var names []string
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("dir/a_long_file_name_%04d.txt", i)
+		mapFS[name] = newMapFile(name)
+		names = append(names, name)
+	}
+	data := NewSeekableBuffer()
+	e := CreateSeekerFS(mapFS, data, nil)
+	if e != nil {
+		t.Logf("Failed creating seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	return getBufferBytes(t, data), names
+}
+
+func TestCache(t *testing.T) {
+	raw, names := createCacheTestImage(t)
+	sfs, e := LoadSeekerFSReaderAt(bytes.NewReader(raw), int64(len(raw)),
+		WithCache(1024*1024))
+	if e != nil {
+		t.Logf("Failed loading seeker FS with a cache: %s\n", e)
+		t.FailNow()
+	}
+	e = fstest.TestFS(sfs, names[0], names[len(names)-1])
+	if e != nil {
+		t.Logf("TestFS failed with a cache: %s\n", e)
+		t.FailNow()
+	}
+
+	// Looking up the same files again should only hit the cache.
+	lookUpAll := func(f fs.FS, prefix string) {
+		for _, name := range names {
+			content, e := fs.ReadFile(f, name[len(prefix):])
+			if e != nil {
+				t.Logf("Failed reading %s: %s\n", name, e)
+				t.FailNow()
+			}
+			if string(content) != name {
+				t.Logf("Got incorrect content for %s: %q\n", name, content)
+				t.FailNow()
+			}
+		}
+	}
+	lookUpAll(sfs, "")
+	before := sfs.CacheStats()
+	t.Logf("Cache stats after first lookups: %+v\n", before)
+	if (before.Hits == 0) || (before.Misses == 0) || (before.Entries == 0) {
+		t.Logf("Cache wasn't used\n")
+		t.FailNow()
+	}
+	sub, e := sfs.Sub("dir")
+	if e != nil {
+		t.Logf("Failed getting sub FS: %s\n", e)
+		t.FailNow()
+	}
+	lookUpAll(sub, "dir/")
+	after := sub.(*SeekerFS).CacheStats()
+	t.Logf("Cache stats after looking up files in sub FS: %+v\n", after)
+	if after.Misses != before.Misses {
+		t.Logf("Got unexpected cache misses in sub FS\n")
+		t.FailNow()
+	}
+	if after.Hits <= before.Hits {
+		t.Logf("Sub FS didn't share the cache\n")
+		t.FailNow()
+	}
+
+	// A small cache should stay within its size limit, even when used by
+	// several goroutines.
+	sfs, e = LoadSeekerFSReaderAt(bytes.NewReader(raw), int64(len(raw)),
+		WithCache(4096))
+	if e != nil {
+		t.Logf("Failed loading seeker FS with a small cache: %s\n", e)
+		t.FailNow()
+	}
+	var wg sync.WaitGroup
+	errors := make([]error, 4)
+	for i := range errors {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			for _, name := range names {
+				_, e := sfs.Stat(name)
+				if e != nil {
+					errors[index] = e
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, e := range errors {
+		if e != nil {
+			t.Logf("Reader %d failed: %s\n", i, e)
+			t.FailNow()
+		}
+	}
+	stats := sfs.CacheStats()
+	t.Logf("Small cache stats: %+v\n", stats)
+	if (stats.Size > 4096) || (stats.MaxSize != 4096) {
+		t.Logf("Small cache exceeded its size limit\n")
+		t.FailNow()
+	}
+
+	// Without a cache, the stats should be empty.
+	sfs, e = LoadSeekerFSReaderAt(bytes.NewReader(raw), int64(len(raw)))
+	if e != nil {
+		t.Logf("Failed loading seeker FS without a cache: %s\n", e)
+		t.FailNow()
+	}
+	lookUpAll(sfs, "")
+	if sfs.CacheStats() != (CacheStats{}) {
+		t.Logf("Got unexpected stats without a cache: %+v\n",
+			sfs.CacheStats())
+		t.FailNow()
+	}
+}
@@ -0,0 +1,582 @@
+// The seekerfs command creates, inspects, verifies, and extracts SeekerFS
+// images. Run it without arguments for usage information.
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yalue/seeker_fs"
+)
+
+// Holds a subcommand of the seekerfs command.
+type command struct {
+	// The arguments the subcommand takes, for the usage message.
+	usage string
+	// A short description of the subcommand.
+	description string
+	// Runs the subcommand with the arguments following its name, writing
+	// output to stdout.
+	run func(args []string, stdout io.Writer) error
+}
+
+// Maps each subcommand's name to the subcommand. Filled in during init(), as
+// the usage function needs to refer to it.
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"pack": {
+			usage:       "[-compress] [-dedup] [-v] <dir> <image>",
+			description: "Creates an image containing the directory.",
+			run:         runPack,
+		},
+		"ls": {
+			usage:       "[-l] <image> [path]",
+			description: "Lists a directory's entries.",
+			run:         runLs,
+		},
+		"cat": {
+			usage:       "<image> <path>",
+			description: "Writes a file's content to stdout.",
+			run:         runCat,
+		},
+		"extract": {
+			usage:       "<image> <dir> [path]",
+			description: "Extracts the image, or a path in it, to a new dir.",
+			run:         runExtract,
+		},
+		"stat": {
+			usage:       "<image> [path]",
+			description: "Prints info about the image or a file in it.",
+			run:         runStat,
+		},
+		"verify": {
+			usage:       "[-root-hash <hex>] <image>",
+			description: "Checks the image's format and every file's content.",
+			run:         runVerify,
+		},
+	}
+}
+
+// Returns the usage message listing every subcommand.
+func usage() string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	toReturn := "Usage: seekerfs <command> [arguments]\n\nCommands:\n"
+	for _, name := range names {
+		c := commands[name]
+		toReturn += fmt.Sprintf("  %s %s\n      %s\n", name, c.usage,
+			c.description)
+	}
+	return toReturn
+}
+
+// Returns a FlagSet for the named subcommand, which reports errors rather than
+// exiting.
+func newFlagSet(name string) *flag.FlagSet {
+	toReturn := flag.NewFlagSet(name, flag.ContinueOnError)
+	toReturn.SetOutput(io.Discard)
+	return toReturn
+}
+
+// Parses the subcommand's flags, and checks that the number of remaining
+// arguments is between min and max. Returns the remaining arguments.
+func parseArgs(flags *flag.FlagSet, args []string, min, max int) ([]string,
+	error) {
+	e := flags.Parse(args)
+	if e != nil {
+		return nil, fmt.Errorf("Invalid arguments for %s: %w", flags.Name(), e)
+	}
+	remaining := flags.Args()
+	if (len(remaining) < min) || (len(remaining) > max) {
+		return nil, fmt.Errorf("Usage: seekerfs %s %s", flags.Name(),
+			commands[flags.Name()].usage)
+	}
+	return remaining, nil
+}
+
+// Opens and loads the image at the given path. The caller must close the
+// returned file when it's done with the FS.
+func loadImage(path string, options ...seeker_fs.LoadOption) (
+	*seeker_fs.SeekerFS, *os.File, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, nil, e
+	}
+	info, e := f.Stat()
+	if e != nil {
+		f.Close()
+		return nil, nil, e
+	}
+	sfs, e := seeker_fs.LoadSeekerFSReaderAt(f, info.Size(), options...)
+	if e != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("Failed loading %s: %w", path, e)
+	}
+	return sfs, f, nil
+}
+
+func runPack(args []string, stdout io.Writer) error {
+	flags := newFlagSet("pack")
+	compress := flags.Bool("compress", false, "")
+	dedup := flags.Bool("dedup", false, "")
+	verbose := flags.Bool("v", false, "")
+	args, e := parseArgs(flags, args, 2, 2)
+	if e != nil {
+		return e
+	}
+	settings := &seeker_fs.CreateFSSettings{
+		Deduplicate: *dedup,
+	}
+	if *compress {
+		settings.Compression = seeker_fs.CompressionDeflate
+	}
+	if *verbose {
+		settings.StatusLog = stdout
+	}
+	output, e := os.Create(args[1])
+	if e != nil {
+		return e
+	}
+	e = seeker_fs.CreateSeekerFS(seeker_fs.NewDirFS(args[0]), output,
+		settings)
+	if e != nil {
+		output.Close()
+		return fmt.Errorf("Failed creating %s: %w", args[1], e)
+	}
+	return output.Close()
+}
+
+// Returns a line describing the given file, like "ls -l". The path is only
+// used if the file is a symbolic link, to read its target.
+func formatLongEntry(sfs *seeker_fs.SeekerFS, path string,
+	info fs.FileInfo) (string, error) {
+	name := info.Name()
+	if (info.Mode() & fs.ModeSymlink) != 0 {
+		target, e := sfs.ReadLink(path)
+		if e != nil {
+			return "", e
+		}
+		name += " -> " + target
+	}
+	owner := "-"
+	group := "-"
+	sysInfo, ok := info.Sys().(*seeker_fs.FileSys)
+	if ok && sysInfo.HasOwner {
+		owner = fmt.Sprintf("%d", sysInfo.UID)
+		if sysInfo.UserName != "" {
+			owner = sysInfo.UserName
+		}
+		group = fmt.Sprintf("%d", sysInfo.GID)
+		if sysInfo.GroupName != "" {
+			group = sysInfo.GroupName
+		}
+	}
+	return fmt.Sprintf("%s %s %s %10d %s %s", info.Mode(), owner, group,
+		info.Size(), info.ModTime().Format("2006-01-02 15:04"), name), nil
+}
+
+func runLs(args []string, stdout io.Writer) error {
+	flags := newFlagSet("ls")
+	long := flags.Bool("l", false, "")
+	args, e := parseArgs(flags, args, 1, 2)
+	if e != nil {
+		return e
+	}
+	sfs, f, e := loadImage(args[0])
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	dirPath := "."
+	if len(args) > 1 {
+		dirPath = args[1]
+	}
+	info, e := fs.Stat(sfs, dirPath)
+	if e != nil {
+		return e
+	}
+
+	// As with ls, only print the file itself if it isn't a directory.
+	paths := []string{dirPath}
+	infos := []fs.FileInfo{info}
+	if info.IsDir() {
+		entries, e := fs.ReadDir(sfs, dirPath)
+		if e != nil {
+			return e
+		}
+		paths = paths[0:0]
+		infos = infos[0:0]
+		for _, entry := range entries {
+			info, e := entry.Info()
+			if e != nil {
+				return e
+			}
+			paths = append(paths, path.Join(dirPath, entry.Name()))
+			infos = append(infos, info)
+		}
+	}
+	for i, info := range infos {
+		line := info.Name()
+		if info.IsDir() {
+			line += "/"
+		}
+		if *long {
+			line, e = formatLongEntry(sfs, paths[i], info)
+			if e != nil {
+				return e
+			}
+		}
+		fmt.Fprintln(stdout, line)
+	}
+	return nil
+}
+
+func runCat(args []string, stdout io.Writer) error {
+	args, e := parseArgs(newFlagSet("cat"), args, 2, 2)
+	if e != nil {
+		return e
+	}
+	sfs, f, e := loadImage(args[0])
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	toCopy, e := sfs.Open(args[1])
+	if e != nil {
+		return e
+	}
+	defer toCopy.Close()
+	_, e = io.Copy(stdout, toCopy)
+	return e
+}
+
+// Creates the file, directory, or symbolic link at the given path in the FS at
+// the corresponding path in the host directory.
+func extractEntry(sfs *seeker_fs.SeekerFS, path, hostPath string,
+	info fs.FileInfo) error {
+	mode := info.Mode()
+	if mode.IsDir() {
+		// Directories are created writable, so that their contents can be
+		// extracted. Their real permissions are set afterwards.
+		return os.Mkdir(hostPath, 0700)
+	}
+	if (mode & fs.ModeSymlink) != 0 {
+		target, e := sfs.ReadLink(path)
+		if e != nil {
+			return e
+		}
+		return os.Symlink(filepath.FromSlash(target), hostPath)
+	}
+	if !mode.IsRegular() {
+		return fmt.Errorf("Unsupported file mode: %s", mode)
+	}
+	input, e := sfs.Open(path)
+	if e != nil {
+		return e
+	}
+	defer input.Close()
+	output, e := os.OpenFile(hostPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		mode.Perm())
+	if e != nil {
+		return e
+	}
+	_, e = io.Copy(output, input)
+	if e != nil {
+		output.Close()
+		return e
+	}
+	e = output.Close()
+	if e != nil {
+		return e
+	}
+	return os.Chtimes(hostPath, info.ModTime(), info.ModTime())
+}
+
+// Returns the host path where the entry at the given path in the FS should be
+// extracted. Returns an error if the host path wouldn't be in the destination
+// directory, or if its parent isn't one of the extracted directories in dirs.
+// The latter ensures that nothing is written through an extracted symbolic
+// link.
+func getExtractPath(destination, path string,
+	dirs map[string]fs.FileInfo) (string, error) {
+	hostPath := filepath.Join(destination, filepath.FromSlash(path))
+	if path == "." {
+		return hostPath, nil
+	}
+	relative, e := filepath.Rel(destination, hostPath)
+	if (e != nil) || (relative == "..") ||
+		strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Path is outside of the destination directory")
+	}
+	if dirs[filepath.Dir(hostPath)] == nil {
+		return "", fmt.Errorf("Parent isn't an extracted directory")
+	}
+	return hostPath, nil
+}
+
+func runExtract(args []string, stdout io.Writer) error {
+	args, e := parseArgs(newFlagSet("extract"), args, 2, 3)
+	if e != nil {
+		return e
+	}
+	image, f, e := loadImage(args[0])
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	sfs := image
+	if len(args) > 2 {
+		sub, e := image.Sub(args[2])
+		if e != nil {
+			return e
+		}
+		sfs = sub.(*seeker_fs.SeekerFS)
+	}
+
+	// Entries with bad names, such as "..", or duplicate names could be used
+	// to write outside of the destination, so refuse to extract anything
+	// from an invalid image.
+	e = sfs.Validate()
+	if e != nil {
+		return fmt.Errorf("Refusing to extract an invalid image: %w", e)
+	}
+	destination, e := filepath.Abs(args[1])
+	if e != nil {
+		return e
+	}
+
+	// Extract everything, then set the directories' permissions and times,
+	// deepest first, so that extracting their contents doesn't change them.
+	var dirPaths []string
+	dirInfo := make(map[string]fs.FileInfo)
+	e = sfs.WalkDir(".", func(path string, d fs.DirEntry, e error) error {
+		if e != nil {
+			return e
+		}
+		info, e := d.Info()
+		if e != nil {
+			return e
+		}
+		hostPath, e := getExtractPath(destination, path, dirInfo)
+		if e != nil {
+			return fmt.Errorf("Can't extract %s: %w", path, e)
+		}
+		e = extractEntry(sfs, path, hostPath, info)
+		if e != nil {
+			return fmt.Errorf("Failed extracting %s: %w", path, e)
+		}
+		if info.IsDir() {
+			dirPaths = append(dirPaths, hostPath)
+			dirInfo[hostPath] = info
+		}
+		return nil
+	})
+	if e != nil {
+		return e
+	}
+	for i := len(dirPaths) - 1; i >= 0; i-- {
+		info := dirInfo[dirPaths[i]]
+		e = os.Chmod(dirPaths[i], info.Mode().Perm())
+		if e == nil {
+			e = os.Chtimes(dirPaths[i], info.ModTime(), info.ModTime())
+		}
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Prints information about the image as a whole.
+func printImageInfo(sfs *seeker_fs.SeekerFS, stdout io.Writer) {
+	header := sfs.GetImageHeader()
+	if header == nil {
+		fmt.Fprintf(stdout, "Legacy image without a header\n")
+		return
+	}
+	fmt.Fprintf(stdout, "Version: %d\n", header.Version)
+	fmt.Fprintf(stdout, "Size: %d bytes\n", header.TotalSize)
+	fmt.Fprintf(stdout, "Created: %s\n",
+		time.Unix(int64(header.CreationTime), 0).Format(time.RFC3339))
+	flagNames := []struct {
+		flag uint64
+		name string
+	}{
+		{seeker_fs.ImageFlagChecksums, "checksums"},
+		{seeker_fs.ImageFlagHashTree, "hash tree"},
+		{seeker_fs.ImageFlagCompression, "compression"},
+		{seeker_fs.ImageFlagFooter, "footer"},
+	}
+	for _, f := range flagNames {
+		if (header.Flags & f.flag) != 0 {
+			fmt.Fprintf(stdout, "Uses %s\n", f.name)
+		}
+	}
+	rootHash := sfs.GetRootHash()
+	if rootHash != nil {
+		fmt.Fprintf(stdout, "Root hash: %x\n", rootHash)
+	}
+}
+
+// Prints information about the file at the given path in the FS.
+func printFileInfo(sfs *seeker_fs.SeekerFS, path string,
+	stdout io.Writer) error {
+	info, e := sfs.Lstat(path)
+	if e != nil {
+		return e
+	}
+	fmt.Fprintf(stdout, "Name: %s\n", info.Name())
+	fmt.Fprintf(stdout, "Mode: %s\n", info.Mode())
+	fmt.Fprintf(stdout, "Size: %d\n", info.Size())
+	fmt.Fprintf(stdout, "Modified: %s\n",
+		info.ModTime().Format(time.RFC3339Nano))
+	if (info.Mode() & fs.ModeSymlink) != 0 {
+		target, e := sfs.ReadLink(path)
+		if e != nil {
+			return e
+		}
+		fmt.Fprintf(stdout, "Target: %s\n", target)
+	}
+	sysInfo := info.Sys().(*seeker_fs.FileSys)
+	fmt.Fprintf(stdout, "ID: %d\n", sysInfo.ID)
+	if sysInfo.HasOwner {
+		fmt.Fprintf(stdout, "Owner: %d (%s)\n", sysInfo.UID,
+			sysInfo.UserName)
+		fmt.Fprintf(stdout, "Group: %d (%s)\n", sysInfo.GID,
+			sysInfo.GroupName)
+	}
+	if !sysInfo.AccessTime.IsZero() {
+		fmt.Fprintf(stdout, "Accessed: %s\n",
+			sysInfo.AccessTime.Format(time.RFC3339Nano))
+	}
+	if !sysInfo.ChangeTime.IsZero() {
+		fmt.Fprintf(stdout, "Changed: %s\n",
+			sysInfo.ChangeTime.Format(time.RFC3339Nano))
+	}
+	names, e := sfs.ListXattr(path)
+	if e != nil {
+		return e
+	}
+	for _, name := range names {
+		value, e := sfs.GetXattr(path, name)
+		if e != nil {
+			return e
+		}
+		fmt.Fprintf(stdout, "Xattr: %s=%q\n", name, value)
+	}
+	return nil
+}
+
+func runStat(args []string, stdout io.Writer) error {
+	args, e := parseArgs(newFlagSet("stat"), args, 1, 2)
+	if e != nil {
+		return e
+	}
+	sfs, f, e := loadImage(args[0])
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	if len(args) == 1 {
+		printImageInfo(sfs, stdout)
+		return nil
+	}
+	return printFileInfo(sfs, args[1], stdout)
+}
+
+func runVerify(args []string, stdout io.Writer) error {
+	flags := newFlagSet("verify")
+	rootHashHex := flags.String("root-hash", "", "")
+	args, e := parseArgs(flags, args, 1, 1)
+	if e != nil {
+		return e
+	}
+	var options []seeker_fs.LoadOption
+	if *rootHashHex != "" {
+		rootHash, e := hex.DecodeString(*rootHashHex)
+		if e != nil {
+			return fmt.Errorf("Invalid root hash: %w", e)
+		}
+		options = append(options, seeker_fs.WithRootHash(rootHash))
+	}
+	sfs, f, e := loadImage(args[0], options...)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	report := sfs.GetValidationReport()
+	for _, problem := range report.Problems {
+		fmt.Fprintf(stdout, "Problem: %s\n", problem)
+	}
+
+	// Validation doesn't read files' content, so read every file to check
+	// its checksum.
+	readProblems := 0
+	e = sfs.WalkDir(".", func(path string, d fs.DirEntry, e error) error {
+		// Count unreadable directories and entries as problems, but keep
+		// going so that the report covers everything that can be read.
+		if e != nil {
+			fmt.Fprintf(stdout, "Problem: Failed walking %s: %s\n", path, e)
+			readProblems++
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		toCheck, e := sfs.Open(path)
+		if e == nil {
+			_, e = io.Copy(io.Discard, toCheck)
+			toCheck.Close()
+		}
+		if e != nil {
+			fmt.Fprintf(stdout, "Problem: Failed reading %s: %s\n", path, e)
+			readProblems++
+		}
+		return nil
+	})
+	if e != nil {
+		return e
+	}
+	fmt.Fprintf(stdout, "Checked %d entries (%d bytes of file content)\n",
+		report.EntriesChecked, report.GoodBytes)
+	problemCount := len(report.Problems) + readProblems
+	if problemCount != 0 {
+		return fmt.Errorf("Found %d problems", problemCount)
+	}
+	return nil
+}
+
+// Runs the subcommand named by the first argument.
+func run(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage())
+	}
+	c := commands[args[0]]
+	if c == nil {
+		return fmt.Errorf("Unknown command %q\n\n%s", args[0], usage())
+	}
+	return c.run(args[1:], stdout)
+}
+
+func main() {
+	e := run(os.Args[1:], os.Stdout)
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", e)
+		os.Exit(1)
+	}
+}
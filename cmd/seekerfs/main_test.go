@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Runs the command with the given arguments, failing the test on error.
+// Returns the command's output.
+func runOK(t *testing.T, args ...string) string {
+	var output bytes.Buffer
+	e := run(args, &output)
+	if e != nil {
+		t.Logf("Command %v failed: %s\n", args, e)
+		t.FailNow()
+	}
+	return output.String()
+}
+
+func TestCommands(t *testing.T) {
+	sourceDir := "../../test_data/test_dir"
+	image := filepath.Join(t.TempDir(), "test.sfs")
+	runOK(t, "pack", "-compress", "-dedup", sourceDir, image)
+
+	output := runOK(t, "ls", image)
+	if output != "a\nb/\ntest1.txt\ntest2.txt\n" {
+		t.Logf("Got incorrect ls output:\n%s", output)
+		t.FailNow()
+	}
+	output = runOK(t, "ls", "-l", image, "b/c")
+	t.Logf("ls -l output:\n%s", output)
+	if !strings.Contains(output, " hi.png\n") {
+		t.Logf("Long listing is missing hi.png\n")
+		t.FailNow()
+	}
+
+	expected, e := os.ReadFile(filepath.Join(sourceDir, "b/c/test1.txt"))
+	if e != nil {
+		t.Logf("Failed reading original file: %s\n", e)
+		t.FailNow()
+	}
+	output = runOK(t, "cat", image, "b/c/test1.txt")
+	if output != string(expected) {
+		t.Logf("Got incorrect cat output: %q\n", output)
+		t.FailNow()
+	}
+
+	output = runOK(t, "stat", image)
+	t.Logf("Image info:\n%s", output)
+	if !strings.Contains(output, "Uses compression\n") {
+		t.Logf("Image info doesn't show that compression is used\n")
+		t.FailNow()
+	}
+	output = runOK(t, "stat", image, "b/c/test1.txt")
+	t.Logf("File info:\n%s", output)
+	if !strings.Contains(output, "Name: test1.txt\n") {
+		t.Logf("File info doesn't contain the file's name\n")
+		t.FailNow()
+	}
+	output = runOK(t, "verify", image)
+	t.Logf("Verify output:\n%s", output)
+
+	// Extract a subdirectory, and make sure its content matches.
+	extracted := filepath.Join(t.TempDir(), "extracted")
+	runOK(t, "extract", image, extracted, "b")
+	data, e := os.ReadFile(filepath.Join(extracted, "c/test1.txt"))
+	if e != nil {
+		t.Logf("Failed reading extracted file: %s\n", e)
+		t.FailNow()
+	}
+	if !bytes.Equal(data, expected) {
+		t.Logf("Extracted file has incorrect content: %q\n", data)
+		t.FailNow()
+	}
+
+	// Corrupting a file's content should be detected.
+	corruptDir := t.TempDir()
+	content := []byte("Content that will be corrupted")
+	e = os.WriteFile(filepath.Join(corruptDir, "a.txt"), content, 0644)
+	if e != nil {
+		t.Logf("Failed writing file to corrupt: %s\n", e)
+		t.FailNow()
+	}
+	image = filepath.Join(t.TempDir(), "corrupt.sfs")
+	runOK(t, "pack", corruptDir, image)
+	raw, e := os.ReadFile(image)
+	if e != nil {
+		t.Logf("Failed reading image: %s\n", e)
+		t.FailNow()
+	}
+	contentOffset := bytes.Index(raw, content)
+	if contentOffset < 0 {
+		t.Logf("Couldn't find file content in the image\n")
+		t.FailNow()
+	}
+	raw[contentOffset] ^= 0xff
+	e = os.WriteFile(image, raw, 0644)
+	if e != nil {
+		t.Logf("Failed writing corrupted image: %s\n", e)
+		t.FailNow()
+	}
+	var verifyOutput bytes.Buffer
+	e = run([]string{"verify", image}, &verifyOutput)
+	if e == nil {
+		t.Logf("Didn't get expected error verifying a corrupt image\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error verifying a corrupt image: %s\n%s", e,
+		verifyOutput.String())
+
+	// A bad entry shouldn't stop verify from checking the rest of the image.
+	content = []byte("More content that will be corrupted")
+	e = os.Mkdir(filepath.Join(corruptDir, "zz"), 0755)
+	if e == nil {
+		e = os.WriteFile(filepath.Join(corruptDir, "zzz.txt"), content, 0644)
+	}
+	if e != nil {
+		t.Logf("Failed creating files to corrupt: %s\n", e)
+		t.FailNow()
+	}
+	image = filepath.Join(t.TempDir(), "bad_entry.sfs")
+	runOK(t, "pack", corruptDir, image)
+	raw, e = os.ReadFile(image)
+	if e != nil {
+		t.Logf("Failed reading image: %s\n", e)
+		t.FailNow()
+	}
+	nameOffset := bytes.Index(raw, []byte("zz\x00"))
+	contentOffset = bytes.Index(raw, content)
+	if (nameOffset < 0) || (contentOffset < 0) {
+		t.Logf("Couldn't find the data to corrupt in the image\n")
+		t.FailNow()
+	}
+	copy(raw[nameOffset:], "..")
+	raw[contentOffset] ^= 0xff
+	e = os.WriteFile(image, raw, 0644)
+	if e != nil {
+		t.Logf("Failed writing corrupted image: %s\n", e)
+		t.FailNow()
+	}
+	verifyOutput.Reset()
+	e = run([]string{"verify", image}, &verifyOutput)
+	if e == nil {
+		t.Logf("Didn't get expected error verifying a bad entry\n")
+		t.FailNow()
+	}
+	output = verifyOutput.String()
+	t.Logf("Got expected error verifying a bad entry: %s\n%s", e, output)
+	if !strings.Contains(output, "Failed walking") ||
+		!strings.Contains(output, "Failed reading zzz.txt") {
+		t.Logf("Verify didn't report both the bad entry and bad content\n")
+		t.FailNow()
+	}
+
+	// Check some bad usage.
+	badArgs := [][]string{
+		{},
+		{"bad_command"},
+		{"cat", image},
+		{"ls", "-bad_flag", image},
+	}
+	for _, args := range badArgs {
+		e = run(args, &bytes.Buffer{})
+		if e == nil {
+			t.Logf("Didn't get expected error for args %v\n", args)
+			t.FailNow()
+		}
+		t.Logf("Got expected error for args %v: %s\n", args, e)
+	}
+}
+
+// Packs a directory containing the given files, then replaces every
+// occurrence of the short name oldName in the image with newName, which must
+// have the same length.
+func createRenamedImage(t *testing.T, files []string, oldName,
+	newName string) string {
+	sourceDir := t.TempDir()
+	for _, name := range files {
+		hostPath := filepath.Join(sourceDir, filepath.FromSlash(name))
+		e := os.MkdirAll(filepath.Dir(hostPath), 0755)
+		if e == nil {
+			e = os.WriteFile(hostPath, []byte(name), 0644)
+		}
+		if e != nil {
+			t.Logf("Failed creating %s: %s\n", name, e)
+			t.FailNow()
+		}
+	}
+	image := filepath.Join(t.TempDir(), "renamed.sfs")
+	runOK(t, "pack", sourceDir, image)
+	raw, e := os.ReadFile(image)
+	if e != nil {
+		t.Logf("Failed reading image: %s\n", e)
+		t.FailNow()
+	}
+	// Short names are padded to 8 bytes using zeros.
+	padding := make([]byte, 8-len(oldName))
+	oldBytes := append([]byte(oldName), padding...)
+	newBytes := append([]byte(newName), padding...)
+	raw = bytes.ReplaceAll(raw, oldBytes, newBytes)
+	e = os.WriteFile(image, raw, 0644)
+	if e != nil {
+		t.Logf("Failed writing renamed image: %s\n", e)
+		t.FailNow()
+	}
+	return image
+}
+
+func TestExtractEscape(t *testing.T) {
+	images := map[string]string{
+		"parent dir name": createRenamedImage(t, []string{"zz/x.txt"}, "zz",
+			".."),
+		"duplicate names": createRenamedImage(t, []string{"a/x.txt",
+			"b/y.txt"}, "b", "a"),
+	}
+	for name, image := range images {
+		parent := t.TempDir()
+		e := run([]string{"extract", image, filepath.Join(parent, "out")},
+			&bytes.Buffer{})
+		if e == nil {
+			t.Logf("Didn't get expected error extracting image with %s\n",
+				name)
+			t.FailNow()
+		}
+		t.Logf("Got expected error extracting image with %s: %s\n", name, e)
+		entries, e := os.ReadDir(parent)
+		if e != nil {
+			t.Logf("Failed reading extraction parent dir: %s\n", e)
+			t.FailNow()
+		}
+		if len(entries) != 0 {
+			t.Logf("Extracting image with %s created %d files\n", name,
+				len(entries))
+			t.FailNow()
+		}
+	}
+
+	// Paths must stay in the destination, and parents must be directories
+	// that were extracted.
+	destination := t.TempDir()
+	info, e := os.Stat(destination)
+	if e != nil {
+		t.Logf("Failed getting destination info: %s\n", e)
+		t.FailNow()
+	}
+	dirs := map[string]fs.FileInfo{destination: info}
+	_, e = getExtractPath(destination, "a.txt", dirs)
+	if e != nil {
+		t.Logf("Failed getting valid extraction path: %s\n", e)
+		t.FailNow()
+	}
+	for _, path := range []string{"../a.txt", "a/../../b", "link/a.txt"} {
+		_, e = getExtractPath(destination, path, dirs)
+		if e == nil {
+			t.Logf("Didn't get expected error for extracting %s\n", path)
+			t.FailNow()
+		}
+		t.Logf("Got expected error for extracting %s: %s\n", path, e)
+	}
+}
@@ -0,0 +1,250 @@
+package seeker_fs
+
+// This file contains code for compressing and decompressing file content.
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Identifies how a file's content is compressed.
+type CompressionCodec uint64
+
+const (
+	// The file's content is stored without compression.
+	CompressionNone CompressionCodec = iota
+	// The file's content is compressed using DEFLATE (see compress/flate).
+	CompressionDeflate
+)
+
+func (c CompressionCodec) String() string {
+	switch c {
+	case CompressionNone:
+		return "store"
+	case CompressionDeflate:
+		return "deflate"
+	}
+	return fmt.Sprintf("unknown codec %d", uint64(c))
+}
+
+// Returns an error if the codec isn't supported.
+func (c CompressionCodec) check() error {
+	if c > CompressionDeflate {
+		return fmt.Errorf("Unsupported compression codec: %s", c)
+	}
+	return nil
+}
+
+// The default size of the chunks of uncompressed content that are compressed
+// independently.
+const DefaultCompressionChunkSize = 64 * 1024
+
+// The largest supported chunk size. This limits the memory needed to
+// decompress a chunk of a corrupt or malicious image.
+const maxCompressionChunkSize = 16 * 1024 * 1024
+
+// Set in an entry of a compressed file's chunk table if the chunk was stored
+// without compression.
+const chunkStoredFlag = uint64(1) << 63
+
+// Stored in a file's extra metadata record if its content is compressed. The
+// file's Size field always contains the uncompressed size.
+//
+// The content is split into chunks of ChunkSize bytes (the last may be
+// shorter), each of which is compressed independently, so that reading from
+// any offset only requires decompressing a single chunk. The file's data
+// starts with a table containing a uint64 for each chunk: the offset of the end
+// of the chunk's data, relative to the file's DataOffset. Each chunk's data
+// starts where the previous chunk's data ends, or immediately after the table
+// for the first chunk. If the table entry has the chunkStoredFlag bit set, the
+// chunk is stored without compression.
+type compressionInfo struct {
+	// The codec used to compress the file's content.
+	Codec CompressionCodec
+	// The size of the compressed content in the data stream, including the
+	// chunk table.
+	StoredSize uint64
+	// The size of each chunk of uncompressed content.
+	ChunkSize uint64
+}
+
+// Returns an error if the compression info isn't usable.
+func (c *compressionInfo) check() error {
+	e := c.Codec.check()
+	if e != nil {
+		return e
+	}
+	if (c.ChunkSize == 0) || (c.ChunkSize > maxCompressionChunkSize) {
+		return fmt.Errorf("Invalid compression chunk size: %d", c.ChunkSize)
+	}
+	return nil
+}
+
+// DEFLATE can't compress data by more than a factor of about 1032, so no
+// valid compressed file can be larger than this multiple of its stored size.
+const maxCompressionRatio = 1032
+
+// Returns an error if the compressed content can't possibly contain the given
+// number of uncompressed bytes: either its chunk table wouldn't fit in the
+// stored content, or it would need to be compressed too well. This makes it
+// safe to allocate size bytes for the uncompressed content.
+func (c *compressionInfo) checkSize(size uint64) error {
+	chunkCount := size / c.ChunkSize
+	if (size % c.ChunkSize) != 0 {
+		chunkCount++
+	}
+	if chunkCount > (c.StoredSize / 8) {
+		return fmt.Errorf("Chunk table for %d bytes doesn't fit in %d bytes "+
+			"of compressed content", size, c.StoredSize)
+	}
+	if (size / maxCompressionRatio) > c.StoredSize {
+		return fmt.Errorf("%d bytes of compressed content can't contain %d "+
+			"bytes", c.StoredSize, size)
+	}
+	return nil
+}
+
+// Compresses the given content using the given codec. Returns nil if the
+// compressed content wouldn't be smaller than the original.
+func compressContent(content []byte, codec CompressionCodec) ([]byte,
+	error) {
+	if codec != CompressionDeflate {
+		return nil, fmt.Errorf("Can't compress using codec %s", codec)
+	}
+	var compressed bytes.Buffer
+	w, e := flate.NewWriter(&compressed, flate.BestCompression)
+	if e != nil {
+		return nil, fmt.Errorf("Failed creating compressor: %w", e)
+	}
+	_, e = w.Write(content)
+	if e != nil {
+		return nil, fmt.Errorf("Failed compressing content: %w", e)
+	}
+	e = w.Close()
+	if e != nil {
+		return nil, fmt.Errorf("Failed finishing compression: %w", e)
+	}
+	if compressed.Len() >= len(content) {
+		return nil, nil
+	}
+	return compressed.Bytes(), nil
+}
+
+// Reads the uncompressed content of a compressed file, one chunk at a time.
+type decompressor struct {
+	// The FS containing the file.
+	p *SeekerFS
+	// The compressed file's header.
+	f *File
+	// Describes how the file's content is compressed.
+	info *compressionInfo
+	// The uncompressed content of the most recently read chunk. Will be nil if
+	// no chunk has been read yet.
+	chunk []byte
+	// The index of the chunk in the chunk slice.
+	chunkIndex uint64
+}
+
+func newDecompressor(p *SeekerFS, f *File, extra *fileExtra) *decompressor {
+	return &decompressor{
+		p:    p,
+		f:    f,
+		info: &(extra.compression),
+	}
+}
+
+// Returns the start and end offsets of the given chunk's data, relative to
+// the file's DataOffset, along with whether the chunk is compressed.
+func (d *decompressor) getChunkLocation(index uint64) (uint64, uint64, bool,
+	error) {
+	chunkCount := (d.f.Size + d.info.ChunkSize - 1) / d.info.ChunkSize
+	tableOffset := d.f.DataOffset
+	var start, end uint64
+	if index == 0 {
+		start = chunkCount * 8
+		raw, e := d.p.getBytes(tableOffset, 8)
+		if e != nil {
+			return 0, 0, false, e
+		}
+		end = binary.LittleEndian.Uint64(raw)
+	} else {
+		raw, e := d.p.getBytes(tableOffset+(index-1)*8, 16)
+		if e != nil {
+			return 0, 0, false, e
+		}
+		start = binary.LittleEndian.Uint64(raw[0:8]) &^ chunkStoredFlag
+		end = binary.LittleEndian.Uint64(raw[8:16])
+	}
+	compressed := (end & chunkStoredFlag) == 0
+	end &^= chunkStoredFlag
+	if (end < start) || (end > d.info.StoredSize) {
+		return 0, 0, false, fmt.Errorf("Invalid location of compressed "+
+			"chunk %d: %d to %d", index, start, end)
+	}
+	return start, end, compressed, nil
+}
+
+// Reads and decompresses the chunk with the given index, unless it's already
+// been loaded.
+func (d *decompressor) loadChunk(index uint64) error {
+	if (d.chunk != nil) && (d.chunkIndex == index) {
+		return nil
+	}
+	start, end, compressed, e := d.getChunkLocation(index)
+	if e != nil {
+		return e
+	}
+	raw, e := d.p.getBytes(d.f.DataOffset+start, end-start)
+	if e != nil {
+		return fmt.Errorf("Failed reading compressed chunk %d: %w", index, e)
+	}
+	size := d.f.Size - index*d.info.ChunkSize
+	if size > d.info.ChunkSize {
+		size = d.info.ChunkSize
+	}
+	if uint64(cap(d.chunk)) < size {
+		d.chunk = make([]byte, size)
+	}
+	d.chunk = d.chunk[0:size]
+	if !compressed {
+		if uint64(len(raw)) != size {
+			d.chunk = nil
+			return fmt.Errorf("Uncompressed chunk %d has incorrect size %d",
+				index, len(raw))
+		}
+		copy(d.chunk, raw)
+	} else {
+		reader := flate.NewReader(bytes.NewReader(raw))
+		_, e = io.ReadFull(reader, d.chunk)
+		reader.Close()
+		if e != nil {
+			d.chunk = nil
+			return fmt.Errorf("Failed decompressing chunk %d: %w", index, e)
+		}
+	}
+	d.chunkIndex = index
+	return nil
+}
+
+// Fills the data slice with uncompressed content starting at the given offset
+// in the file.
+func (d *decompressor) readAt(data []byte, offset uint64) error {
+	for len(data) != 0 {
+		index := offset / d.info.ChunkSize
+		e := d.loadChunk(index)
+		if e != nil {
+			return e
+		}
+		n := copy(data, d.chunk[offset-index*d.info.ChunkSize:])
+		data = data[n:]
+		offset += uint64(n)
+	}
+	return nil
+}
+
+// Releases the decompressor's buffer.
+func (d *decompressor) close() {
+	d.chunk = nil
+}
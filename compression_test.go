@@ -0,0 +1,308 @@
+package seeker_fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestCompression(t *testing.T) {
+	baseFS := fstest.MapFS(make(map[string]*fstest.MapFile))
+	text := strings.Repeat("Hello, compressed world! ", 4000)
+	baseFS["text.txt"] = newMapFile(text)
+	baseFS["short.txt"] = newMapFile("hi")
+	baseFS["dir/more_text.txt"] = newMapFile(text + "more")
+	// Include a file where some chunks won't get smaller when compressed.
+	random := make([]byte, 10000)
+	rand.New(rand.NewSource(1337)).Read(random)
+	baseFS["mixed.bin"] = newMapFile(string(random) + text)
+	settings := CreateFSSettings{
+		Compression:          CompressionDeflate,
+		CompressionChunkSize: 4096,
+		StatusLog:            &testLogger{t},
+	}
+	data := NewSeekableBuffer()
+	e := CreateSeekerFS(baseFS, data, &settings)
+	if e != nil {
+		t.Logf("Failed creating compressed seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	imageSize := len(getBufferBytes(t, data))
+	if imageSize >= len(text)+len(random) {
+		t.Logf("Image is %d bytes, but one file alone is %d bytes.\n",
+			imageSize, len(text)+len(random))
+		t.Fail()
+	}
+	sfs, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading compressed seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	if (sfs.GetImageHeader().Flags & ImageFlagCompression) == 0 {
+		t.Logf("The image header doesn't indicate compression is used.\n")
+		t.Fail()
+	}
+	e = sfs.Validate()
+	if e != nil {
+		t.Logf("Validating compressed FS failed: %s\n", e)
+		t.FailNow()
+	}
+	e = fstest.TestFS(sfs, "text.txt", "short.txt", "dir/more_text.txt",
+		"mixed.bin")
+	if e != nil {
+		t.Logf("TestFS failed on compressed FS: %s\n", e)
+		t.FailNow()
+	}
+	info, e := fs.Stat(sfs, "text.txt")
+	if e != nil {
+		t.Logf("Failed getting info for text.txt: %s\n", e)
+		t.FailNow()
+	}
+	if info.Size() != int64(len(text)) {
+		t.Logf("Expected text.txt to be %d bytes, got %d\n", len(text),
+			info.Size())
+		t.Fail()
+	}
+
+	// Make sure seeking backwards and forwards in a compressed file works,
+	// including reads that span chunk boundaries.
+	f, e := sfs.Open("text.txt")
+	if e != nil {
+		t.Logf("Failed opening text.txt: %s\n", e)
+		t.FailNow()
+	}
+	defer f.Close()
+	seeker := f.(io.ReadSeeker)
+	buffer := make([]byte, 10)
+	for _, offset := range []int64{50000, 100, 99990, 0, 4090, 8190} {
+		_, e = seeker.Seek(offset, io.SeekStart)
+		if e != nil {
+			t.Logf("Failed seeking to offset %d: %s\n", offset, e)
+			t.FailNow()
+		}
+		_, e = io.ReadFull(seeker, buffer)
+		if e != nil {
+			t.Logf("Failed reading at offset %d: %s\n", offset, e)
+			t.FailNow()
+		}
+		expected := []byte(text[offset : offset+10])
+		if !bytes.Equal(buffer, expected) {
+			t.Logf("Read %q at offset %d, expected %q\n", buffer, offset,
+				expected)
+			t.FailNow()
+		}
+	}
+}
+
+// Returns a compressed FS containing a single compressed file named text.txt,
+// along with the FS's data and the offset of the file's header.
+func createCompressedTestFS(t *testing.T, chunkSize int64) (*SeekerFS,
+	io.ReadWriteSeeker, uint64) {
+	baseFS := fstest.MapFS{
+		"text.txt": newMapFile(strings.Repeat("Compressible text. ", 1000)),
+	}
+	data := NewSeekableBuffer()
+	e := CreateSeekerFS(baseFS, data, &CreateFSSettings{
+		Compression:          CompressionDeflate,
+		CompressionChunkSize: chunkSize,
+	})
+	if e != nil {
+		t.Logf("Failed creating compressed seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading compressed seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	_, offset, e := resolveFilePath(sfs.topFile, sfs.topOffset, sfs,
+		"text.txt", false)
+	if e != nil {
+		t.Logf("Failed finding text.txt: %s\n", e)
+		t.FailNow()
+	}
+	return sfs, data, offset
+}
+
+func TestCorruptCompressedSize(t *testing.T) {
+	sfs, data, offset := createCompressedTestFS(t, 4096)
+	// The Size field is at offset 48 in the File struct. This size would
+	// require an enormous allocation if it were trusted.
+	newSize := make([]byte, 8)
+	binary.LittleEndian.PutUint64(newSize, 1<<40)
+	corruptBuffer(t, data, int64(offset)+48, newSize)
+	_, e := sfs.ReadFile("text.txt")
+	if e == nil {
+		t.Logf("Didn't get expected error reading a file with a corrupt " +
+			"size\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error reading a file with a corrupt size: %s\n", e)
+}
+
+func TestCorruptStoredChunk(t *testing.T) {
+	sfs, data, _ := createCompressedTestFS(t, 4096)
+	f, _, e := resolveFilePath(sfs.topFile, sfs.topOffset, sfs, "text.txt",
+		false)
+	if e != nil {
+		t.Logf("Failed finding text.txt: %s\n", e)
+		t.FailNow()
+	}
+	expected, e := sfs.ReadFile("text.txt")
+	if e != nil {
+		t.Logf("Failed reading text.txt: %s\n", e)
+		t.FailNow()
+	}
+	// Mark the last (short) chunk as stored without compression, so its
+	// size will be incorrect.
+	lastChunk := (f.Size - 1) / 4096
+	entryOffset := int64(f.DataOffset + lastChunk*8)
+	raw := getBufferBytes(t, data)
+	entry := binary.LittleEndian.Uint64(raw[entryOffset:])
+	newEntry := make([]byte, 8)
+	binary.LittleEndian.PutUint64(newEntry, entry|chunkStoredFlag)
+	corruptBuffer(t, data, entryOffset, newEntry)
+
+	file, e := sfs.Open("text.txt")
+	if e != nil {
+		t.Logf("Failed opening text.txt: %s\n", e)
+		t.FailNow()
+	}
+	defer file.Close()
+	seeker := file.(io.ReadSeeker)
+	buffer := make([]byte, 10)
+	_, e = io.ReadFull(seeker, buffer)
+	if e != nil {
+		t.Logf("Failed reading the first chunk: %s\n", e)
+		t.FailNow()
+	}
+	_, e = seeker.Seek(int64(lastChunk*4096), io.SeekStart)
+	if e == nil {
+		_, e = io.ReadFull(seeker, buffer)
+	}
+	if e == nil {
+		t.Logf("Didn't get expected error reading the corrupt chunk\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error reading the corrupt chunk: %s\n", e)
+
+	// Reading the first chunk again must not use the corrupt chunk's data.
+	_, e = seeker.Seek(4000, io.SeekStart)
+	if e == nil {
+		_, e = io.ReadFull(seeker, buffer)
+	}
+	if e != nil {
+		t.Logf("Failed re-reading the first chunk: %s\n", e)
+		t.FailNow()
+	}
+	if !bytes.Equal(buffer, expected[4000:4010]) {
+		t.Logf("Got incorrect content re-reading the first chunk: %q\n",
+			buffer)
+		t.FailNow()
+	}
+}
+
+// Wraps an FS, hiding every method of its regular files other than those of
+// fs.File, so that they can't seek.
+type noSeekFS struct {
+	fs.FS
+}
+
+func (f noSeekFS) Open(name string) (fs.File, error) {
+	file, e := f.FS.Open(name)
+	if e != nil {
+		return nil, e
+	}
+	_, isDir := file.(fs.ReadDirFile)
+	if isDir {
+		return file, nil
+	}
+	return struct{ fs.File }{file}, nil
+}
+
+func TestIncompressibleContent(t *testing.T) {
+	random := make([]byte, 300000)
+	rand.New(rand.NewSource(1337)).Read(random)
+	baseFS := fstest.MapFS{
+		"random.bin": newMapFile(string(random)),
+	}
+	getImageSize := func(compression CompressionCodec, streaming bool) int {
+		settings := &CreateFSSettings{
+			Compression:  compression,
+			CreationTime: time.Unix(1234567890, 0),
+		}
+		if streaming {
+			var output writeOnlyBuffer
+			e := CreateSeekerFSStream(baseFS, &output, settings)
+			if e != nil {
+				t.Logf("Failed creating streaming FS: %s\n", e)
+				t.FailNow()
+			}
+			return output.b.Len()
+		}
+		data := NewSeekableBuffer()
+		e := CreateSeekerFS(baseFS, data, settings)
+		if e != nil {
+			t.Logf("Failed creating FS: %s\n", e)
+			t.FailNow()
+		}
+		sfs, e := LoadSeekerFS(data)
+		if e != nil {
+			t.Logf("Failed loading FS: %s\n", e)
+			t.FailNow()
+		}
+		if (sfs.GetImageHeader().Flags & ImageFlagCompression) != 0 {
+			t.Logf("Image with incompressible content uses compression\n")
+			t.FailNow()
+		}
+		return len(getBufferBytes(t, data))
+	}
+	for _, streaming := range []bool{false, true} {
+		plainSize := getImageSize(CompressionNone, streaming)
+		compressedSize := getImageSize(CompressionDeflate, streaming)
+		t.Logf("Image sizes with streaming = %v: %d plain, %d compressed\n",
+			streaming, plainSize, compressedSize)
+		if plainSize != compressedSize {
+			t.Logf("Incompressible content wasn't stored as-is\n")
+			t.FailNow()
+		}
+	}
+
+	// If a later chunk gets smaller, but the earlier chunks can't be read
+	// again, the content should still be stored correctly.
+	text := strings.Repeat("Hello, compressed world! ", 4000)
+	baseFS["mixed.bin"] = newMapFile(string(random) + text)
+	data := NewSeekableBuffer()
+	e := CreateSeekerFS(noSeekFS{baseFS}, data, &CreateFSSettings{
+		Compression: CompressionDeflate,
+	})
+	if e != nil {
+		t.Logf("Failed creating FS from unseekable files: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading FS created from unseekable files: %s\n", e)
+		t.FailNow()
+	}
+	e = sfs.Validate()
+	if e != nil {
+		t.Logf("Validating FS created from unseekable files failed: %s\n", e)
+		t.FailNow()
+	}
+	content, e := sfs.ReadFile("mixed.bin")
+	if e != nil {
+		t.Logf("Failed reading mixed.bin: %s\n", e)
+		t.FailNow()
+	}
+	if string(content) != (string(random) + text) {
+		t.Logf("Got incorrect content for mixed.bin\n")
+		t.FailNow()
+	}
+}
@@ -3,11 +3,17 @@ package seeker_fs
 // This file contains code related to creating a new seeker_fs from a different
 // FS.
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"io/fs"
 	"sort"
+	"time"
 )
 
 // Holds a file that needs to have its *data* appended to the output stream.
@@ -16,12 +22,14 @@ type fileToProcess struct {
 	// The file with the data to be written to the output stream. We'll write
 	// its name and data to the output stream.  If its a directory, we'll add
 	// its entries to the queue of files to process, too. Will be closed after
-	// processing.
+	// processing. Will be nil if the file is a symbolic link, which isn't
+	// opened, as opening it would follow the link.
 	toProcess fs.File
 	// The path to this file. Will be "." for the root directory, the rest
 	// of the files will *not* include the leading ".".
 	path string
-	// The offset in the output stream reserved for the file's header.
+	// The offset in the output stream reserved for the file's header. Will be
+	// -1 when creating a streaming image, as headers can't be reserved.
 	fileHeaderOffset int64
 	// The depth of this file. (The number of directories past root that
 	// must be traversed to reach it.)
@@ -43,6 +51,29 @@ type CreateFSSettings struct {
 	// If non-nil, creating the SeekerFS will result in human-readable status
 	// messages to this.
 	StatusLog io.Writer
+	// If true, don't store checksums of regular files' content. Checksums are
+	// verified whenever a file is read to the end.
+	DisableChecksums bool
+	// The codec used to compress each regular file's content. Content that
+	// doesn't get smaller when compressed is stored uncompressed. Defaults to
+	// CompressionNone.
+	Compression CompressionCodec
+	// If true, files with identical content will share a single copy of the
+	// content in the output. This requires reading each file's content twice.
+	Deduplicate bool
+	// The size of the chunks of each file's content that are compressed
+	// independently. Smaller chunks make seeking in compressed files faster,
+	// but may compress less effectively. Defaults to
+	// DefaultCompressionChunkSize if <= 0.
+	CompressionChunkSize int64
+	// The creation time to record in the image's header. The current time is
+	// used if this is the zero time. Setting this allows reproducible output.
+	CreationTime time.Time
+	// If true, store each file's access and status change times when the
+	// input provides them. These change whenever the input is read or its
+	// metadata is modified, so storing them prevents identical inputs from
+	// producing identical images.
+	StoreAccessTimes bool
 }
 
 // A simple type to wrap our depth-first traversal.
@@ -60,6 +91,62 @@ type outputQueue struct {
 	// The number of files and directories that have been enqueued so far,
 	// including those that have already been processed.
 	totalFilesWritten int64
+	// The ImageHeader flags for features used by the files written so far.
+	imageFlags uint64
+	// Maps the SHA-256 hashes of file content to where the content was
+	// written. Only used if deduplication is enabled.
+	writtenContent map[[sha256.Size]byte]*writtenContent
+	// The number of bytes that didn't need to be written due to
+	// deduplication.
+	bytesDeduplicated uint64
+	// Tracks regular files with multiple hard links in the source FS, so that
+	// later links can refer to the first one that was written.
+	linkedFiles map[sourceFileID]*linkedFile
+	// Caches the names of users and groups that own files in the source FS,
+	// keyed by their numeric IDs.
+	userNames  map[uint32]string
+	groupNames map[uint32]string
+	// True if the output can't seek backwards. In this case, output is only
+	// ever appended to, and headers are written after the content they refer
+	// to. See CreateSeekerFSStream.
+	streaming bool
+}
+
+// Returns a new outputQueue for copying the input FS to the output.
+func newOutputQueue(f fs.FS, output io.WriteSeeker,
+	settings *CreateFSSettings) *outputQueue {
+	return &outputQueue{
+		unprocessed:    make([]fileToProcess, 0, 1000),
+		inputFS:        f,
+		output:         output,
+		settings:       settings,
+		writtenContent: make(map[[sha256.Size]byte]*writtenContent),
+		linkedFiles:    make(map[sourceFileID]*linkedFile),
+		userNames:      make(map[uint32]string),
+		groupNames:     make(map[uint32]string),
+	}
+}
+
+// Identifies a file in the FS passed to CreateSeekerFS, for the purpose of
+// detecting hard links.
+type sourceFileID struct {
+	device uint64
+	inode  uint64
+}
+
+// Holds information about the first link to a hard-linked file that was
+// written to the output.
+type linkedFile struct {
+	// The path to the first link.
+	path string
+	// The file ID shared by all links. This is the offset of the first link's
+	// header, unless the first link was given an explicit ID.
+	fileID uint64
+	// The location and size of the shared content.
+	dataOffset int64
+	size       int64
+	// The checksum and compression info for the content.
+	extra fileExtra
 }
 
 func (q *outputQueue) LogStatus(format string, args ...interface{}) {
@@ -142,11 +229,9 @@ func (q *outputQueue) writeDataAtLocation(toWrite interface{},
 	return nil
 }
 
-// Reserves space for the file's header in the output stream (by writing the
-// correct number of zeros), and enqueues the file in the list of files with
-// content to be written.
-func (q *outputQueue) reserveHeaderAndEnqueue(f fs.File, path string,
-	depth int) error {
+// Counts a new file at the given depth towards the limits in q's settings.
+// Returns an error if any limits are exceeded.
+func (q *outputQueue) checkEntryLimits(depth int) error {
 	// Check the limit on the number of files to write.
 	fileLimit := q.settings.MaxTotalEntries
 	if (fileLimit > 0) && (q.totalFilesWritten >= fileLimit) {
@@ -157,6 +242,18 @@ func (q *outputQueue) reserveHeaderAndEnqueue(f fs.File, path string,
 	if (depthLimit > 0) && (depth > depthLimit) {
 		return fmt.Errorf("Exceeded directory depth limit of %d", depthLimit)
 	}
+	return nil
+}
+
+// Reserves space for the file's header in the output stream (by writing the
+// correct number of zeros), and enqueues the file in the list of files with
+// content to be written.
+func (q *outputQueue) reserveHeaderAndEnqueue(f fs.File, path string,
+	depth int) error {
+	e := q.checkEntryLimits(depth)
+	if e != nil {
+		return e
+	}
 	// Write an empty header to the end of the stream.
 	headerOffset, e := q.writeDataAndGetLocation(File{})
 	if e != nil {
@@ -176,63 +273,649 @@ func (q *outputQueue) reserveHeaderAndEnqueue(f fs.File, path string,
 // Converts the given fs.File into a seeker_fs.File struct, without NameOffset,
 // DataOffset, or Size being set.
 func getSeekerFSHeader(info fs.FileInfo) *File {
+	return newFileHeader(info.Name(), info.Mode(), info.ModTime())
+}
+
+// Returns a seeker_fs.File struct for a file with the given name, mode, and
+// modification time, without NameOffset, DataOffset, or Size being set.
+func newFileHeader(name string, mode fs.FileMode, modTime time.Time) *File {
 	var toReturn File
 	copy(toReturn.Magic[:], []byte("1337FILE"))
-	toReturn.Mode = uint64(info.Mode())
-	name := info.Name()
+	toReturn.Mode = uint64(mode)
 	copy(toReturn.ShortName[0:8], []byte(name))
 	toReturn.NameSize = uint64(len(name))
-	toReturn.ModTime = uint64(info.ModTime().Unix())
+	toReturn.ModTime = uint64(modTime.Unix())
 	return &toReturn
 }
 
-// Requires the queueEntry to be a regular file; writes its name and content to
-// the output stream, followed by writing its header.
+// Removes the access and status change times from the extra metadata record,
+// unless the settings ask for them to be stored.
+func (q *outputQueue) filterAccessTimes(extra *fileExtra) {
+	if q.settings.StoreAccessTimes {
+		return
+	}
+	extra.hasAccessTime = false
+	extra.accessTime = 0
+	extra.hasChangeTime = false
+	extra.changeTime = 0
+}
+
+// Returns a new extra metadata record containing the ownership and timestamps
+// of the given file from the input FS, if they're available. Copies this info
+// from the *FileSys if the input FS is another SeekerFS.
+func (q *outputQueue) newFileExtra(info fs.FileInfo) *fileExtra {
+	toReturn := &fileExtra{
+		modTimeNsec: uint32(info.ModTime().Nanosecond()),
+	}
+	sysInfo, ok := info.Sys().(*FileSys)
+	if !ok {
+		q.setHostMetadata(info, toReturn)
+		q.filterAccessTimes(toReturn)
+		return toReturn
+	}
+	toReturn.hasOwner = sysInfo.HasOwner
+	toReturn.owner = fileOwner{
+		UID: sysInfo.UID,
+		GID: sysInfo.GID,
+	}
+	toReturn.userName = sysInfo.UserName
+	toReturn.groupName = sysInfo.GroupName
+	if !sysInfo.AccessTime.IsZero() {
+		toReturn.hasAccessTime = true
+		toReturn.accessTime = sysInfo.AccessTime.UnixNano()
+	}
+	if !sysInfo.ChangeTime.IsZero() {
+		toReturn.hasChangeTime = true
+		toReturn.changeTime = sysInfo.ChangeTime.UnixNano()
+	}
+	q.filterAccessTimes(toReturn)
+	return toReturn
+}
+
+// If the input FS implements XattrFS, reads the extended attributes of the file
+// at the given path into the extra metadata record.
+func (q *outputQueue) readXattrs(path string, extra *fileExtra) error {
+	xattrFS, ok := q.inputFS.(XattrFS)
+	if !ok {
+		return nil
+	}
+	names, e := xattrFS.ListXattr(path)
+	if e != nil {
+		return fmt.Errorf("Failed listing extended attributes: %w", e)
+	}
+	sort.Strings(names)
+	totalSize := 0
+	extra.xattrs = make([]fileXattr, 0, len(names))
+	for i, name := range names {
+		if (name == "") || ((i > 0) && (name == names[i-1])) {
+			continue
+		}
+		value, e := xattrFS.GetXattr(path, name)
+		if e != nil {
+			// The attribute may have been removed after it was listed.
+			if errors.Is(e, ErrNoXattr) {
+				continue
+			}
+			return fmt.Errorf("Failed reading extended attribute %s: %w",
+				name, e)
+		}
+		totalSize += binary.Size(xattrHeader{}) + len(name) + len(value)
+		if totalSize > maxXattrTableSize {
+			return fmt.Errorf("Extended attributes exceed the limit of %d "+
+				"bytes", maxXattrTableSize)
+		}
+		extra.xattrs = append(extra.xattrs, fileXattr{
+			name:  name,
+			value: value,
+		})
+	}
+	return nil
+}
+
+// Writes the file's name and extra metadata record, if necessary, and updates
+// the header's NameOffset and flags accordingly. The name is only written if
+// it doesn't fit in the ShortName field or if there's an extra record to
+// write. Expects the header's other name-related fields to already be set.
+func (q *outputQueue) writeNameAndExtra(header *File, name string,
+	extra *fileExtra) error {
+	if extra.isEmpty() {
+		// Only write names longer than 8 bytes, as they otherwise fit in the
+		// ShortName field of the File struct.
+		if len(name) <= 8 {
+			return nil
+		}
+		nameOffset, e := q.writeDataAndGetLocation([]byte(name))
+		if e != nil {
+			return e
+		}
+		header.NameOffset = uint64(nameOffset)
+		return nil
+	}
+	// The extra record must immediately follow the name.
+	toWrite := append([]byte(name), extra.encode()...)
+	nameOffset, e := q.writeDataAndGetLocation(toWrite)
+	if e != nil {
+		return e
+	}
+	header.NameOffset = uint64(nameOffset)
+	header.Mode |= FileFlagHasExtra
+	return nil
+}
+
+// Reads size bytes of content from the source, and writes it to the end of the
+// output, compressed using the codec specified in q's settings. Content is
+// compressed in independent chunks (see compressionInfo), and chunks that don't
+// get smaller are stored uncompressed. If no chunk gets smaller, the content is
+// written without compression or a chunk table. Updates the extra metadata to
+// indicate whether the content was compressed. If size is negative, reads the
+// source until EOF instead; this is only possible if the output is streaming,
+// as the size of the chunk table isn't known until every chunk has been read.
+//
+// Chunks are written uncompressed until one of them gets smaller. If this
+// happens after some chunks were already written to a non-streaming output,
+// restart is called to read the content again from the start, so that the
+// chunk table can be written in front of them. If restart is nil, the rest of
+// the content is written uncompressed instead.
+func (q *outputQueue) writeCompressedContent(source io.Reader, size int64,
+	extra *fileExtra, restart func() error) error {
+	codec := q.settings.Compression
+	chunkSize := q.settings.CompressionChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultCompressionChunkSize
+	}
+	if chunkSize > maxCompressionChunkSize {
+		return fmt.Errorf("Compression chunk size %d is too large",
+			chunkSize)
+	}
+	unsized := size < 0
+	if unsized && !q.streaming {
+		return fmt.Errorf("The size of compressed content must be known " +
+			"unless the output is streaming")
+	}
+	chunkCount := int64(-1)
+	if !unsized {
+		chunkCount = (size + chunkSize - 1) / chunkSize
+		if chunkSize > size {
+			chunkSize = size
+		}
+	}
+	dataOffset, e := q.seekToEnd()
+	if e != nil {
+		return e
+	}
+	originalSize := size
+	chunk := make([]byte, chunkSize)
+	compress := true
+
+	// Reads and compresses the next chunk, returning the data to write along
+	// with its chunk table flag. Returns io.EOF if the content is unsized and
+	// no more of it remains.
+	nextChunk := func() ([]byte, uint64, error) {
+		if !unsized && (size < int64(len(chunk))) {
+			chunk = chunk[0:size]
+		}
+		n, e := io.ReadFull(source, chunk)
+		if unsized && ((e == io.EOF) || (e == io.ErrUnexpectedEOF)) {
+			if n == 0 {
+				return nil, 0, io.EOF
+			}
+			// This is the final chunk, and may be shorter than the others.
+			chunk = chunk[0:n]
+			e = nil
+		}
+		if e != nil {
+			return nil, 0, fmt.Errorf("Failed reading content: %w", e)
+		}
+		size -= int64(len(chunk))
+		if !compress {
+			return chunk, chunkStoredFlag, nil
+		}
+		compressed, e := compressContent(chunk, codec)
+		if e != nil {
+			return nil, 0, e
+		}
+		if compressed == nil {
+			return chunk, chunkStoredFlag, nil
+		}
+		return compressed, 0, nil
+	}
+
+	// Write chunks without compression until one gets smaller. If the output
+	// is streaming, we buffer them in memory instead, as they'll need to
+	// follow the chunk table if a later chunk gets smaller. Until then, the
+	// table's entries don't include the size of the table itself.
+	var table []uint64
+	var buffered bytes.Buffer
+	var toWrite []byte
+	flag := chunkStoredFlag
+	storedSize := uint64(0)
+	for int64(len(table)) != chunkCount {
+		toWrite, flag, e = nextChunk()
+		if e == io.EOF {
+			// The unsized content ended without any chunk getting smaller.
+			flag = chunkStoredFlag
+			break
+		}
+		if e != nil {
+			return e
+		}
+		if flag != chunkStoredFlag {
+			break
+		}
+		if q.streaming {
+			buffered.Write(toWrite)
+		} else {
+			_, e = q.writeDataAndGetLocation(toWrite)
+			if e != nil {
+				return fmt.Errorf("Failed writing chunk %d: %w", len(table),
+					e)
+			}
+		}
+		storedSize += uint64(len(toWrite))
+		table = append(table, storedSize|flag)
+	}
+	if flag == chunkStoredFlag {
+		// No chunk got smaller, so the content is stored as-is.
+		if q.streaming && (buffered.Len() != 0) {
+			_, e = q.writeDataAndGetLocation(buffered.Bytes())
+			return e
+		}
+		return nil
+	}
+
+	if !q.streaming && (len(table) != 0) {
+		if restart == nil {
+			// We can't put the chunk table before the chunks we already
+			// wrote, so write the rest of the content uncompressed, too.
+			compress = false
+			toWrite = chunk
+			for i := int64(len(table)); i < chunkCount; i++ {
+				if i != int64(len(table)) {
+					toWrite, _, e = nextChunk()
+					if e != nil {
+						return e
+					}
+				}
+				_, e = q.writeDataAndGetLocation(toWrite)
+				if e != nil {
+					return fmt.Errorf("Failed writing chunk %d: %w", i, e)
+				}
+			}
+			return nil
+		}
+		// Read the content again, overwriting what we already wrote. The
+		// chunk table and the chunks preceding this one will be at least as
+		// large, so nothing written so far will be left over.
+		e = restart()
+		if e != nil {
+			return e
+		}
+		size = originalSize
+		table = table[0:0]
+		storedSize = 0
+		toWrite, flag, e = nextChunk()
+		if e != nil {
+			return e
+		}
+	}
+
+	// Reserve space for the chunk table, which we'll fill in at the end. If
+	// the output is streaming, we instead keep buffering the chunks in memory
+	// until the table is complete.
+	writeOffset := dataOffset
+	if !q.streaming {
+		e = q.writeDataAtLocation(make([]uint64, chunkCount), dataOffset)
+		if e != nil {
+			return fmt.Errorf("Failed reserving space for chunk table: %w", e)
+		}
+		writeOffset += chunkCount * 8
+	}
+	for {
+		if q.streaming {
+			buffered.Write(toWrite)
+		} else {
+			e = q.writeDataAtLocation(toWrite, writeOffset)
+			if e != nil {
+				return fmt.Errorf("Failed writing chunk %d: %w", len(table),
+					e)
+			}
+			writeOffset += int64(len(toWrite))
+		}
+		storedSize += uint64(len(toWrite))
+		table = append(table, storedSize|flag)
+		if int64(len(table)) == chunkCount {
+			break
+		}
+		toWrite, flag, e = nextChunk()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return e
+		}
+	}
+	tableSize := uint64(len(table)) * 8
+	for i := range table {
+		table[i] += tableSize
+	}
+	storedSize += tableSize
+	if q.streaming {
+		_, e = q.writeDataAndGetLocation(table)
+		if e == nil {
+			_, e = q.writeDataAndGetLocation(buffered.Bytes())
+		}
+	} else {
+		e = q.writeDataAtLocation(table, dataOffset)
+	}
+	if e != nil {
+		return fmt.Errorf("Failed writing chunk table: %w", e)
+	}
+	extra.compression.Codec = codec
+	extra.compression.StoredSize = storedSize
+	extra.compression.ChunkSize = uint64(chunkSize)
+	q.imageFlags |= ImageFlagCompression
+	return nil
+}
+
+// Returns a function that seeks the source back to its current offset and
+// resets the checksum, so that writeCompressedContent can read the content
+// again. Returns nil if the source can't seek, or if the output is streaming
+// and therefore never needs to read content twice.
+func (q *outputQueue) getRestartFunc(source io.Reader,
+	checksum hash.Hash32) func() error {
+	seeker, ok := source.(io.Seeker)
+	if !ok || q.streaming {
+		return nil
+	}
+	start, e := seeker.Seek(0, io.SeekCurrent)
+	if e != nil {
+		return nil
+	}
+	return func() error {
+		_, e := seeker.Seek(start, io.SeekStart)
+		if e != nil {
+			return fmt.Errorf("Failed seeking to start of content: %w", e)
+		}
+		checksum.Reset()
+		return nil
+	}
+}
+
+// Writes size bytes of content from the source to the end of the output,
+// compressing it and computing its checksum if needed. Updates the extra
+// metadata accordingly, and returns the offset where the content was written.
+// If size is negative, reads the source until EOF instead; see
+// writeCompressedContent.
+func (q *outputQueue) writeContent(source io.Reader, size int64,
+	extra *fileExtra) (int64, error) {
+	// We'll use io.CopyN here, to let the io package take care of
+	// intermediate buffering.
+	dataOffset, e := q.seekToEnd()
+	if e != nil {
+		return 0, fmt.Errorf("Failed seeking to data location: %w", e)
+	}
+	checksum := crc32.New(crc32cTable)
+	hashed := source
+	if !q.settings.DisableChecksums {
+		hashed = io.TeeReader(source, checksum)
+	}
+	if q.settings.Compression != CompressionNone {
+		e = q.writeCompressedContent(hashed, size, extra,
+			q.getRestartFunc(source, checksum))
+	} else if size >= 0 {
+		e = q.checkWriteLimit(dataOffset + size)
+		if e != nil {
+			return 0, e
+		}
+		_, e = io.CopyN(q.output, hashed, size)
+	} else {
+		e = q.copyUnsizedContent(hashed, dataOffset)
+	}
+	if e != nil {
+		return 0, e
+	}
+	if !q.settings.DisableChecksums {
+		extra.hasChecksum = true
+		extra.checksum = checksum.Sum32()
+		q.imageFlags |= ImageFlagChecksums
+	}
+	return dataOffset, nil
+}
+
+// Copies the source to the output, starting at the given offset, until EOF.
+// Returns an error without writing any content past the output size limit if
+// the content doesn't fit.
+func (q *outputQueue) copyUnsizedContent(source io.Reader,
+	dataOffset int64) error {
+	limit := q.settings.MaxOutputSize
+	if limit <= 0 {
+		_, e := io.Copy(q.output, source)
+		return e
+	}
+	_, e := io.CopyN(q.output, source, limit-dataOffset)
+	if e == io.EOF {
+		return nil
+	}
+	if e != nil {
+		return e
+	}
+	// We reached the limit, so make sure there isn't any content left.
+	var extraByte [1]byte
+	_, e = io.ReadFull(source, extraByte[:])
+	if e == io.EOF {
+		return nil
+	}
+	if e != nil {
+		return e
+	}
+	return q.checkWriteLimit(limit + 1)
+}
+
+// Holds the location of content that has already been written to the output,
+// so that it can be reused by other files with identical content.
+type writtenContent struct {
+	// The offset of the content in the output.
+	dataOffset int64
+	// The number of bytes the content occupies in the output.
+	storedSize uint64
+	// The checksum and compression info for the content. Other fields are
+	// ignored.
+	extra fileExtra
+}
+
+// Computes the SHA-256 hash of size bytes of the given file's content. Returns
+// the hash, along with a file positioned at the start of the content. The
+// returned file will be the original file if it can seek; otherwise it will be
+// newly opened, and the caller is responsible for closing it.
+func (q *outputQueue) hashContent(queueEntry *fileToProcess,
+	size int64) ([sha256.Size]byte, fs.File, error) {
+	var toReturn [sha256.Size]byte
+	f := queueEntry.toProcess
+	h := sha256.New()
+	_, e := io.CopyN(h, f, size)
+	if e != nil {
+		return toReturn, nil, fmt.Errorf("Failed hashing content: %w", e)
+	}
+	copy(toReturn[:], h.Sum(nil))
+	seeker, ok := f.(io.Seeker)
+	if ok {
+		_, e = seeker.Seek(0, io.SeekStart)
+		if e == nil {
+			return toReturn, f, nil
+		}
+	}
+	// We couldn't seek back to the start, so open the file again instead.
+	reopened, e := q.inputFS.Open(queueEntry.path)
+	if e != nil {
+		return toReturn, nil, fmt.Errorf("Failed reopening file: %w", e)
+	}
+	return toReturn, reopened, nil
+}
+
+// Like writeContent, but first checks whether identical content has already
+// been written. If so, returns the existing content's offset rather than
+// writing it again.
+func (q *outputQueue) writeDeduplicatedContent(queueEntry *fileToProcess,
+	size int64, extra *fileExtra) (int64, error) {
+	hash, source, e := q.hashContent(queueEntry, size)
+	if e != nil {
+		return 0, e
+	}
+	if source != queueEntry.toProcess {
+		defer source.Close()
+	}
+	existing := q.writtenContent[hash]
+	if existing != nil {
+		extra.copyContentInfo(&existing.extra)
+		q.bytesDeduplicated += existing.storedSize
+		q.LogStatus("Reused existing content for %s (%d bytes saved).\n",
+			queueEntry.path, existing.storedSize)
+		return existing.dataOffset, nil
+	}
+	dataOffset, e := q.writeContent(source, size, extra)
+	if e != nil {
+		return 0, e
+	}
+	endOffset, e := q.seekToEnd()
+	if e != nil {
+		return 0, e
+	}
+	q.writtenContent[hash] = &writtenContent{
+		dataOffset: dataOffset,
+		storedSize: uint64(endOffset - dataOffset),
+		extra:      *extra,
+	}
+	return dataOffset, nil
+}
+
+// Requires the queueEntry to be a regular file; writes its content and name to
+// the output stream. Returns the file's header, which the caller must write.
 func (q *outputQueue) writeFileContent(queueEntry *fileToProcess,
-	stat fs.FileInfo) error {
+	stat fs.FileInfo) (*File, error) {
 	var e error
-	var nameOffset, dataOffset int64
-	f := queueEntry.toProcess
-	name := stat.Name()
+	var dataOffset int64
 	fullPath := queueEntry.path
+	extra := q.newFileExtra(stat)
+	e = q.readXattrs(fullPath, extra)
+	if e != nil {
+		return nil, fmt.Errorf("Failed getting metadata for %s: %w", fullPath,
+			e)
+	}
 
-	// Only write names longer than 8 bytes, as they otherwise fit in the
-	// ShortName field of the File struct.
-	if len(name) > 8 {
-		nameOffset, e = q.writeDataAndGetLocation([]byte(name))
-		if e != nil {
-			return fmt.Errorf("Failed writing name of %s: %w", fullPath, e)
-		}
+	// If this is a hard link to a file we already wrote, simply refer to the
+	// existing file.
+	sourceID, isLinked := getSourceFileID(stat)
+	if isLinked && (q.linkedFiles[sourceID] != nil) {
+		return q.writeHardLink(queueEntry, stat, q.linkedFiles[sourceID])
 	}
 
-	// Write the file's content to the output stream. We'll use io.CopyN here,
-	// to let the io package take care of intermediate buffering.
+	// Write the file's content to the output stream.
 	size := stat.Size()
 	if size > 0 {
-		dataOffset, e = q.seekToEnd()
-		if e != nil {
-			return fmt.Errorf("Failed seeking to data location: %w", e)
+		if q.settings.Deduplicate {
+			dataOffset, e = q.writeDeduplicatedContent(queueEntry, size, extra)
+		} else {
+			dataOffset, e = q.writeContent(queueEntry.toProcess, size, extra)
 		}
-		e = q.checkWriteLimit(dataOffset + size)
 		if e != nil {
-			return e
+			return nil, fmt.Errorf("Failed writing content of %s: %w",
+				fullPath, e)
 		}
-		_, e = io.CopyN(q.output, f, size)
+	}
+
+	// Later links to this file will share its ID. If the output is streaming,
+	// we don't know where this file's header will be, so we instead give it
+	// an explicit ID: the offset of its name, which is about to be written
+	// and therefore can't be any other file's ID.
+	fileID := uint64(queueEntry.fileHeaderOffset)
+	if isLinked && q.streaming {
+		nameOffset, e := q.seekToEnd()
 		if e != nil {
-			return fmt.Errorf("Failed writing content of %s: %w", fullPath, e)
+			return nil, e
 		}
+		fileID = uint64(nameOffset)
+		extra.hasFileID = true
+		extra.fileID = fileID
 	}
 
-	// We have the info we need, so now write the header at its reserved spot.
+	// We have the info we need, so now write the name.
 	header := getSeekerFSHeader(stat)
-	header.NameOffset = uint64(nameOffset)
+	e = q.writeNameAndExtra(header, stat.Name(), extra)
+	if e != nil {
+		return nil, fmt.Errorf("Failed writing name of %s: %w", fullPath, e)
+	}
 	header.Size = uint64(size)
 	header.DataOffset = uint64(dataOffset)
-	e = q.writeDataAtLocation(header, queueEntry.fileHeaderOffset)
+	if isLinked {
+		q.linkedFiles[sourceID] = &linkedFile{
+			path:       fullPath,
+			fileID:     fileID,
+			dataOffset: dataOffset,
+			size:       size,
+			extra:      *extra,
+		}
+	}
+	return header, nil
+}
+
+// Writes the name for a regular file that's a hard link to the given file that
+// was already written. Returns the new file's header, which shares the
+// existing file's content and ID.
+func (q *outputQueue) writeHardLink(queueEntry *fileToProcess,
+	stat fs.FileInfo, existing *linkedFile) (*File, error) {
+	fullPath := queueEntry.path
+	extra := existing.extra
+	extra.hasFileID = true
+	extra.fileID = existing.fileID
+	header := getSeekerFSHeader(stat)
+	e := q.writeNameAndExtra(header, stat.Name(), &extra)
 	if e != nil {
-		return fmt.Errorf("Failed updating header for %s: %w", fullPath, e)
+		return nil, fmt.Errorf("Failed writing name of %s: %w", fullPath, e)
 	}
-	return nil
+	header.Size = uint64(existing.size)
+	header.DataOffset = uint64(existing.dataOffset)
+	q.LogStatus("%s is a hard link to %s.\n", fullPath, existing.path)
+	return header, nil
+}
+
+// Requires the queueEntry to be a symbolic link, and the input FS to implement
+// ReadLinkFS. Writes the link's target as its content, followed by its name.
+// Returns the link's header.
+func (q *outputQueue) writeSymlink(queueEntry *fileToProcess) (*File, error) {
+	linkFS := q.inputFS.(ReadLinkFS)
+	fullPath := queueEntry.path
+	stat, e := linkFS.Lstat(fullPath)
+	if e != nil {
+		return nil, e
+	}
+	if (stat.Mode() & fs.ModeSymlink) == 0 {
+		return nil, fmt.Errorf("%s is no longer a symbolic link", fullPath)
+	}
+	target, e := linkFS.ReadLink(fullPath)
+	if e != nil {
+		return nil, e
+	}
+	if target == "" {
+		return nil, fmt.Errorf("%s has an empty target", fullPath)
+	}
+	dataOffset, e := q.writeDataAndGetLocation([]byte(target))
+	if e != nil {
+		return nil, fmt.Errorf("Failed writing target of %s: %w", fullPath, e)
+	}
+	extra := q.newFileExtra(stat)
+	e = q.readXattrs(fullPath, extra)
+	if e != nil {
+		return nil, fmt.Errorf("Failed getting metadata for %s: %w", fullPath,
+			e)
+	}
+	header := getSeekerFSHeader(stat)
+	e = q.writeNameAndExtra(header, stat.Name(), extra)
+	if e != nil {
+		return nil, fmt.Errorf("Failed writing name of %s: %w", fullPath, e)
+	}
+	header.Size = uint64(len(target))
+	header.DataOffset = uint64(dataOffset)
+	return header, nil
 }
 
 // Implements sort.Interface to sort entries by name, as the SeekerFS requires
@@ -251,97 +934,117 @@ func (s dirEntrySlice) Swap(a, b int) {
 	s[a], s[b] = s[b], s[a]
 }
 
-// Requires the queueEntry to be for a directory, and that the directory to
-// implement ReadDirFile. Takes a FileInfo object for convenience. Reserves
-// space and enqueues the directory's children for later processing, then
-// updates the directory's File header.
-func (q *outputQueue) writeDirContent(queueEntry *fileToProcess,
-	stat fs.FileInfo) error {
+// Requires the queueEntry to be a directory that implements ReadDirFile.
+// Writes the directory's name and extra metadata, and returns its header
+// (without DataOffset or Size set) along with its sorted entries.
+func (q *outputQueue) readDirAndWriteName(queueEntry *fileToProcess,
+	stat fs.FileInfo) (*File, []fs.DirEntry, error) {
 	fullPath := queueEntry.path
 	dir, ok := queueEntry.toProcess.(fs.ReadDirFile)
 	if !ok {
-		return fmt.Errorf("Directory %s doesn't implement ReadDirFile",
-			fullPath)
+		return nil, nil, fmt.Errorf("Directory %s doesn't implement "+
+			"ReadDirFile", fullPath)
+	}
+	// As with regular files, this only writes the name if it won't fit in
+	// the ShortName field or if there's extra metadata.
+	extra := q.newFileExtra(stat)
+	e := q.readXattrs(fullPath, extra)
+	if e != nil {
+		return nil, nil, fmt.Errorf("Failed getting metadata for dir %s: %w",
+			fullPath, e)
 	}
-	name := stat.Name()
+	header := getSeekerFSHeader(stat)
+	e = q.writeNameAndExtra(header, stat.Name(), extra)
+	if e != nil {
+		return nil, nil, fmt.Errorf("Failed writing name of dir %s: %w",
+			fullPath, e)
+	}
+	entries, e := dir.ReadDir(-1)
+	if e != nil {
+		return nil, nil, fmt.Errorf("Failed reading files in dir %s: %w",
+			fullPath, e)
+	}
+	sort.Sort(dirEntrySlice(entries))
+	return header, entries, nil
+}
 
-	var nameOffset int64
-	var e error
-	// As with regular files, we only need to write dir names if they won't
-	// fit in the ShortName field.
-	if len(name) > 8 {
-		nameOffset, e = q.writeDataAndGetLocation([]byte(name))
-		if e != nil {
-			return fmt.Errorf("Failed writing name of dir %s: %w", fullPath, e)
-		}
+// Opens the given entry of a directory, at the given path. Returns a nil file
+// and no error if the entry is a symbolic link that should be stored as a
+// link rather than opened, as opening it would follow the link.
+func (q *outputQueue) openDirEntry(dirEntry fs.DirEntry,
+	path string) (fs.File, error) {
+	// If the input FS can read links, then we'll store links as links rather
+	// than following them.
+	_, canReadLinks := q.inputFS.(ReadLinkFS)
+	if canReadLinks && ((dirEntry.Type() & fs.ModeSymlink) != 0) {
+		return nil, nil
+	}
+	newFile, e := q.inputFS.Open(path)
+	if e != nil {
+		return nil, fmt.Errorf("Failed opening %s: %w", path, e)
 	}
+	return newFile, nil
+}
 
-	entries, e := dir.ReadDir(-1)
+// Requires the queueEntry to be for a directory, and that the directory to
+// implement ReadDirFile. Takes a FileInfo object for convenience. Reserves
+// space and enqueues the directory's children for later processing, then
+// returns the directory's File header.
+func (q *outputQueue) writeDirContent(queueEntry *fileToProcess,
+	stat fs.FileInfo) (*File, error) {
+	fullPath := queueEntry.path
+	header, entries, e := q.readDirAndWriteName(queueEntry, stat)
 	if e != nil {
-		return fmt.Errorf("Failed reading files in dir %s: %w", fullPath, e)
+		return nil, e
 	}
 
-	// If the directory contained no files, write its header and return early.
+	// If the directory contained no files, return its header early.
 	if len(entries) == 0 {
-		header := getSeekerFSHeader(stat)
-		header.NameOffset = uint64(nameOffset)
-		e = q.writeDataAtLocation(header, queueEntry.fileHeaderOffset)
-		if e != nil {
-			return fmt.Errorf("Failed writing header for empty dir %s: %w",
-				fullPath, e)
-		}
-		return nil
+		return header, nil
 	}
 
 	// Get the offset before we start writing the headers.
 	dataOffset, e := q.seekToEnd()
 	if e != nil {
-		return fmt.Errorf("Failed getting offset of dir %s contents: %w",
+		return nil, fmt.Errorf("Failed getting offset of dir %s contents: %w",
 			fullPath, e)
 	}
 
 	// Open and enqueue all of the directory entries, in their sorted order.
-	sort.Sort(dirEntrySlice(entries))
 	for _, dirEntry := range entries {
 		// Don't include a leading "./" in paths in the root directory.
-		var newPath string
-		if fullPath == "." {
-			newPath = dirEntry.Name()
-		} else {
-			newPath = fullPath + "/" + dirEntry.Name()
-		}
-		newFile, e := q.inputFS.Open(newPath)
+		newPath := joinPath(fullPath, dirEntry.Name())
+		newFile, e := q.openDirEntry(dirEntry, newPath)
 		if e != nil {
-			return fmt.Errorf("Failed opening %s: %w", newPath, e)
+			return nil, e
 		}
 		e = q.reserveHeaderAndEnqueue(newFile, newPath, queueEntry.depth+1)
 		if e != nil {
-			return fmt.Errorf("Failed enqueueing %s: %w", newPath, e)
+			return nil, fmt.Errorf("Failed enqueueing %s: %w", newPath, e)
 		}
 	}
 
-	// Finally, update the header for this directory.
-	header := getSeekerFSHeader(stat)
-	header.NameOffset = uint64(nameOffset)
+	// Finally, fill in the rest of the header for this directory.
 	header.DataOffset = uint64(dataOffset)
 	header.Size = uint64(len(entries))
-	e = q.writeDataAtLocation(header, queueEntry.fileHeaderOffset)
-	if e != nil {
-		return fmt.Errorf("Failed updating header for dir %s: %w", fullPath, e)
-	}
-	return nil
+	return header, nil
 }
 
-// Removes one file from the top of the stack, writes its data to the output,
-// and, if it's a directory, adds its children to the queue to process. Closes
+// Writes the data for the given file to the output, and returns its header,
+// which the caller must write. If the file is a directory, its children are
+// either enqueued or, if the output is streaming, written recursively. Closes
 // the file before returning.
-func (q *outputQueue) processNextFile() error {
-	if len(q.unprocessed) == 0 {
-		return fmt.Errorf("No files are left to process")
+func (q *outputQueue) writeEntry(toProcess *fileToProcess) (*File, error) {
+	// Symbolic links are handled separately, as they aren't opened.
+	if toProcess.toProcess == nil {
+		header, e := q.writeSymlink(toProcess)
+		if e != nil {
+			return nil, fmt.Errorf("Failed writing symbolic link %s: %w",
+				toProcess.path, e)
+		}
+		q.LogStatus("Wrote symbolic link %s OK.\n", toProcess.path)
+		return header, nil
 	}
-	// Pop an item from the end of the queue.
-	toProcess := q.unprocessed[len(q.unprocessed)-1]
-	q.unprocessed = q.unprocessed[0 : len(q.unprocessed)-1]
 
 	// Error or not, we're done with this file after this function.
 	f := toProcess.toProcess
@@ -351,26 +1054,68 @@ func (q *outputQueue) processNextFile() error {
 	// directory.
 	stat, e := f.Stat()
 	if e != nil {
-		return fmt.Errorf("Stat() failed for file %s: %w", toProcess.path, e)
+		return nil, fmt.Errorf("Stat() failed for file %s: %w",
+			toProcess.path, e)
 	}
 	if !stat.IsDir() {
-		e = q.writeFileContent(&toProcess, stat)
+		header, e := q.writeFileContent(toProcess, stat)
 		if e != nil {
-			return fmt.Errorf("Failed writing content for file %s: %w",
+			return nil, fmt.Errorf("Failed writing content for file %s: %w",
 				toProcess.path, e)
 		}
 		q.LogStatus("Wrote %s OK (%d bytes).\n", toProcess.path, stat.Size())
-		return nil
+		return header, nil
+	}
+	var header *File
+	if q.streaming {
+		header, e = q.streamDirContent(toProcess, stat)
+	} else {
+		header, e = q.writeDirContent(toProcess, stat)
 	}
-	e = q.writeDirContent(&toProcess, stat)
 	if e != nil {
-		return fmt.Errorf("Failed writing content for directory %s: %w",
+		return nil, fmt.Errorf("Failed writing content for directory %s: %w",
 			toProcess.path, e)
 	}
 	q.LogStatus("Wrote directory content for %s OK.\n", toProcess.path)
+	return header, nil
+}
+
+// Removes one file from the top of the stack, writes its data to the output,
+// and, if it's a directory, adds its children to the queue to process. Closes
+// the file before returning.
+func (q *outputQueue) processNextFile() error {
+	if len(q.unprocessed) == 0 {
+		return fmt.Errorf("No files are left to process")
+	}
+	// Pop an item from the end of the queue.
+	toProcess := q.unprocessed[len(q.unprocessed)-1]
+	q.unprocessed = q.unprocessed[0 : len(q.unprocessed)-1]
+	header, e := q.writeEntry(&toProcess)
+	if e != nil {
+		return e
+	}
+	e = q.writeDataAtLocation(header, toProcess.fileHeaderOffset)
+	if e != nil {
+		return fmt.Errorf("Failed updating header for %s: %w",
+			toProcess.path, e)
+	}
 	return nil
 }
 
+// Fills in the fields of the image header that are only known once every file
+// has been written. Doesn't set TotalSize or RootOffset.
+func (q *outputQueue) finishImageHeader(imageHeader *ImageHeader) {
+	if q.settings.Deduplicate {
+		q.LogStatus("Deduplication saved %d bytes.\n", q.bytesDeduplicated)
+	}
+	imageHeader.Flags |= q.imageFlags
+	creationTime := q.settings.CreationTime
+	if creationTime.IsZero() {
+		creationTime = time.Now()
+	}
+	imageHeader.CreationTime = uint64(creationTime.Unix())
+}
+
 // Copies the entire contents of the arbitrary filesystem f into a new
 // SeekerFS, writing the SeekerFS's bytes to the output data stream. Returns an
 // error if any occurs. May be memory intensive, as it may potentially need to
@@ -388,26 +1133,44 @@ func CreateSeekerFS(f fs.FS, output io.WriteSeeker,
 	if settings == nil {
 		settings = &CreateFSSettings{}
 	}
-	queue := outputQueue{
-		unprocessed: make([]fileToProcess, 0, 1000),
-		inputFS:     f,
-		output:      output,
-		settings:    settings,
+	queue := newOutputQueue(f, output, settings)
+
+	// Reserve space for the image header, which we'll fill in at the end.
+	imageHeader := newImageHeader()
+	headerOffset, e := queue.writeDataAndGetLocation(imageHeader)
+	if e != nil {
+		return fmt.Errorf("Error reserving space for image header: %w", e)
+	}
+	if headerOffset != 0 {
+		return fmt.Errorf("The output must initially be empty")
 	}
 
 	// Start the encoding by enqueuing the root directory.
-	e = (&queue).reserveHeaderAndEnqueue(rootFile, ".", 0)
+	e = queue.reserveHeaderAndEnqueue(rootFile, ".", 0)
 	if e != nil {
 		return fmt.Errorf("Error enqueuing root directory for processing: %w",
 			e)
 	}
+	imageHeader.RootOffset = uint64(queue.unprocessed[0].fileHeaderOffset)
 
 	// This is just a basic depth-first loop until everything is written.
 	for len(queue.unprocessed) != 0 {
-		e = (&queue).processNextFile()
+		e = queue.processNextFile()
 		if e != nil {
 			return fmt.Errorf("Error writing file to output: %w", e)
 		}
 	}
+
+	// Now that we know the total size, fill in the image header.
+	totalSize, e := queue.seekToEnd()
+	if e != nil {
+		return fmt.Errorf("Error getting total image size: %w", e)
+	}
+	imageHeader.TotalSize = uint64(totalSize)
+	queue.finishImageHeader(imageHeader)
+	e = queue.writeDataAtLocation(imageHeader, 0)
+	if e != nil {
+		return fmt.Errorf("Error writing image header: %w", e)
+	}
 	return nil
 }
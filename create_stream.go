@@ -0,0 +1,173 @@
+package seeker_fs
+
+// This file contains code for creating a SeekerFS on an output that can't
+// seek, such as a pipe. Such "streaming" images contain all of their file
+// content before the File headers referring to it, and end with a footer
+// containing the real image header.
+import (
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// Wraps an io.Writer to satisfy the io.WriteSeeker interface, so that the
+// outputQueue code can be shared between streaming and non-streaming
+// creation. Only supports "seeking" to the current offset, which is always the
+// end of the data written so far.
+type appendOnlyWriter struct {
+	w io.Writer
+	// The number of bytes written so far.
+	offset int64
+}
+
+func (w *appendOnlyWriter) Write(data []byte) (int, error) {
+	n, e := w.w.Write(data)
+	w.offset += int64(n)
+	return n, e
+}
+
+func (w *appendOnlyWriter) Seek(offset int64, whence int) (int64, error) {
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent, io.SeekEnd:
+		newOffset = w.offset + offset
+	default:
+		return 0, fmt.Errorf("Invalid \"whence\" argument")
+	}
+	if newOffset != w.offset {
+		return 0, fmt.Errorf("Can't seek in a streaming output")
+	}
+	return w.offset, nil
+}
+
+// Like writeDirContent, but for streaming output, where space for headers
+// can't be reserved and filled in later. Instead, writes each of the
+// directory's entries (recursively, for subdirectories) before writing the
+// directory's name and the File headers of its entries. Returns the
+// directory's header.
+func (q *outputQueue) streamDirContent(queueEntry *fileToProcess,
+	stat fs.FileInfo) (*File, error) {
+	fullPath := queueEntry.path
+	// The directory's name is written before its entries' content, but that
+	// doesn't matter, as long as the entries' headers are contiguous.
+	header, entries, e := q.readDirAndWriteName(queueEntry, stat)
+	if e != nil {
+		return nil, e
+	}
+	if len(entries) == 0 {
+		return header, nil
+	}
+	headers := make([]File, len(entries))
+	for i, dirEntry := range entries {
+		newPath := joinPath(fullPath, dirEntry.Name())
+		e = q.checkEntryLimits(queueEntry.depth + 1)
+		if e != nil {
+			return nil, fmt.Errorf("Failed adding %s: %w", newPath, e)
+		}
+		newFile, e := q.openDirEntry(dirEntry, newPath)
+		if e != nil {
+			return nil, e
+		}
+		entryHeader, e := q.writeEntry(&fileToProcess{
+			toProcess:        newFile,
+			path:             newPath,
+			fileHeaderOffset: -1,
+			depth:            queueEntry.depth + 1,
+		})
+		if e != nil {
+			return nil, e
+		}
+		headers[i] = *entryHeader
+	}
+	dataOffset, e := q.writeDataAndGetLocation(headers)
+	if e != nil {
+		return nil, fmt.Errorf("Failed writing entries of dir %s: %w",
+			fullPath, e)
+	}
+	header.DataOffset = uint64(dataOffset)
+	header.Size = uint64(len(entries))
+	return header, nil
+}
+
+// Writes the placeholder header at the start of a streaming image, which only
+// indicates that the real header is in the footer.
+func (q *outputQueue) writeStreamHeader() error {
+	placeholder := newImageHeader()
+	placeholder.Flags = ImageFlagFooter
+	_, e := q.writeDataAndGetLocation(placeholder)
+	if e != nil {
+		return fmt.Errorf("Error writing image header: %w", e)
+	}
+	return nil
+}
+
+// Finishes a streaming image by writing the root directory's header, followed
+// by the footer containing the real image header. The footer is included in
+// the image's size. Returns the footer.
+func (q *outputQueue) writeStreamFooter(rootHeader *File) (*ImageHeader,
+	error) {
+	rootOffset, e := q.writeDataAndGetLocation(rootHeader)
+	if e != nil {
+		return nil, fmt.Errorf("Error writing root directory header: %w", e)
+	}
+	footerOffset, e := q.seekToEnd()
+	if e != nil {
+		return nil, fmt.Errorf("Error getting footer offset: %w", e)
+	}
+	footer := newImageHeader()
+	footer.Flags = ImageFlagFooter
+	footer.RootOffset = uint64(rootOffset)
+	footer.TotalSize = uint64(footerOffset) + imageHeaderSize
+	q.finishImageHeader(footer)
+	_, e = q.writeDataAndGetLocation(footer)
+	if e != nil {
+		return nil, fmt.Errorf("Error writing image footer: %w", e)
+	}
+	return footer, nil
+}
+
+// Like CreateSeekerFS, but writes the SeekerFS to an output that doesn't need
+// to support seeking, such as a pipe, network connection, or compressor. This
+// works by writing every file's content before the headers referring to it,
+// and by writing the real image header as a footer at the end of the image.
+// The header at the start of the image only indicates that the image has a
+// footer (see ImageFlagFooter). The resulting image can be loaded like any
+// other, as long as it isn't followed by any other data. Every File header in
+// a directory, and in all of its parent directories, is buffered in memory
+// until the directory is complete. The compressed content of each file is
+// also buffered in memory if compression is enabled.
+func CreateSeekerFSStream(f fs.FS, output io.Writer,
+	settings *CreateFSSettings) error {
+	rootFile, e := f.Open(".")
+	if e != nil {
+		return fmt.Errorf("Error opening root file: %w", e)
+	}
+	if settings == nil {
+		settings = &CreateFSSettings{}
+	}
+	queue := newOutputQueue(f, &appendOnlyWriter{w: output}, settings)
+	queue.streaming = true
+	e = queue.writeStreamHeader()
+	if e != nil {
+		return e
+	}
+
+	// Write everything, followed by the root directory's header.
+	e = queue.checkEntryLimits(0)
+	if e != nil {
+		return fmt.Errorf("Error adding root directory: %w", e)
+	}
+	rootHeader, e := queue.writeEntry(&fileToProcess{
+		toProcess:        rootFile,
+		path:             ".",
+		fileHeaderOffset: -1,
+		depth:            0,
+	})
+	if e != nil {
+		return fmt.Errorf("Error writing file to output: %w", e)
+	}
+	_, e = queue.writeStreamFooter(rootHeader)
+	return e
+}
@@ -0,0 +1,156 @@
+package seeker_fs
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// Wraps a bytes.Buffer, hiding any methods other than Write, so that it can't
+// be used as an io.WriteSeeker.
+type writeOnlyBuffer struct {
+	b bytes.Buffer
+}
+
+func (w *writeOnlyBuffer) Write(data []byte) (int, error) {
+	return w.b.Write(data)
+}
+
+func TestCreateStream(t *testing.T) {
+	var output writeOnlyBuffer
+	var w io.Writer = &output
+	_, canSeek := w.(io.Seeker)
+	if canSeek {
+		t.Logf("The test output shouldn't be able to seek.\n")
+		t.FailNow()
+	}
+	e := CreateSeekerFSStream(os.DirFS("test_data/test_dir"), w,
+		&CreateFSSettings{
+			StatusLog: &testLogger{t},
+		})
+	if e != nil {
+		t.Logf("Failed creating streaming seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	raw := output.b.Bytes()
+	sfs, e := LoadSeekerFSReaderAt(bytes.NewReader(raw), int64(len(raw)))
+	if e != nil {
+		t.Logf("Failed loading streaming seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	header := sfs.GetImageHeader()
+	if (header.Flags & ImageFlagFooter) == 0 {
+		t.Logf("The streaming image doesn't have a footer.\n")
+		t.FailNow()
+	}
+	if header.TotalSize != uint64(len(raw)) {
+		t.Logf("Incorrect image size: expected %d, got %d\n", len(raw),
+			header.TotalSize)
+		t.FailNow()
+	}
+	e = sfs.Validate()
+	if e != nil {
+		t.Logf("Validating streaming FS failed: %s\n", e)
+		t.FailNow()
+	}
+	e = fstest.TestFS(sfs, "test1.txt", "b/c/test2.txt", "b/c/hi.png")
+	if e != nil {
+		t.Logf("TestFS failed on streaming FS: %s\n", e)
+		t.FailNow()
+	}
+
+	// Adding a hash tree should convert the image to one with a normal
+	// header.
+	data := NewSeekableBuffer()
+	_, e = data.Write(raw)
+	if e != nil {
+		t.Logf("Failed copying streaming image: %s\n", e)
+		t.FailNow()
+	}
+	rootHash, e := AddHashTree(data, 0)
+	if e != nil {
+		t.Logf("Failed adding hash tree to streaming image: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e = LoadSeekerFS(data, WithRootHash(rootHash))
+	if e != nil {
+		t.Logf("Failed loading streaming image with a hash tree: %s\n", e)
+		t.FailNow()
+	}
+	if (sfs.GetImageHeader().Flags & ImageFlagFooter) != 0 {
+		t.Logf("The image still uses a footer after adding a hash tree.\n")
+		t.FailNow()
+	}
+	e = fstest.TestFS(sfs, "test1.txt", "b/c/test2.txt", "b/c/hi.png")
+	if e != nil {
+		t.Logf("TestFS failed on streaming FS with a hash tree: %s\n", e)
+		t.FailNow()
+	}
+
+	// Trailing data should prevent the footer from being found.
+	raw = append(raw, 0)
+	_, e = LoadSeekerFSReaderAt(bytes.NewReader(raw), int64(len(raw)))
+	if e == nil {
+		t.Logf("Didn't get expected error when loading an image with " +
+			"trailing data.\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error loading an image with trailing data: %s\n", e)
+}
+
+func TestCreateStreamFeatures(t *testing.T) {
+	content := strings.Repeat("Streaming content. ", 1000)
+	baseFS := fstest.MapFS(make(map[string]*fstest.MapFile))
+	baseFS["a.txt"] = newMapFile(content)
+	baseFS["dir/b.txt"] = newMapFile(content)
+	baseFS["dir/sub/c.txt"] = newMapFile(content + "!")
+	baseFS["dir/sub/long_file_name.txt"] = newMapFile("short")
+	baseFS["empty_dir"] = &fstest.MapFile{Mode: fs.ModeDir | 0755}
+	var output writeOnlyBuffer
+	e := CreateSeekerFSStream(baseFS, &output, &CreateFSSettings{
+		Compression:          CompressionDeflate,
+		CompressionChunkSize: 4096,
+		Deduplicate:          true,
+		StatusLog:            &testLogger{t},
+	})
+	if e != nil {
+		t.Logf("Failed creating streaming seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	raw := output.b.Bytes()
+	sfs, e := LoadSeekerFSReaderAt(bytes.NewReader(raw), int64(len(raw)))
+	if e != nil {
+		t.Logf("Failed loading streaming seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	if len(raw) >= len(content) {
+		t.Logf("Streaming image is %d bytes, but a single file is %d\n",
+			len(raw), len(content))
+		t.Fail()
+	}
+	e = sfs.Validate()
+	if e != nil {
+		t.Logf("Validating streaming FS failed: %s\n", e)
+		t.FailNow()
+	}
+	e = fstest.TestFS(sfs, "a.txt", "dir/b.txt", "dir/sub/c.txt",
+		"dir/sub/long_file_name.txt", "empty_dir")
+	if e != nil {
+		t.Logf("TestFS failed on streaming FS: %s\n", e)
+		t.FailNow()
+	}
+
+	// Limits should still be enforced.
+	e = CreateSeekerFSStream(baseFS, &writeOnlyBuffer{}, &CreateFSSettings{
+		MaxTotalEntries: 4,
+	})
+	if e == nil {
+		t.Logf("Didn't get expected error when exceeding the entry limit.\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error when exceeding the entry limit: %s\n", e)
+}
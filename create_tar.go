@@ -0,0 +1,170 @@
+package seeker_fs
+
+// This file contains code for creating a SeekerFS directly from a tar archive,
+// without extracting it first.
+import (
+	"archive/tar"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"path"
+	"sort"
+	"strings"
+)
+
+// The prefix of the PAX records containing extended attributes, as written by
+// GNU tar and the archive/tar package.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// Converts a path from a tar header into a path in the SeekerFS. Tar archives
+// often use paths starting with "./" or "/", and directories' paths may end
+// with "/". Returns an error if the path refers to something outside of the
+// archive.
+func getTarEntryPath(name string) (string, error) {
+	cleaned := path.Clean(strings.TrimLeft(name, "/"))
+	if !fs.ValidPath(cleaned) {
+		return "", fmt.Errorf("Invalid path in tar archive: %q", name)
+	}
+	return cleaned, nil
+}
+
+// Returns an extra metadata record containing the ownership, timestamps, and
+// extended attributes from the given tar header.
+func getTarExtra(h *tar.Header) (*fileExtra, error) {
+	if (h.Uid < 0) || (int64(h.Uid) > math.MaxUint32) || (h.Gid < 0) ||
+		(int64(h.Gid) > math.MaxUint32) {
+		return nil, fmt.Errorf("Invalid owner: UID %d, GID %d", h.Uid, h.Gid)
+	}
+	toReturn := &fileExtra{
+		hasOwner: true,
+		owner: fileOwner{
+			UID: uint32(h.Uid),
+			GID: uint32(h.Gid),
+		},
+		userName:  h.Uname,
+		groupName: h.Gname,
+	}
+	if !h.AccessTime.IsZero() {
+		toReturn.hasAccessTime = true
+		toReturn.accessTime = h.AccessTime.UnixNano()
+	}
+	if !h.ChangeTime.IsZero() {
+		toReturn.hasChangeTime = true
+		toReturn.changeTime = h.ChangeTime.UnixNano()
+	}
+	names := make([]string, 0, len(h.PAXRecords))
+	for key := range h.PAXRecords {
+		name := strings.TrimPrefix(key, paxXattrPrefix)
+		if (name == key) || (name == "") {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	totalSize := 0
+	for _, name := range names {
+		value := h.PAXRecords[paxXattrPrefix+name]
+		totalSize += binary.Size(xattrHeader{}) + len(name) + len(value)
+		if totalSize > maxXattrTableSize {
+			return nil, fmt.Errorf("Extended attributes exceed the limit of "+
+				"%d bytes", maxXattrTableSize)
+		}
+		toReturn.xattrs = append(toReturn.xattrs, fileXattr{
+			name:  name,
+			value: []byte(value),
+		})
+	}
+	return toReturn, nil
+}
+
+// Adds the entry described by the given tar header to the Builder, reading
+// its content from the tar reader if it's a regular file.
+func (b *Builder) addTarEntry(h *tar.Header, r *tar.Reader) error {
+	entryPath, e := getTarEntryPath(h.Name)
+	if e != nil {
+		return e
+	}
+	extra, e := getTarExtra(h)
+	if e != nil {
+		return fmt.Errorf("Failed getting metadata for %s: %w", entryPath, e)
+	}
+	b.queue.filterAccessTimes(extra)
+	// The type bits are determined by the entry's type, rather than its mode.
+	mode := h.FileInfo().Mode() &^ fs.ModeType
+	switch h.Typeflag {
+	case tar.TypeReg:
+		return b.addFile(entryPath, mode, h.ModTime, r, extra)
+	case tar.TypeDir:
+		return b.addDir(entryPath, mode, h.ModTime, extra)
+	case tar.TypeSymlink:
+		return b.addSymlink(entryPath, h.Linkname, h.ModTime, extra)
+	case tar.TypeLink:
+		target, e := getTarEntryPath(h.Linkname)
+		if e != nil {
+			return fmt.Errorf("Bad target for hard link %s: %w", entryPath, e)
+		}
+		return b.addHardLink(entryPath, target)
+	}
+	b.queue.LogStatus("Skipping %s, which has unsupported tar type %q.\n",
+		entryPath, h.Typeflag)
+	return nil
+}
+
+// Creates a SeekerFS from the tar archive read from the input, reading the
+// archive only once. Preserves each entry's mode, modification time,
+// ownership, and extended attributes, along with symbolic and hard links.
+// Entries of other types, such as devices, are skipped. Parent directories
+// that aren't in the archive are created with 0755 permissions. Returns an
+// error if the archive contains more than one entry at the same path. The
+// settings behave as they do for CreateSeekerFS, except that Deduplicate isn't
+// supported. The output must initially be empty. Like the Builder, this keeps
+// every file's name and header in memory until the entire archive has been
+// read.
+func CreateSeekerFSFromTar(input io.Reader, output io.WriteSeeker,
+	settings *CreateFSSettings) error {
+	size, e := output.Seek(0, io.SeekEnd)
+	if e != nil {
+		return fmt.Errorf("Couldn't seek to end of output data: %w", e)
+	}
+	if size != 0 {
+		return fmt.Errorf("The output must initially be empty")
+	}
+	b, e := NewBuilder(output, settings)
+	if e != nil {
+		return e
+	}
+	r := tar.NewReader(input)
+	for {
+		h, e := r.Next()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return fmt.Errorf("Error reading tar archive: %w", e)
+		}
+		e = b.addTarEntry(h, r)
+		if e != nil {
+			return fmt.Errorf("Error adding %s from tar archive: %w", h.Name,
+				e)
+		}
+	}
+	header, e := b.finish()
+	if e != nil {
+		return e
+	}
+
+	// The output can seek, so we can replace the placeholder header with the
+	// real one. The footer remains as part of the image.
+	header.Flags &^= ImageFlagFooter
+	_, e = output.Seek(0, io.SeekStart)
+	if e != nil {
+		return fmt.Errorf("Couldn't seek to image header: %w", e)
+	}
+	e = binary.Write(output, binary.LittleEndian, header)
+	if e != nil {
+		return fmt.Errorf("Error writing image header: %w", e)
+	}
+	return nil
+}
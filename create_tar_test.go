@@ -0,0 +1,264 @@
+package seeker_fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// Returns a tar archive containing the given entries. Regular files' content
+// is taken from the content map, keyed by the entries' names.
+func createTestTar(t *testing.T, headers []*tar.Header,
+	content map[string]string) []byte {
+	var output bytes.Buffer
+	w := tar.NewWriter(&output)
+	for _, h := range headers {
+		data := content[h.Name]
+		h.Size = int64(len(data))
+		h.Format = tar.FormatPAX
+		e := w.WriteHeader(h)
+		if e != nil {
+			t.Logf("Failed writing tar header for %s: %s\n", h.Name, e)
+			t.FailNow()
+		}
+		_, e = w.Write([]byte(data))
+		if e != nil {
+			t.Logf("Failed writing tar content for %s: %s\n", h.Name, e)
+			t.FailNow()
+		}
+	}
+	e := w.Close()
+	if e != nil {
+		t.Logf("Failed closing tar writer: %s\n", e)
+		t.FailNow()
+	}
+	return output.Bytes()
+}
+
+func TestCreateFromTar(t *testing.T) {
+	modTime := time.Unix(1234567890, 987654321)
+	accessTime := time.Unix(1300000000, 1000)
+	headers := []*tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0750},
+		{Name: "./z_dir/", Typeflag: tar.TypeDir, Mode: 0700},
+		{
+			Name:       "./z_dir/owned.txt",
+			Typeflag:   tar.TypeReg,
+			Mode:       0640,
+			Uid:        1000,
+			Gid:        1001,
+			Uname:      "someone",
+			Gname:      "some_group",
+			AccessTime: accessTime,
+			PAXRecords: map[string]string{
+				"SCHILY.xattr.user.test": "xattr value",
+				"comment":                "not an xattr",
+			},
+		},
+		{Name: "./a.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{
+			Name:     "./implicit/dir/link",
+			Typeflag: tar.TypeSymlink,
+			Linkname: "../../a.txt",
+		},
+		{
+			Name:     "./z_dir/hard_link.txt",
+			Typeflag: tar.TypeLink,
+			Linkname: "./a.txt",
+		},
+		{Name: "./fifo", Typeflag: tar.TypeFifo, Mode: 0644},
+		{Name: "/absolute.txt", Typeflag: tar.TypeReg, Mode: 0644},
+	}
+	for _, h := range headers {
+		h.ModTime = modTime
+	}
+	content := map[string]string{
+		"./z_dir/owned.txt": "Owned content",
+		"./a.txt":           "Linked content",
+		"/absolute.txt":     "Absolute content",
+	}
+	archive := createTestTar(t, headers, content)
+
+	data := NewSeekableBuffer()
+	e := CreateSeekerFSFromTar(bytes.NewReader(archive), data,
+		&CreateFSSettings{
+			StatusLog:        &testLogger{t},
+			StoreAccessTimes: true,
+		})
+	if e != nil {
+		t.Logf("Failed creating FS from tar: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading FS created from tar: %s\n", e)
+		t.FailNow()
+	}
+	if (sfs.GetImageHeader().Flags & ImageFlagFooter) != 0 {
+		t.Logf("The image created from tar shouldn't need a footer\n")
+		t.FailNow()
+	}
+	e = sfs.Validate()
+	if e != nil {
+		t.Logf("Validating FS created from tar failed: %s\n", e)
+		t.FailNow()
+	}
+	e = fstest.TestFS(sfs, "a.txt", "absolute.txt", "z_dir/owned.txt",
+		"z_dir/hard_link.txt", "implicit/dir/link")
+	if e != nil {
+		t.Logf("TestFS failed on FS created from tar: %s\n", e)
+		t.FailNow()
+	}
+	expectedContent := map[string]string{
+		"a.txt":               "Linked content",
+		"absolute.txt":        "Absolute content",
+		"z_dir/owned.txt":     "Owned content",
+		"z_dir/hard_link.txt": "Linked content",
+		"implicit/dir/link":   "Linked content",
+	}
+	for path, expected := range expectedContent {
+		data, e := fs.ReadFile(sfs, path)
+		if e != nil {
+			t.Logf("Failed reading %s: %s\n", path, e)
+			t.FailNow()
+		}
+		if string(data) != expected {
+			t.Logf("Got incorrect content for %s: %q\n", path, data)
+			t.FailNow()
+		}
+	}
+	_, e = sfs.Lstat("fifo")
+	if e == nil {
+		t.Logf("The FIFO in the tar archive wasn't skipped\n")
+		t.FailNow()
+	}
+
+	expectedModes := map[string]fs.FileMode{
+		".":               fs.ModeDir | 0750,
+		"z_dir":           fs.ModeDir | 0700,
+		"z_dir/owned.txt": 0640,
+		"implicit":        fs.ModeDir | 0755,
+	}
+	for path, expected := range expectedModes {
+		info, e := fs.Stat(sfs, path)
+		if e != nil {
+			t.Logf("Failed getting info for %s: %s\n", path, e)
+			t.FailNow()
+		}
+		if info.Mode() != expected {
+			t.Logf("Got incorrect mode for %s: %s\n", path, info.Mode())
+			t.FailNow()
+		}
+		if !info.ModTime().Equal(modTime) {
+			t.Logf("Got incorrect mod time for %s: %s\n", path,
+				info.ModTime())
+			t.FailNow()
+		}
+	}
+
+	info, e := fs.Stat(sfs, "z_dir/owned.txt")
+	if e != nil {
+		t.Logf("Failed getting info for owned file: %s\n", e)
+		t.FailNow()
+	}
+	sysInfo := info.Sys().(*FileSys)
+	if !sysInfo.HasOwner || (sysInfo.UID != 1000) || (sysInfo.GID != 1001) ||
+		(sysInfo.UserName != "someone") ||
+		(sysInfo.GroupName != "some_group") {
+		t.Logf("Got incorrect ownership: %+v\n", sysInfo)
+		t.FailNow()
+	}
+	if !sysInfo.AccessTime.Equal(accessTime) {
+		t.Logf("Got incorrect access time: %s\n", sysInfo.AccessTime)
+		t.FailNow()
+	}
+	value, e := sfs.GetXattr("z_dir/owned.txt", "user.test")
+	if e != nil {
+		t.Logf("Failed getting extended attribute: %s\n", e)
+		t.FailNow()
+	}
+	if string(value) != "xattr value" {
+		t.Logf("Got incorrect extended attribute value: %q\n", value)
+		t.FailNow()
+	}
+	names, e := sfs.ListXattr("z_dir/owned.txt")
+	if e != nil {
+		t.Logf("Failed listing extended attributes: %s\n", e)
+		t.FailNow()
+	}
+	if len(names) != 1 {
+		t.Logf("Expected 1 extended attribute, got %v\n", names)
+		t.FailNow()
+	}
+
+	// Both hard links should share an ID, distinct from other files' IDs.
+	ids := make(map[string]uint64)
+	for _, path := range []string{"a.txt", "z_dir/hard_link.txt",
+		"z_dir/owned.txt", "absolute.txt"} {
+		info, e := fs.Stat(sfs, path)
+		if e != nil {
+			t.Logf("Failed getting info for %s: %s\n", path, e)
+			t.FailNow()
+		}
+		ids[path] = info.Sys().(*FileSys).ID
+	}
+	if ids["a.txt"] != ids["z_dir/hard_link.txt"] {
+		t.Logf("Hard links have different IDs: %v\n", ids)
+		t.FailNow()
+	}
+	if (ids["a.txt"] == ids["z_dir/owned.txt"]) ||
+		(ids["a.txt"] == ids["absolute.txt"]) {
+		t.Logf("A hard link has the same ID as a different file: %v\n", ids)
+		t.FailNow()
+	}
+}
+
+func TestCreateFromBadTar(t *testing.T) {
+	badArchives := map[string][]*tar.Header{
+		"escaping path": {
+			{Name: "../evil.txt", Typeflag: tar.TypeReg},
+		},
+		"duplicate path": {
+			{Name: "a.txt", Typeflag: tar.TypeReg},
+			{Name: "a.txt", Typeflag: tar.TypeReg},
+		},
+		"missing link target": {
+			{Name: "link", Typeflag: tar.TypeLink, Linkname: "missing"},
+		},
+		"linked directory": {
+			{Name: "dir", Typeflag: tar.TypeDir},
+			{Name: "link", Typeflag: tar.TypeLink, Linkname: "dir"},
+		},
+	}
+	for name, headers := range badArchives {
+		archive := createTestTar(t, headers, nil)
+		e := CreateSeekerFSFromTar(bytes.NewReader(archive),
+			NewSeekableBuffer(), nil)
+		if e == nil {
+			t.Logf("Didn't get expected error for tar with %s\n", name)
+			t.FailNow()
+		}
+		t.Logf("Got expected error for tar with %s: %s\n", name, e)
+	}
+}
+
+func TestCreateFromTarNonEmptyOutput(t *testing.T) {
+	archive := createTestTar(t, []*tar.Header{
+		{Name: "a.txt", Typeflag: tar.TypeReg},
+	}, nil)
+	output := NewSeekableBuffer()
+	_, e := output.Write([]byte("Existing data"))
+	if e != nil {
+		t.Logf("Failed writing existing data: %s\n", e)
+		t.FailNow()
+	}
+	e = CreateSeekerFSFromTar(bytes.NewReader(archive), output, nil)
+	if e == nil {
+		t.Logf("Didn't get expected error for a non-empty output\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error for a non-empty output: %s\n", e)
+}
@@ -0,0 +1,73 @@
+package seeker_fs
+
+// This file contains DirFS, a wrapper around os.DirFS that exposes metadata
+// that os.DirFS doesn't provide on its own.
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Wraps os.DirFS, additionally implementing the ReadLinkFS interface so that
+// CreateSeekerFS can store symbolic links in the directory tree as links. On
+// Linux, this also implements the XattrFS interface, so that CreateSeekerFS
+// stores extended attributes.
+type DirFS struct {
+	fs.FS
+	// The directory on the host filesystem at the root of the FS.
+	dir string
+}
+
+// Returns a DirFS for the tree of files rooted at the given directory.
+func NewDirFS(dir string) *DirFS {
+	return &DirFS{
+		FS:  os.DirFS(dir),
+		dir: dir,
+	}
+}
+
+// Converts a path within the FS to a path on the host filesystem. Returns an
+// error if the path isn't valid.
+func (d *DirFS) getHostPath(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", fs.ErrInvalid
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(name)), nil
+}
+
+// Returns the underlying error from the os package's *fs.PathErrors, so that
+// they can be rewrapped using the path within the FS rather than the host path.
+func unwrapPathError(e error) error {
+	var pathError *fs.PathError
+	if errors.As(e, &pathError) {
+		return pathError.Err
+	}
+	return e
+}
+
+func (d *DirFS) ReadLink(name string) (string, error) {
+	hostPath, e := d.getHostPath(name)
+	if e != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: e}
+	}
+	target, e := os.Readlink(hostPath)
+	if e != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name,
+			Err: unwrapPathError(e)}
+	}
+	return filepath.ToSlash(target), nil
+}
+
+func (d *DirFS) Lstat(name string) (fs.FileInfo, error) {
+	hostPath, e := d.getHostPath(name)
+	if e != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: e}
+	}
+	info, e := os.Lstat(hostPath)
+	if e != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name,
+			Err: unwrapPathError(e)}
+	}
+	return info, nil
+}
@@ -0,0 +1,127 @@
+//go:build linux
+// +build linux
+
+package seeker_fs
+
+// This file contains the Linux-specific parts of DirFS, which implement the
+// XattrFS interface.
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"syscall"
+	"unsafe"
+)
+
+// Returns a pointer to the start of the buffer, or nil if it's empty, for
+// passing to a system call.
+func bufferPointer(buffer []byte) uintptr {
+	if len(buffer) == 0 {
+		return 0
+	}
+	return uintptr(unsafe.Pointer(&(buffer[0])))
+}
+
+// Like syscall.Listxattr, but doesn't follow a symbolic link at the end of the
+// path. The syscall package doesn't provide this.
+func llistxattr(path string, dest []byte) (int, error) {
+	pathPtr, e := syscall.BytePtrFromString(path)
+	if e != nil {
+		return 0, e
+	}
+	size, _, errno := syscall.Syscall(syscall.SYS_LLISTXATTR,
+		uintptr(unsafe.Pointer(pathPtr)), bufferPointer(dest),
+		uintptr(len(dest)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(size), nil
+}
+
+// Like syscall.Getxattr, but doesn't follow a symbolic link at the end of the
+// path. The syscall package doesn't provide this.
+func lgetxattr(path, attr string, dest []byte) (int, error) {
+	pathPtr, e := syscall.BytePtrFromString(path)
+	if e != nil {
+		return 0, e
+	}
+	attrPtr, e := syscall.BytePtrFromString(attr)
+	if e != nil {
+		return 0, e
+	}
+	size, _, errno := syscall.Syscall6(syscall.SYS_LGETXATTR,
+		uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(attrPtr)),
+		bufferPointer(dest), uintptr(len(dest)), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(size), nil
+}
+
+// Calls the given function with increasingly large buffers until it succeeds,
+// as the size of an extended attribute or list may change between querying
+// its size and reading it. The function must behave like lgetxattr.
+func readXattrBuffer(read func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, e := read(nil)
+		if e != nil {
+			return nil, e
+		}
+		buffer := make([]byte, size)
+		size, e = read(buffer)
+		if errors.Is(e, syscall.ERANGE) {
+			continue
+		}
+		if e != nil {
+			return nil, e
+		}
+		return buffer[0:size], nil
+	}
+}
+
+// Returns the names of the named file's extended attributes, without following
+// a symbolic link in the last path component. Returns an empty list if the
+// host filesystem doesn't support extended attributes.
+func (d *DirFS) ListXattr(name string) ([]string, error) {
+	hostPath, e := d.getHostPath(name)
+	if e != nil {
+		return nil, &fs.PathError{Op: "listxattr", Path: name, Err: e}
+	}
+	list, e := readXattrBuffer(func(dest []byte) (int, error) {
+		return llistxattr(hostPath, dest)
+	})
+	if errors.Is(e, syscall.ENOTSUP) {
+		return nil, nil
+	}
+	if e != nil {
+		return nil, &fs.PathError{Op: "listxattr", Path: name, Err: e}
+	}
+	// The list is a sequence of null-terminated names.
+	var toReturn []string
+	for _, attr := range bytes.Split(list, []byte{0}) {
+		if len(attr) != 0 {
+			toReturn = append(toReturn, string(attr))
+		}
+	}
+	return toReturn, nil
+}
+
+// Returns the value of the named file's extended attribute, without following
+// a symbolic link in the last path component. Returns an error wrapping
+// ErrNoXattr if the file doesn't have the attribute.
+func (d *DirFS) GetXattr(name, attr string) ([]byte, error) {
+	hostPath, e := d.getHostPath(name)
+	if e != nil {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: e}
+	}
+	value, e := readXattrBuffer(func(dest []byte) (int, error) {
+		return lgetxattr(hostPath, attr, dest)
+	})
+	if errors.Is(e, syscall.ENODATA) || errors.Is(e, syscall.ENOTSUP) {
+		e = ErrNoXattr
+	}
+	if e != nil {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: e}
+	}
+	return value, nil
+}
@@ -0,0 +1,331 @@
+package seeker_fs
+
+// This file contains code related to the optional record of extra metadata
+// that may be associated with each File.
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// If this bit is set in File.Mode, then the file has a record of extra
+// metadata. In this case, NameOffset always points to the file's full name
+// (even if it fits in ShortName), and the extra record immediately follows the
+// name in the data stream. The record consists of a uint64 size, followed by
+// that many bytes of fields. Each field starts with an extraFieldHeader.
+const FileFlagHasExtra = uint64(1) << 32
+
+// Tags identifying each field in a file's extra metadata record. Fields with
+// unknown tags are ignored when reading.
+const (
+	// A uint32 CRC32C checksum of the file's (uncompressed) content.
+	extraTagChecksum = 1
+	// A compressionInfo struct, present if the file's content is compressed.
+	extraTagCompression = 2
+	// A uint64 file ID, present if the file is a hard link to a file that was
+	// written earlier. See fileExtra.getFileID().
+	extraTagFileID = 3
+	// A fileOwner struct, holding the numeric IDs of the file's owners.
+	extraTagOwner = 4
+	// The name of the user that owns the file.
+	extraTagUserName = 5
+	// The name of the group that owns the file.
+	extraTagGroupName = 6
+	// A uint32 number of nanoseconds to add to the File's ModTime.
+	extraTagModTimeNsec = 7
+	// An int64 access time, in nanoseconds since the Unix epoch.
+	extraTagAccessTime = 8
+	// An int64 status change time, in nanoseconds since the Unix epoch.
+	extraTagChangeTime = 9
+	// The file's extended attributes. See encodeXattrs().
+	extraTagXattrs = 10
+)
+
+// The content of an extraTagOwner field.
+type fileOwner struct {
+	UID uint32
+	GID uint32
+}
+
+// The header of each field in an extra metadata record. Followed by Size bytes
+// of the field's content.
+type extraFieldHeader struct {
+	Tag  uint32
+	Size uint32
+}
+
+// The table used for computing file content checksums.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Holds the decoded contents of a file's extra metadata record.
+type fileExtra struct {
+	// True if the file's content has a checksum.
+	hasChecksum bool
+	// The CRC32C checksum of the file's content.
+	checksum uint32
+	// Describes how the file's content is compressed. The codec will be
+	// CompressionNone if the content isn't compressed.
+	compression compressionInfo
+	// True if the file has an explicit file ID, i.e. it's a hard link.
+	hasFileID bool
+	// The file's ID, if hasFileID is true.
+	fileID uint64
+	// True if the file's owner is known.
+	hasOwner bool
+	// The numeric IDs of the file's owners, if hasOwner is true.
+	owner fileOwner
+	// The names of the file's owners. Empty if they aren't known.
+	userName  string
+	groupName string
+	// The sub-second part of the file's modification time.
+	modTimeNsec uint32
+	// True if the file's access time is known.
+	hasAccessTime bool
+	// The file's access time, in nanoseconds since the Unix epoch.
+	accessTime int64
+	// True if the file's status change time is known.
+	hasChangeTime bool
+	// The file's status change time, in nanoseconds since the Unix epoch.
+	changeTime int64
+	// The file's extended attributes, sorted by name.
+	xattrs []fileXattr
+}
+
+// Returns true if the record doesn't contain any fields, and therefore doesn't
+// need to be written.
+func (x *fileExtra) isEmpty() bool {
+	return !x.hasChecksum && !x.isCompressed() && !x.hasFileID &&
+		!x.hasOwner && (x.userName == "") && (x.groupName == "") &&
+		(x.modTimeNsec == 0) && !x.hasAccessTime && !x.hasChangeTime &&
+		(len(x.xattrs) == 0)
+}
+
+// Copies the fields describing the file's content (its checksum and
+// compression) from another record, leaving the other fields unchanged.
+func (x *fileExtra) copyContentInfo(other *fileExtra) {
+	x.hasChecksum = other.hasChecksum
+	x.checksum = other.checksum
+	x.compression = other.compression
+}
+
+// Returns true if the file's content is compressed.
+func (x *fileExtra) isCompressed() bool {
+	return x.compression.Codec != CompressionNone
+}
+
+// Returns the ID of the file whose header is at the given offset. Every
+// directory entry referring to the same file (i.e., hard links) will have the
+// same ID. Files without an explicit ID use the offset of their header, so
+// hard links use the header offset of the first link that was written.
+func (x *fileExtra) getFileID(headerOffset uint64) uint64 {
+	if x.hasFileID {
+		return x.fileID
+	}
+	return headerOffset
+}
+
+// Returns the number of bytes occupied by the content of the given file in
+// the data stream.
+func (x *fileExtra) storedSize(f *File) uint64 {
+	if x.isCompressed() {
+		return x.compression.StoredSize
+	}
+	return f.Size
+}
+
+// Appends a single field with the given tag and content to the buffer.
+func writeExtraField(b *bytes.Buffer, tag uint32, content interface{}) {
+	header := extraFieldHeader{
+		Tag:  tag,
+		Size: uint32(binary.Size(content)),
+	}
+	// Writes to a bytes.Buffer can't fail.
+	binary.Write(b, binary.LittleEndian, &header)
+	binary.Write(b, binary.LittleEndian, content)
+}
+
+// Returns the binary representation of the record, including the leading
+// size.
+func (x *fileExtra) encode() []byte {
+	var fields bytes.Buffer
+	if x.hasChecksum {
+		writeExtraField(&fields, extraTagChecksum, x.checksum)
+	}
+	if x.isCompressed() {
+		writeExtraField(&fields, extraTagCompression, &x.compression)
+	}
+	if x.hasFileID {
+		writeExtraField(&fields, extraTagFileID, x.fileID)
+	}
+	if x.hasOwner {
+		writeExtraField(&fields, extraTagOwner, &x.owner)
+	}
+	if x.userName != "" {
+		writeExtraField(&fields, extraTagUserName, []byte(x.userName))
+	}
+	if x.groupName != "" {
+		writeExtraField(&fields, extraTagGroupName, []byte(x.groupName))
+	}
+	if x.modTimeNsec != 0 {
+		writeExtraField(&fields, extraTagModTimeNsec, x.modTimeNsec)
+	}
+	if x.hasAccessTime {
+		writeExtraField(&fields, extraTagAccessTime, x.accessTime)
+	}
+	if x.hasChangeTime {
+		writeExtraField(&fields, extraTagChangeTime, x.changeTime)
+	}
+	if len(x.xattrs) != 0 {
+		writeExtraField(&fields, extraTagXattrs, encodeXattrs(x.xattrs))
+	}
+	var toReturn bytes.Buffer
+	binary.Write(&toReturn, binary.LittleEndian, uint64(fields.Len()))
+	toReturn.Write(fields.Bytes())
+	return toReturn.Bytes()
+}
+
+// Decodes a single field's content into dst, which must be a pointer to a
+// fixed-size value. Returns an error if the content is the wrong size.
+func decodeExtraField(content []byte, dst interface{}) error {
+	if len(content) != binary.Size(dst) {
+		return fmt.Errorf("Invalid field size: %d", len(content))
+	}
+	return binary.Read(bytes.NewReader(content), binary.LittleEndian, dst)
+}
+
+// Sets the record's contents from the given binary fields, not including the
+// leading size.
+func (x *fileExtra) decode(raw []byte) error {
+	var header extraFieldHeader
+	headerSize := binary.Size(&header)
+	for len(raw) != 0 {
+		if len(raw) < headerSize {
+			return fmt.Errorf("Extra record contains a truncated field header")
+		}
+		header.Tag = binary.LittleEndian.Uint32(raw[0:4])
+		header.Size = binary.LittleEndian.Uint32(raw[4:8])
+		raw = raw[headerSize:]
+		if uint64(len(raw)) < uint64(header.Size) {
+			return fmt.Errorf("Extra record field %d is truncated",
+				header.Tag)
+		}
+		content := raw[0:header.Size]
+		raw = raw[header.Size:]
+		switch header.Tag {
+		case extraTagChecksum:
+			if len(content) != 4 {
+				return fmt.Errorf("Invalid checksum size: %d", len(content))
+			}
+			x.hasChecksum = true
+			x.checksum = binary.LittleEndian.Uint32(content)
+		case extraTagCompression:
+			e := decodeExtraField(content, &x.compression)
+			if e != nil {
+				return fmt.Errorf("Bad compression info: %w", e)
+			}
+			e = x.compression.check()
+			if e != nil {
+				return e
+			}
+		case extraTagFileID:
+			e := decodeExtraField(content, &x.fileID)
+			if e != nil {
+				return fmt.Errorf("Bad file ID: %w", e)
+			}
+			x.hasFileID = true
+		case extraTagOwner:
+			e := decodeExtraField(content, &x.owner)
+			if e != nil {
+				return fmt.Errorf("Bad owner: %w", e)
+			}
+			x.hasOwner = true
+		case extraTagUserName:
+			x.userName = string(content)
+		case extraTagGroupName:
+			x.groupName = string(content)
+		case extraTagModTimeNsec:
+			e := decodeExtraField(content, &x.modTimeNsec)
+			if e != nil {
+				return fmt.Errorf("Bad modification time: %w", e)
+			}
+			if x.modTimeNsec >= 1000000000 {
+				return fmt.Errorf("Invalid modification time nanoseconds: %d",
+					x.modTimeNsec)
+			}
+		case extraTagAccessTime:
+			e := decodeExtraField(content, &x.accessTime)
+			if e != nil {
+				return fmt.Errorf("Bad access time: %w", e)
+			}
+			x.hasAccessTime = true
+		case extraTagChangeTime:
+			e := decodeExtraField(content, &x.changeTime)
+			if e != nil {
+				return fmt.Errorf("Bad change time: %w", e)
+			}
+			x.hasChangeTime = true
+		case extraTagXattrs:
+			xattrs, e := decodeXattrs(content)
+			if e != nil {
+				return fmt.Errorf("Bad extended attributes: %w", e)
+			}
+			x.xattrs = xattrs
+		}
+	}
+	return nil
+}
+
+// Returns true if the file has an extra metadata record.
+func (f *File) HasExtra() bool {
+	return (f.Mode & FileFlagHasExtra) != 0
+}
+
+// Returns the offset of the file's extra metadata record. Only valid if
+// HasExtra() returns true.
+func (f *File) extraOffset() uint64 {
+	return f.NameOffset + f.NameSize
+}
+
+// Reads and decodes the extra metadata record for the given file. Returns an
+// empty record if the file doesn't have one.
+func getFileExtra(f *File, p *SeekerFS) (*fileExtra, error) {
+	toReturn := &fileExtra{}
+	if !f.HasExtra() {
+		return toReturn, nil
+	}
+	offset := f.extraOffset()
+	if offset < f.NameOffset {
+		return nil, fmt.Errorf("Invalid extra record offset")
+	}
+	rawSize, e := p.getBytes(offset, 8)
+	if e != nil {
+		return nil, fmt.Errorf("Failed reading extra record size: %w", e)
+	}
+	size := binary.LittleEndian.Uint64(rawSize)
+	raw, e := p.getBytes(offset+8, size)
+	if e != nil {
+		return nil, fmt.Errorf("Failed reading extra record: %w", e)
+	}
+	e = toReturn.decode(raw)
+	if e != nil {
+		return nil, fmt.Errorf("Failed decoding extra record: %w", e)
+	}
+	return toReturn, nil
+}
+
+// Returned when reading a file whose content doesn't match the checksum that
+// was recorded when the FS was created.
+type ChecksumError struct {
+	// The path to the corrupted file.
+	Path string
+	// The checksum recorded in the FS.
+	Expected uint32
+	// The checksum of the data that was actually read.
+	Actual uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("Content of %s is corrupt: expected checksum 0x%08x, "+
+		"got 0x%08x", e.Path, e.Expected, e.Actual)
+}
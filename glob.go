@@ -0,0 +1,142 @@
+package seeker_fs
+
+// This file contains code for matching paths against glob patterns. Since the
+// entries of every directory are sorted by name, the entries matching a
+// pattern that starts with literal characters can be found using a binary
+// search, rather than by checking every entry in the directory.
+import (
+	"path"
+	"strings"
+)
+
+// The number of File structs read at once when checking the entries of a
+// directory against a pattern.
+const globBatchSize = 256
+
+// Returns true if the path contains any of the special characters recognized
+// by path.Match.
+func hasGlobMeta(s string) bool {
+	return strings.ContainsAny(s, `*?[\`)
+}
+
+// Returns the part of the pattern before its first special character. Every
+// name matching the pattern must start with this prefix.
+func getGlobPrefix(pattern string) string {
+	end := strings.IndexAny(pattern, `*?[\`)
+	if end < 0 {
+		return pattern
+	}
+	return pattern[0:end]
+}
+
+// Returns the index of the first entry in directory f with a name that isn't
+// less than the given prefix. Returns f.Size if there isn't one.
+func findFirstDirEntry(f *File, p *SeekerFS, prefix string) (int, error) {
+	// Like in getNamedDirEntry, this cast can't overflow.
+	beginIndex := 0
+	endIndex := int(f.Size)
+	if prefix == "" {
+		return beginIndex, nil
+	}
+	for beginIndex < endIndex {
+		currentIndex := (beginIndex + endIndex) >> 1
+		currentEntry, e := getDirEntry(f, p, currentIndex)
+		if e != nil {
+			return 0, e
+		}
+		compareResult, e := compareFileName(currentEntry, p, prefix)
+		if e != nil {
+			return 0, e
+		}
+		if compareResult < 0 {
+			beginIndex = currentIndex + 1
+		} else {
+			endIndex = currentIndex
+		}
+	}
+	return beginIndex, nil
+}
+
+// Appends the paths of the entries in the given directory that match the
+// pattern to matches, and returns the new slice. Like fs.Glob, this ignores
+// errors, such as if dir isn't a directory.
+func (p *SeekerFS) globDir(dir, pattern string, matches []string) []string {
+	f, _, e := resolveFilePath(p.topFile, p.topOffset, p, dir, true)
+	if (e != nil) || !f.IsDir() {
+		return matches
+	}
+	prefix := getGlobPrefix(pattern)
+	index, e := findFirstDirEntry(f, p, prefix)
+	if e != nil {
+		return matches
+	}
+	entries := make([]File, globBatchSize)
+	for uint64(index) < f.Size {
+		count := f.Size - uint64(index)
+		if count > globBatchSize {
+			count = globBatchSize
+		}
+		e = p.readFilesAtOffset(entries[0:count], getDirEntryOffset(f, index))
+		if e != nil {
+			return matches
+		}
+		for i := range entries[0:count] {
+			name, e := getFileName(&(entries[i]), p)
+			if e != nil {
+				return matches
+			}
+			// The entries are sorted, so none of the remaining entries can
+			// match once one doesn't start with the prefix.
+			if !strings.HasPrefix(name, prefix) {
+				return matches
+			}
+			matched, _ := path.Match(pattern, name)
+			if matched {
+				matches = append(matches, path.Join(dir, name))
+			}
+		}
+		index += int(count)
+	}
+	return matches
+}
+
+// Implements the fs.GlobFS interface, returning the same paths as fs.Glob.
+// Entries matching a pattern component that starts with literal characters are
+// found using a binary search, so globbing for a prefix is fast even in huge
+// directories. Symbolic links are followed when reading directories.
+func (p *SeekerFS) Glob(pattern string) ([]string, error) {
+	// Check that the pattern is well-formed, in the same way as fs.Glob.
+	_, e := path.Match(pattern, "")
+	if e != nil {
+		return nil, e
+	}
+	if !hasGlobMeta(pattern) {
+		_, e = p.Stat(pattern)
+		if e != nil {
+			return nil, nil
+		}
+		return []string{pattern}, nil
+	}
+	dir, file := path.Split(pattern)
+	if dir == "" {
+		dir = "."
+	} else {
+		dir = strings.TrimSuffix(dir, "/")
+	}
+	if !hasGlobMeta(dir) {
+		return p.globDir(dir, file, nil), nil
+	}
+	// Prevent infinite recursion, as fs.Glob does.
+	if dir == pattern {
+		return nil, path.ErrBadPattern
+	}
+	dirs, e := p.Glob(dir)
+	if e != nil {
+		return nil, e
+	}
+	var matches []string
+	for _, d := range dirs {
+		matches = p.globDir(d, file, matches)
+	}
+	return matches, nil
+}
@@ -0,0 +1,119 @@
+package seeker_fs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+)
+
+// Wraps an io.ReaderAt, counting the number of reads.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int64
+}
+
+func (c *countingReaderAt) ReadAt(data []byte, offset int64) (int, error) {
+	atomic.AddInt64(&c.reads, 1)
+	return c.r.ReadAt(data, offset)
+}
+
+// Hides every method of an FS other than Open, so that the functions in io/fs
+// use their generic implementations.
+type openOnlyFS struct {
+	fs.FS
+}
+
+func TestGlob(t *testing.T) {
+	mapFS := fstest.MapFS{
+		"logs/[bracket].txt":       newMapFile("Bracket"),
+		"logs/nested/2024-01.txt":  newMapFile("Nested"),
+		"other/2024-01/notes.txt":  newMapFile("Other"),
+		"other/2024-02/notes.txt":  newMapFile("Other"),
+		"other/2024-02/notes2.txt": newMapFile("Other"),
+		"top.txt":                  newMapFile("Top"),
+	}
+	for year := 2020; year < 2025; year++ {
+		for day := 0; day < 200; day++ {
+			name := fmt.Sprintf("logs/%d-%03d.log", year, day)
+			mapFS[name] = newMapFile(name)
+		}
+	}
+	data := NewSeekableBuffer()
+	e := CreateSeekerFS(mapFS, data, nil)
+	if e != nil {
+		t.Logf("Failed creating seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	raw := getBufferBytes(t, data)
+	counter := &countingReaderAt{r: bytes.NewReader(raw)}
+	sfs, e := LoadSeekerFSReaderAt(counter, int64(len(raw)))
+	if e != nil {
+		t.Logf("Failed loading seeker FS: %s\n", e)
+		t.FailNow()
+	}
+
+	patterns := []string{
+		"*",
+		"logs/2024-*",
+		"logs/2024-1?0.log",
+		"logs/202[13]-00*",
+		"logs/\\[bracket].txt",
+		"logs/*/2024-01.txt",
+		"*/2024-0*/notes*",
+		"*/*/*",
+		"top.txt",
+		"missing.txt",
+		"missing/*",
+		"top.txt/*",
+		"logs/zzz*",
+	}
+	for _, pattern := range patterns {
+		expected, e := fs.Glob(openOnlyFS{sfs}, pattern)
+		if e != nil {
+			t.Logf("fs.Glob failed for %s: %s\n", pattern, e)
+			t.FailNow()
+		}
+		matches, e := sfs.Glob(pattern)
+		if e != nil {
+			t.Logf("Glob failed for %s: %s\n", pattern, e)
+			t.FailNow()
+		}
+		t.Logf("Pattern %s matched %d paths\n", pattern, len(matches))
+		if !reflect.DeepEqual(matches, expected) {
+			t.Logf("Got incorrect matches for %s: %v, expected %v\n",
+				pattern, matches, expected)
+			t.FailNow()
+		}
+	}
+	_, e = sfs.Glob("logs/[")
+	if e != path.ErrBadPattern {
+		t.Logf("Didn't get expected error for a bad pattern. Got %v "+
+			"instead.\n", e)
+		t.FailNow()
+	}
+
+	// Finding a handful of entries by prefix shouldn't require reading every
+	// entry in the directory.
+	atomic.StoreInt64(&counter.reads, 0)
+	matches, e := sfs.Glob("logs/2022-19*")
+	if e != nil {
+		t.Logf("Glob failed: %s\n", e)
+		t.FailNow()
+	}
+	reads := atomic.LoadInt64(&counter.reads)
+	t.Logf("Matched %d paths using %d reads\n", len(matches), reads)
+	if len(matches) != 10 {
+		t.Logf("Got %d matches, expected 10\n", len(matches))
+		t.FailNow()
+	}
+	if reads > 50 {
+		t.Logf("Glob used too many reads: %d\n", reads)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,136 @@
+package seeker_fs
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Returns the ID of the file at the given path in the FS.
+func getFileID(t *testing.T, f fs.FS, path string) uint64 {
+	info, e := fs.Stat(f, path)
+	if e != nil {
+		t.Logf("Failed getting info for %s: %s\n", path, e)
+		t.FailNow()
+	}
+	sysInfo, ok := info.Sys().(*FileSys)
+	if !ok {
+		t.Logf("Sys() for %s didn't return a *FileSys\n", path)
+		t.FailNow()
+	}
+	return sysInfo.ID
+}
+
+func TestHardLinks(t *testing.T) {
+	dir := t.TempDir()
+	check := func(e error) {
+		if e != nil {
+			t.Logf("Failed creating test directory tree: %s\n", e)
+			t.FailNow()
+		}
+	}
+	content := "Content shared by hard links"
+	check(os.MkdirAll(filepath.Join(dir, "a/b"), 0755))
+	check(os.WriteFile(filepath.Join(dir, "a/original.txt"), []byte(content),
+		0644))
+	check(os.WriteFile(filepath.Join(dir, "a/different.txt"),
+		[]byte(content), 0644))
+	check(os.Link(filepath.Join(dir, "a/original.txt"),
+		filepath.Join(dir, "a/b/link1.txt")))
+	check(os.Link(filepath.Join(dir, "a/original.txt"),
+		filepath.Join(dir, "link2.txt")))
+
+	data := NewSeekableBuffer()
+	e := CreateSeekerFS(NewDirFS(dir), data, &CreateFSSettings{
+		StatusLog: &testLogger{t},
+	})
+	if e != nil {
+		t.Logf("Failed creating FS with hard links: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading FS with hard links: %s\n", e)
+		t.FailNow()
+	}
+	checkHardLinks(t, sfs, content)
+
+	// Streaming images need to handle links differently, as the location of
+	// the first link's header isn't known when later links are written.
+	var output writeOnlyBuffer
+	e = CreateSeekerFSStream(NewDirFS(dir), &output, nil)
+	if e != nil {
+		t.Logf("Failed creating streaming FS with hard links: %s\n", e)
+		t.FailNow()
+	}
+	raw := output.b.Bytes()
+	sfs, e = LoadSeekerFSReaderAt(bytes.NewReader(raw), int64(len(raw)))
+	if e != nil {
+		t.Logf("Failed loading streaming FS with hard links: %s\n", e)
+		t.FailNow()
+	}
+	checkHardLinks(t, sfs, content)
+}
+
+// Checks that the FS created by TestHardLinks contains the expected links.
+func checkHardLinks(t *testing.T, sfs *SeekerFS, content string) {
+	e := sfs.Validate()
+	if e != nil {
+		t.Logf("Validating FS with hard links failed: %s\n", e)
+		t.FailNow()
+	}
+
+	linkPaths := []string{"a/original.txt", "a/b/link1.txt", "link2.txt"}
+	expectedID := getFileID(t, sfs, linkPaths[0])
+	for _, path := range linkPaths {
+		id := getFileID(t, sfs, path)
+		if id != expectedID {
+			t.Logf("%s has ID %d, expected %d\n", path, id, expectedID)
+			t.FailNow()
+		}
+		data, e := fs.ReadFile(sfs, path)
+		if e != nil {
+			t.Logf("Failed reading %s: %s\n", path, e)
+			t.FailNow()
+		}
+		if string(data) != content {
+			t.Logf("Got incorrect content for %s: %q\n", path, data)
+			t.FailNow()
+		}
+	}
+	if getFileID(t, sfs, "a/different.txt") == expectedID {
+		t.Logf("A file that isn't a link has the same ID as a link\n")
+		t.FailNow()
+	}
+
+	// Make sure IDs are the same when accessed through a Sub view.
+	sub, e := sfs.Sub("a")
+	if e != nil {
+		t.Logf("Failed getting sub FS: %s\n", e)
+		t.FailNow()
+	}
+	if getFileID(t, sub, "b/link1.txt") != expectedID {
+		t.Logf("Link has a different ID in a sub FS\n")
+		t.FailNow()
+	}
+	if getFileID(t, sub, ".") != getFileID(t, sfs, "a") {
+		t.Logf("Directory has a different ID in a sub FS\n")
+		t.FailNow()
+	}
+	entries, e := fs.ReadDir(sub, "b")
+	if e != nil {
+		t.Logf("Failed reading directory in sub FS: %s\n", e)
+		t.FailNow()
+	}
+	info, e := entries[0].Info()
+	if e != nil {
+		t.Logf("Failed getting info from directory entry: %s\n", e)
+		t.FailNow()
+	}
+	if info.Sys().(*FileSys).ID != expectedID {
+		t.Logf("Directory entry for link has a different ID\n")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,437 @@
+package seeker_fs
+
+// This file contains code for adding a hash tree to an existing image, and for
+// verifying an image's content against its hash tree as it's read.
+//
+// The hash tree covers the first TotalSize bytes of the image (including the
+// ImageHeader), split into fixed-size blocks. The hash of each data block is
+// stored in level 0 of the tree. Each level is split into blocks of the same
+// size (the last one padded with zeros), and the hashes of those blocks make up
+// the next level, until a level contains only a single hash: the root hash.
+// Every level except the root is stored immediately after a hashTreeHeader,
+// which is located at offset TotalSize in the image.
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// The default size of the blocks covered by each hash in a hash tree.
+const DefaultHashTreeBlockSize = 4096
+
+// Located at the end of an image with a hash tree, and followed by the levels
+// of the tree, starting with level 0.
+type hashTreeHeader struct {
+	// Must be the eight bytes "HASHTREE".
+	Magic [8]byte
+	// The size of each block, in bytes. Must be a power of two, and at least
+	// 64.
+	BlockSize uint64
+	// The SHA-256 root hash of the tree.
+	RootHash [sha256.Size]byte
+}
+
+// Returned when data read from an image doesn't match its hash tree.
+type HashTreeError struct {
+	// The level of the tree containing the corrupt block. Level -1 indicates
+	// the image's data itself, rather than a level of stored hashes.
+	Level int
+	// The offset of the corrupt block in the image.
+	Offset uint64
+}
+
+func (e *HashTreeError) Error() string {
+	if e.Level < 0 {
+		return fmt.Sprintf("Image data block at offset %d doesn't match the "+
+			"hash tree", e.Offset)
+	}
+	return fmt.Sprintf("Block of level %d of the hash tree at offset %d is "+
+		"corrupt", e.Level, e.Offset)
+}
+
+// Returns the number of hashes in each level of a hash tree covering
+// dataSize bytes. The last level will always contain a single hash.
+func getHashTreeLevelCounts(dataSize, blockSize uint64) []uint64 {
+	fanout := blockSize / sha256.Size
+	count := (dataSize + blockSize - 1) / blockSize
+	if count == 0 {
+		count = 1
+	}
+	toReturn := []uint64{count}
+	for count > 1 {
+		count = (count + fanout - 1) / fanout
+		toReturn = append(toReturn, count)
+	}
+	return toReturn
+}
+
+// Checks that the block size is usable for a hash tree.
+func checkHashTreeBlockSize(blockSize uint64) error {
+	if (blockSize < 64) || ((blockSize & (blockSize - 1)) != 0) {
+		return fmt.Errorf("Invalid hash tree block size: %d", blockSize)
+	}
+	return nil
+}
+
+// Hashes the given data, split into blocks of the given size. Pads the data
+// with zeros to a multiple of the block size first if pad is true.
+func hashBlocks(data []byte, blockSize uint64, pad bool) []byte {
+	if pad && ((uint64(len(data)) % blockSize) != 0) {
+		padding := blockSize - (uint64(len(data)) % blockSize)
+		data = append(data, make([]byte, padding)...)
+	}
+	toReturn := make([]byte, 0, (uint64(len(data))/blockSize+1)*sha256.Size)
+	for len(data) != 0 {
+		end := blockSize
+		if end > uint64(len(data)) {
+			end = uint64(len(data))
+		}
+		sum := sha256.Sum256(data[0:end])
+		toReturn = append(toReturn, sum[:]...)
+		data = data[end:]
+	}
+	return toReturn
+}
+
+// Adds a hash tree to the image in the given data stream, which must have been
+// created by CreateSeekerFS, and returns the tree's root hash. Pass the root
+// hash to WithRootHash when loading the image to ensure that it hasn't been
+// modified. The image's header is updated to indicate that it has a hash tree,
+// and the tree is written after the end of the image, replacing any existing
+// hash tree. Uses DefaultHashTreeBlockSize if blockSize is 0.
+func AddHashTree(image io.ReadWriteSeeker, blockSize uint64) ([]byte, error) {
+	if blockSize == 0 {
+		blockSize = DefaultHashTreeBlockSize
+	}
+	e := checkHashTreeBlockSize(blockSize)
+	if e != nil {
+		return nil, e
+	}
+	var header ImageHeader
+	_, e = image.Seek(0, io.SeekStart)
+	if e != nil {
+		return nil, fmt.Errorf("Failed seeking to image start: %w", e)
+	}
+	e = binary.Read(image, binary.LittleEndian, &header)
+	if e != nil {
+		return nil, fmt.Errorf("Failed reading image header: %w", e)
+	}
+	streamSize, e := image.Seek(0, io.SeekEnd)
+	if e != nil {
+		return nil, fmt.Errorf("Failed getting image size: %w", e)
+	}
+	if (header.Flags & ImageFlagFooter) != 0 {
+		// The tree will follow the footer, so replace the placeholder header
+		// with the real one. The footer will remain as part of the image.
+		_, e = image.Seek(streamSize-int64(imageHeaderSize), io.SeekStart)
+		if e != nil {
+			return nil, fmt.Errorf("Failed seeking to image footer: %w", e)
+		}
+		e = binary.Read(image, binary.LittleEndian, &header)
+		if e != nil {
+			return nil, fmt.Errorf("Failed reading image footer: %w", e)
+		}
+		if (header.Flags & ImageFlagFooter) == 0 {
+			return nil, fmt.Errorf("Invalid image footer")
+		}
+		header.Flags &^= ImageFlagFooter
+	}
+	e = header.Validate(uint64(streamSize))
+	if e != nil {
+		return nil, fmt.Errorf("Invalid image header: %w", e)
+	}
+
+	// The header is covered by the tree, so update its flags first.
+	header.Flags |= ImageFlagHashTree
+	_, e = image.Seek(0, io.SeekStart)
+	if e != nil {
+		return nil, fmt.Errorf("Failed seeking to image start: %w", e)
+	}
+	e = binary.Write(image, binary.LittleEndian, &header)
+	if e != nil {
+		return nil, fmt.Errorf("Failed updating image header: %w", e)
+	}
+
+	// Compute level 0 by hashing the image's data one block at a time.
+	_, e = image.Seek(0, io.SeekStart)
+	if e != nil {
+		return nil, fmt.Errorf("Failed seeking to image start: %w", e)
+	}
+	block := make([]byte, blockSize)
+	levelCounts := getHashTreeLevelCounts(header.TotalSize, blockSize)
+	level := make([]byte, 0, levelCounts[0]*sha256.Size)
+	remaining := header.TotalSize
+	for remaining > 0 {
+		toRead := blockSize
+		if toRead > remaining {
+			toRead = remaining
+		}
+		_, e = io.ReadFull(image, block[0:toRead])
+		if e != nil {
+			return nil, fmt.Errorf("Failed reading image data: %w", e)
+		}
+		sum := sha256.Sum256(block[0:toRead])
+		level = append(level, sum[:]...)
+		remaining -= toRead
+	}
+
+	// Compute the remaining levels in memory, padding each stored level to a
+	// multiple of the block size.
+	var storedLevels bytes.Buffer
+	for len(level) > sha256.Size {
+		storedLevels.Write(level)
+		padding := blockSize - (uint64(len(level)) % blockSize)
+		if padding != blockSize {
+			storedLevels.Write(make([]byte, padding))
+		}
+		level = hashBlocks(level, blockSize, true)
+	}
+	treeHeader := hashTreeHeader{
+		BlockSize: blockSize,
+	}
+	copy(treeHeader.Magic[:], []byte("HASHTREE"))
+	copy(treeHeader.RootHash[:], level)
+
+	// Finally, write the tree following the image's data.
+	_, e = image.Seek(int64(header.TotalSize), io.SeekStart)
+	if e != nil {
+		return nil, fmt.Errorf("Failed seeking to end of image data: %w", e)
+	}
+	e = binary.Write(image, binary.LittleEndian, &treeHeader)
+	if e != nil {
+		return nil, fmt.Errorf("Failed writing hash tree header: %w", e)
+	}
+	_, e = image.Write(storedLevels.Bytes())
+	if e != nil {
+		return nil, fmt.Errorf("Failed writing hash tree: %w", e)
+	}
+	return treeHeader.RootHash[:], nil
+}
+
+// Identifies a block of stored hashes in a hashTree.
+type hashBlockID struct {
+	level int
+	index uint64
+}
+
+// Satisfies the io.ReaderAt interface, verifying every block of an image's
+// data against the image's hash tree as it's read. Blocks of stored hashes
+// are cached once they've been verified, but the image's data is verified
+// every time it's read, so the underlying data can't be changed after being
+// verified.
+type hashTree struct {
+	// The underlying data stream containing the image and the tree.
+	data io.ReaderAt
+	// The size of the image's data covered by the tree.
+	dataSize uint64
+	// The tree's header, including the root hash.
+	header hashTreeHeader
+	// The number of hashes in each level of the tree.
+	levelCounts []uint64
+	// The offset of each stored level in the data stream. Doesn't include the
+	// final level, containing only the root hash.
+	levelOffsets []uint64
+	// Protects the verified map.
+	lock sync.Mutex
+	// Contains every block of stored hashes that has been verified so far.
+	verified map[hashBlockID][]byte
+}
+
+// Reads and checks the hash tree for an image containing dataSize bytes,
+// located in a data stream of the given size.
+func loadHashTree(data io.ReaderAt, dataSize, streamSize uint64) (*hashTree,
+	error) {
+	var header hashTreeHeader
+	headerSize := uint64(binary.Size(&header))
+	e := checkDataRange(dataSize, headerSize, streamSize)
+	if e != nil {
+		return nil, fmt.Errorf("Hash tree header is missing: %w", e)
+	}
+	raw := make([]byte, headerSize)
+	e = readFullAt(data, raw, dataSize)
+	if e != nil {
+		return nil, fmt.Errorf("Failed reading hash tree header: %w", e)
+	}
+	binary.Read(bytes.NewReader(raw), binary.LittleEndian, &header)
+	if string(header.Magic[:]) != "HASHTREE" {
+		return nil, fmt.Errorf("Incorrect hash tree magic")
+	}
+	e = checkHashTreeBlockSize(header.BlockSize)
+	if e != nil {
+		return nil, e
+	}
+	toReturn := &hashTree{
+		data:        data,
+		dataSize:    dataSize,
+		header:      header,
+		levelCounts: getHashTreeLevelCounts(dataSize, header.BlockSize),
+		verified:    make(map[hashBlockID][]byte),
+	}
+	hashesPerBlock := header.BlockSize / sha256.Size
+	offset := dataSize + headerSize
+	for i := 0; i < len(toReturn.levelCounts)-1; i++ {
+		toReturn.levelOffsets = append(toReturn.levelOffsets, offset)
+		blockCount := (toReturn.levelCounts[i] + hashesPerBlock - 1) /
+			hashesPerBlock
+		offset += blockCount * header.BlockSize
+	}
+	e = checkDataRange(dataSize, offset-dataSize, streamSize)
+	if e != nil {
+		return nil, fmt.Errorf("Hash tree is truncated: %w", e)
+	}
+	return toReturn, nil
+}
+
+// Returns the tree's root hash.
+func (t *hashTree) rootHash() []byte {
+	return t.header.RootHash[:]
+}
+
+// Returns the expected hash of the block with the given index in the given
+// level, where level -1 refers to the image's data.
+func (t *hashTree) getHash(level int, index uint64) ([]byte, error) {
+	if level+1 == len(t.levelCounts)-1 {
+		// The block at this level is covered directly by the root hash.
+		return t.rootHash(), nil
+	}
+	hashesPerBlock := t.header.BlockSize / sha256.Size
+	block, e := t.getHashBlock(level+1, index/hashesPerBlock)
+	if e != nil {
+		return nil, e
+	}
+	start := (index % hashesPerBlock) * sha256.Size
+	return block[start : start+sha256.Size], nil
+}
+
+// Returns the verified contents of the block of stored hashes with the given
+// index in the given level.
+func (t *hashTree) getHashBlock(level int, index uint64) ([]byte, error) {
+	id := hashBlockID{
+		level: level,
+		index: index,
+	}
+	t.lock.Lock()
+	toReturn := t.verified[id]
+	t.lock.Unlock()
+	if toReturn != nil {
+		return toReturn, nil
+	}
+	offset := t.levelOffsets[level] + index*t.header.BlockSize
+	toReturn = make([]byte, t.header.BlockSize)
+	e := readFullAt(t.data, toReturn, offset)
+	if e != nil {
+		return nil, fmt.Errorf("Failed reading hash tree block: %w", e)
+	}
+	expected, e := t.getHash(level, index)
+	if e != nil {
+		return nil, e
+	}
+	actual := sha256.Sum256(toReturn)
+	if !bytes.Equal(actual[:], expected) {
+		return nil, &HashTreeError{
+			Level:  level,
+			Offset: offset,
+		}
+	}
+	t.lock.Lock()
+	t.verified[id] = toReturn
+	t.lock.Unlock()
+	return toReturn, nil
+}
+
+// Reads and verifies the block of image data containing the given offset,
+// and returns the block's offset and contents.
+func (t *hashTree) readDataBlock(offset uint64) (uint64, []byte, error) {
+	blockSize := t.header.BlockSize
+	index := offset / blockSize
+	start := index * blockSize
+	end := start + blockSize
+	if end > t.dataSize {
+		end = t.dataSize
+	}
+	block := make([]byte, end-start)
+	e := readFullAt(t.data, block, start)
+	if e != nil {
+		return 0, nil, fmt.Errorf("Failed reading image data: %w", e)
+	}
+	expected, e := t.getHash(-1, index)
+	if e != nil {
+		return 0, nil, e
+	}
+	actual := sha256.Sum256(block)
+	if !bytes.Equal(actual[:], expected) {
+		return 0, nil, &HashTreeError{
+			Level:  -1,
+			Offset: start,
+		}
+	}
+	return start, block, nil
+}
+
+func (t *hashTree) ReadAt(data []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("Invalid offset: %d", offset)
+	}
+	bytesRead := 0
+	current := uint64(offset)
+	for bytesRead < len(data) {
+		if current >= t.dataSize {
+			return bytesRead, io.EOF
+		}
+		blockStart, block, e := t.readDataBlock(current)
+		if e != nil {
+			return bytesRead, e
+		}
+		n := copy(data[bytesRead:], block[current-blockStart:])
+		bytesRead += n
+		current += uint64(n)
+	}
+	return bytesRead, nil
+}
+
+// Returns the root hash of the image's hash tree, or nil if the image doesn't
+// have a hash tree.
+func (f *SeekerFS) GetRootHash() []byte {
+	if f.tree == nil {
+		return nil
+	}
+	return append([]byte{}, f.tree.rootHash()...)
+}
+
+// Loads the image's hash tree if it has one, and, if so, makes all further
+// reads go through the tree. The streamSize is the size of the underlying data
+// stream. If rootHash is non-nil, the image must have a hash tree with the
+// given root hash. Must be called after reading the image's header.
+func (f *SeekerFS) setupHashTree(streamSize uint64, rootHash []byte) error {
+	if (f.header == nil) || ((f.header.Flags & ImageFlagHashTree) == 0) {
+		if rootHash != nil {
+			return fmt.Errorf("A root hash was provided, but the image " +
+				"doesn't have a hash tree")
+		}
+		return nil
+	}
+	tree, e := loadHashTree(f.data, f.header.TotalSize, streamSize)
+	if e != nil {
+		return fmt.Errorf("Failed loading hash tree: %w", e)
+	}
+	if (rootHash != nil) && !bytes.Equal(rootHash, tree.rootHash()) {
+		return fmt.Errorf("The image's root hash doesn't match the provided " +
+			"root hash")
+	}
+	f.data = tree
+	f.tree = tree
+
+	// We read the header before we could verify it, so make sure the verified
+	// header matches.
+	verified, e := f.readImageHeader()
+	if e != nil {
+		return fmt.Errorf("Failed verifying image header: %w", e)
+	}
+	if *verified != *(f.header) {
+		return fmt.Errorf("The image header changed while loading")
+	}
+	return nil
+}
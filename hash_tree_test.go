@@ -0,0 +1,83 @@
+package seeker_fs
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestHashTree(t *testing.T) {
+	data := NewSeekableBuffer()
+	e := CreateSeekerFS(os.DirFS("test_data/test_dir"), data, nil)
+	if e != nil {
+		t.Logf("Failed creating seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	// Use a tiny block size, so that the tree has several levels.
+	rootHash, e := AddHashTree(data, 64)
+	if e != nil {
+		t.Logf("Failed adding hash tree: %s\n", e)
+		t.FailNow()
+	}
+	t.Logf("Got root hash %x\n", rootHash)
+	sfs, e := LoadSeekerFS(data, WithRootHash(rootHash))
+	if e != nil {
+		t.Logf("Failed loading seeker FS with a hash tree: %s\n", e)
+		t.FailNow()
+	}
+	if !bytes.Equal(sfs.GetRootHash(), rootHash) {
+		t.Logf("Got incorrect root hash from the loaded FS: %x\n",
+			sfs.GetRootHash())
+		t.Fail()
+	}
+	e = fstest.TestFS(sfs, "test1.txt", "b/c/test2.txt", "b/c/hi.png")
+	if e != nil {
+		t.Logf("TestFS failed on FS with a hash tree: %s\n", e)
+		t.FailNow()
+	}
+	e = sfs.Validate()
+	if e != nil {
+		t.Logf("Validating FS with a hash tree failed: %s\n", e)
+		t.FailNow()
+	}
+
+	// Make sure we refuse to load the FS with the wrong root hash.
+	wrongHash := append([]byte{}, rootHash...)
+	wrongHash[0] ^= 1
+	_, e = LoadSeekerFS(data, WithRootHash(wrongHash))
+	if e == nil {
+		t.Logf("Didn't get expected error when using the wrong root hash.\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error when using the wrong root hash: %s\n", e)
+
+	// Corrupt a file's content, and make sure reading it fails.
+	f, _, e := resolveFilePath(sfs.topFile, sfs.topOffset, sfs,
+		"b/c/hi.png", true)
+	if e != nil {
+		t.Logf("Failed finding b/c/hi.png: %s\n", e)
+		t.FailNow()
+	}
+	corruptBuffer(t, data, int64(f.DataOffset+f.Size/2), []byte("oops"))
+	_, e = fs.ReadFile(sfs, "b/c/hi.png")
+	var treeError *HashTreeError
+	if !errors.As(e, &treeError) {
+		t.Logf("Didn't get expected hash tree error. Got %v instead.\n", e)
+		t.FailNow()
+	}
+	t.Logf("Got expected error when reading a corrupt file: %s\n", e)
+
+	// Other files should still be readable.
+	content, e := fs.ReadFile(sfs, "b/c/test2.txt")
+	if e != nil {
+		t.Logf("Failed reading uncorrupted file: %s\n", e)
+		t.FailNow()
+	}
+	if string(content) != "test2" {
+		t.Logf("Got incorrect content for b/c/test2.txt: %q\n", content)
+		t.Fail()
+	}
+}
@@ -0,0 +1,156 @@
+package seeker_fs
+
+// This file contains code related to the header at the start of a SeekerFS
+// image.
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// The magic string at the start of every SeekerFS image with an ImageHeader.
+const imageHeaderMagic = "SEEKERFS"
+
+// The most recent version of the ImageHeader format. Images with a later
+// version can't be loaded.
+const CurrentImageVersion = 1
+
+// Bits in ImageHeader.Flags, indicating optional features used by an image.
+const (
+	// Regular files may have checksums of their content, which are verified
+	// when the file is read.
+	ImageFlagChecksums = uint64(1) << iota
+	// The image is followed by a hash tree, which is used to verify its
+	// content as it's read.
+	ImageFlagHashTree
+	// Regular files may have compressed content.
+	ImageFlagCompression
+	// The image was written to a stream (see CreateSeekerFSStream), so the
+	// header at the start of the image is only a placeholder, and the real
+	// header is stored as a footer in the image's last bytes. Both the
+	// placeholder and the footer have this flag set.
+	ImageFlagFooter
+)
+
+// A mask of all ImageHeader.Flags bits supported by this version of the
+// library. Images with any other flags set can't be loaded, as they may rely
+// on features that we'd otherwise silently ignore.
+const supportedImageFlags = ImageFlagChecksums | ImageFlagHashTree |
+	ImageFlagCompression | ImageFlagFooter
+
+// Holds the header at the start of a SeekerFS image. Images written by older
+// versions of this library don't contain a header, and instead start with the
+// root directory's File struct. Such "legacy" images can still be loaded.
+type ImageHeader struct {
+	// Must be the eight bytes "SEEKERFS".
+	Magic [8]byte
+	// The version of the image format.
+	Version uint64
+	// A bitfield of optional features used by the image.
+	Flags uint64
+	// The offset of the root directory's File struct.
+	RootOffset uint64
+	// The total size of the image, in bytes, including this header.
+	TotalSize uint64
+	// A 64-bit unix timestamp of when the image was created.
+	CreationTime uint64
+}
+
+// Holds the size of the ImageHeader struct, in bytes. Set during init().
+var imageHeaderSize uint64
+
+func init() {
+	imageHeaderSize = uint64(binary.Size(ImageHeader{}))
+}
+
+// Returns a new header for the current image version, with the magic string
+// and version set.
+func newImageHeader() *ImageHeader {
+	var toReturn ImageHeader
+	copy(toReturn.Magic[:], []byte(imageHeaderMagic))
+	toReturn.Version = CurrentImageVersion
+	return &toReturn
+}
+
+// Checks the header's fields, given the size of the data stream containing the
+// image. Returns nil if the header can be used.
+func (h *ImageHeader) Validate(dataSize uint64) error {
+	if string(h.Magic[:]) != imageHeaderMagic {
+		return fmt.Errorf("Incorrect image header magic")
+	}
+	if (h.Version == 0) || (h.Version > CurrentImageVersion) {
+		return fmt.Errorf("Unsupported image version: %d", h.Version)
+	}
+	unsupported := h.Flags &^ supportedImageFlags
+	if unsupported != 0 {
+		return fmt.Errorf("Image uses unsupported features (flags 0x%x)",
+			unsupported)
+	}
+	if h.TotalSize > dataSize {
+		return fmt.Errorf("Image is truncated: expected %d bytes, got %d",
+			h.TotalSize, dataSize)
+	}
+	if h.RootOffset < imageHeaderSize {
+		return fmt.Errorf("Root directory offset %d overlaps the header",
+			h.RootOffset)
+	}
+	e := checkDataRange(h.RootOffset, fileStructSize, h.TotalSize)
+	if e != nil {
+		return fmt.Errorf("Bad root directory location: %w", e)
+	}
+	return nil
+}
+
+// Reads the ImageHeader at the start of the FS's data stream. Returns a nil
+// header and no error if the image is a legacy image without a header.
+func (f *SeekerFS) readImageHeader() (*ImageHeader, error) {
+	magic, e := f.getBytes(0, 8)
+	if e != nil {
+		return nil, fmt.Errorf("Failed reading image magic: %w", e)
+	}
+	if string(magic) != imageHeaderMagic {
+		// We'll let the caller report an error if this isn't a File either.
+		return nil, nil
+	}
+	raw, e := f.getBytes(0, imageHeaderSize)
+	if e != nil {
+		return nil, fmt.Errorf("Failed reading image header: %w", e)
+	}
+	var toReturn ImageHeader
+	e = binary.Read(bytes.NewReader(raw), binary.LittleEndian, &toReturn)
+	if e != nil {
+		return nil, fmt.Errorf("Failed parsing image header: %w", e)
+	}
+	if (toReturn.Flags & ImageFlagFooter) != 0 {
+		// The real header is at the end of the data.
+		if f.dataSize < 2*imageHeaderSize {
+			return nil, fmt.Errorf("Image is too small to contain a footer")
+		}
+		raw, e = f.getBytes(f.dataSize-imageHeaderSize, imageHeaderSize)
+		if e != nil {
+			return nil, fmt.Errorf("Failed reading image footer: %w", e)
+		}
+		e = binary.Read(bytes.NewReader(raw), binary.LittleEndian, &toReturn)
+		if e != nil {
+			return nil, fmt.Errorf("Failed parsing image footer: %w", e)
+		}
+		if (toReturn.Flags & ImageFlagFooter) == 0 {
+			return nil, fmt.Errorf("Invalid image footer")
+		}
+	}
+	e = toReturn.Validate(f.dataSize)
+	if e != nil {
+		return nil, fmt.Errorf("Invalid image header: %w", e)
+	}
+	return &toReturn, nil
+}
+
+// Returns a copy of the image's header, or nil if the FS was loaded from a
+// legacy image without a header.
+func (f *SeekerFS) GetImageHeader() *ImageHeader {
+	if f.header == nil {
+		return nil
+	}
+	toReturn := *f.header
+	return &toReturn
+}
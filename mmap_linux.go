@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+package seeker_fs
+
+// This file contains code for loading a SeekerFS from a memory-mapped file.
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// Satisfies the io.ReaderAt and byteSlicer interfaces for the contents of a
+// memory-mapped file.
+type mappedData struct {
+	mapping []byte
+	// Set when the file is unmapped, after which reads return fs.ErrClosed.
+	closed bool
+}
+
+func (m *mappedData) ReadAt(data []byte, offset int64) (int, error) {
+	if m.closed {
+		return 0, fs.ErrClosed
+	}
+	if (offset < 0) || (offset >= int64(len(m.mapping))) {
+		return 0, io.EOF
+	}
+	n := copy(data, m.mapping[offset:])
+	if n < len(data) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *mappedData) slice(offset, size uint64) ([]byte, error) {
+	if m.closed {
+		return nil, fs.ErrClosed
+	}
+	e := checkDataRange(offset, size, uint64(len(m.mapping)))
+	if e != nil {
+		return nil, e
+	}
+	return m.mapping[offset : offset+size], nil
+}
+
+// A SeekerFS that reads directly from a memory-mapped image file. Satisfies
+// the io.Closer interface; Close() must be called to unmap the file when the
+// FS is no longer needed.
+type MappedSeekerFS struct {
+	*SeekerFS
+	data *mappedData
+}
+
+// Unmaps the underlying file. Afterwards, reading from the MappedSeekerFS, any
+// FS returned by Sub(), or any file opened from them returns an error wrapping
+// fs.ErrClosed. This must not be called while other goroutines are using the
+// FS, and slices returned by the FS must not be used after this is called.
+func (m *MappedSeekerFS) Close() error {
+	if m.data.closed {
+		return nil
+	}
+	m.data.closed = true
+	e := syscall.Munmap(m.data.mapping)
+	m.data.mapping = nil
+	if e != nil {
+		return fmt.Errorf("Failed unmapping image: %w", e)
+	}
+	return nil
+}
+
+// Memory-maps the SeekerFS image at the given path, and loads the FS from the
+// mapped data. File headers, names, and content are read directly from the
+// mapped memory without any locking, so the returned FS is fast to use from
+// many goroutines at once. The file must not be modified or truncated while it
+// is mapped.
+func MapSeekerFS(path string, options ...LoadOption) (*MappedSeekerFS,
+	error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, fmt.Errorf("Failed opening %s: %w", path, e)
+	}
+	// The mapping remains valid after the file is closed.
+	defer f.Close()
+	info, e := f.Stat()
+	if e != nil {
+		return nil, fmt.Errorf("Failed getting info for %s: %w", path, e)
+	}
+	size := info.Size()
+	if (size <= 0) || (int64(int(size)) != size) {
+		return nil, fmt.Errorf("Can't map %s: invalid size %d", path, size)
+	}
+	mapping, e := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ,
+		syscall.MAP_SHARED)
+	if e != nil {
+		return nil, fmt.Errorf("Failed mapping %s: %w", path, e)
+	}
+	data := &mappedData{mapping: mapping}
+	sfs, e := LoadSeekerFSReaderAt(data, size, options...)
+	if e != nil {
+		syscall.Munmap(mapping)
+		return nil, e
+	}
+	return &MappedSeekerFS{
+		SeekerFS: sfs,
+		data:     data,
+	}, nil
+}
@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+package seeker_fs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMapSeekerFS(t *testing.T) {
+	data := NewSeekableBuffer()
+	e := CreateSeekerFS(os.DirFS("test_data/test_dir"), data, nil)
+	if e != nil {
+		t.Logf("Failed creating seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	imagePath := filepath.Join(t.TempDir(), "image.bin")
+	e = os.WriteFile(imagePath, getBufferBytes(t, data), 0644)
+	if e != nil {
+		t.Logf("Failed writing image file: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e := MapSeekerFS(imagePath)
+	if e != nil {
+		t.Logf("Failed mapping seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	e = fstest.TestFS(sfs, "test1.txt", "b/c/test2.txt", "b/c/hi.png")
+	if e != nil {
+		t.Logf("TestFS failed on mapped FS: %s\n", e)
+		t.Fail()
+	}
+	e = sfs.Validate()
+	if e != nil {
+		t.Logf("Validating mapped FS failed: %s\n", e)
+		t.Fail()
+	}
+	sub, e := sfs.Sub("b")
+	if e != nil {
+		t.Logf("Failed getting sub FS: %s\n", e)
+		t.FailNow()
+	}
+	f, e := sfs.Open("test1.txt")
+	if e != nil {
+		t.Logf("Failed opening test1.txt: %s\n", e)
+		t.FailNow()
+	}
+	defer f.Close()
+	e = sfs.Close()
+	if e != nil {
+		t.Logf("Failed closing mapped FS: %s\n", e)
+		t.FailNow()
+	}
+
+	// Using the FS after closing it should return errors rather than crash.
+	_, e = sfs.ReadFile("b/c/test2.txt")
+	if !errors.Is(e, fs.ErrClosed) {
+		t.Logf("Didn't get expected error reading closed FS. Got %v "+
+			"instead.\n", e)
+		t.FailNow()
+	}
+	_, e = fs.ReadFile(sub, "c/test2.txt")
+	if !errors.Is(e, fs.ErrClosed) {
+		t.Logf("Didn't get expected error reading closed sub FS. Got %v "+
+			"instead.\n", e)
+		t.FailNow()
+	}
+	_, e = f.Read(make([]byte, 4))
+	if !errors.Is(e, fs.ErrClosed) {
+		t.Logf("Didn't get expected error reading file from closed FS. Got "+
+			"%v instead.\n", e)
+		t.FailNow()
+	}
+	e = sfs.Close()
+	if e != nil {
+		t.Logf("Failed closing mapped FS twice: %s\n", e)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,138 @@
+package seeker_fs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Checks that the file at the given path in the FS has the expected ownership
+// and timestamps. The access and change times must be missing if accessTime
+// is the zero time.
+func checkOwnership(t *testing.T, f fs.FS, path string, modTime,
+	accessTime time.Time) {
+	info, e := fs.Stat(f, path)
+	if e != nil {
+		t.Logf("Failed getting info for %s: %s\n", path, e)
+		t.FailNow()
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Logf("%s has incorrect mod time: %s, expected %s\n", path,
+			info.ModTime(), modTime)
+		t.FailNow()
+	}
+	sysInfo := info.Sys().(*FileSys)
+	if !sysInfo.HasOwner {
+		t.Logf("%s doesn't have an owner\n", path)
+		t.FailNow()
+	}
+	if (sysInfo.UID != uint32(os.Getuid())) ||
+		(sysInfo.GID != uint32(os.Getgid())) {
+		t.Logf("%s has incorrect owner %d:%d, expected %d:%d\n", path,
+			sysInfo.UID, sysInfo.GID, os.Getuid(), os.Getgid())
+		t.FailNow()
+	}
+	t.Logf("%s is owned by %s:%s\n", path, sysInfo.UserName,
+		sysInfo.GroupName)
+	if !sysInfo.AccessTime.Equal(accessTime) {
+		t.Logf("%s has incorrect access time: %s, expected %s\n", path,
+			sysInfo.AccessTime, accessTime)
+		t.FailNow()
+	}
+	if accessTime.IsZero() {
+		if !sysInfo.ChangeTime.IsZero() {
+			t.Logf("%s has an unexpected change time\n", path)
+			t.FailNow()
+		}
+		return
+	}
+	if sysInfo.ChangeTime.IsZero() {
+		t.Logf("%s doesn't have a change time\n", path)
+		t.FailNow()
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "dir/file.txt")
+	e := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if e != nil {
+		t.Logf("Failed creating test directory: %s\n", e)
+		t.FailNow()
+	}
+	e = os.WriteFile(filePath, []byte("Owned content"), 0644)
+	if e != nil {
+		t.Logf("Failed creating test file: %s\n", e)
+		t.FailNow()
+	}
+	modTime := time.Unix(1600000000, 123456789)
+	accessTime := time.Unix(1700000000, 987654321)
+	e = os.Chtimes(filePath, accessTime, modTime)
+	if e != nil {
+		t.Logf("Failed setting test file times: %s\n", e)
+		t.FailNow()
+	}
+
+	settings := &CreateFSSettings{
+		StoreAccessTimes: true,
+	}
+	data := NewSeekableBuffer()
+	e = CreateSeekerFS(NewDirFS(dir), data, settings)
+	if e != nil {
+		t.Logf("Failed creating FS: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading FS: %s\n", e)
+		t.FailNow()
+	}
+	e = sfs.Validate()
+	if e != nil {
+		t.Logf("Validating FS with ownership failed: %s\n", e)
+		t.FailNow()
+	}
+	checkOwnership(t, sfs, "dir/file.txt", modTime, accessTime)
+	info, e := fs.Stat(sfs, "dir")
+	if e != nil {
+		t.Logf("Failed getting directory info: %s\n", e)
+		t.FailNow()
+	}
+	if !info.Sys().(*FileSys).HasOwner {
+		t.Logf("Directory doesn't have an owner\n")
+		t.FailNow()
+	}
+
+	// Make sure the metadata is kept when copying one SeekerFS to another.
+	data = NewSeekableBuffer()
+	e = CreateSeekerFS(sfs, data, settings)
+	if e != nil {
+		t.Logf("Failed copying FS: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e = LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading copied FS: %s\n", e)
+		t.FailNow()
+	}
+	checkOwnership(t, sfs, "dir/file.txt", modTime, accessTime)
+
+	// Access and change times shouldn't be stored by default, either from
+	// the host or when copying a SeekerFS.
+	for _, input := range []fs.FS{NewDirFS(dir), sfs} {
+		data = NewSeekableBuffer()
+		e = CreateSeekerFS(input, data, nil)
+		if e != nil {
+			t.Logf("Failed creating FS without access times: %s\n", e)
+			t.FailNow()
+		}
+		copied, e := LoadSeekerFS(data)
+		if e != nil {
+			t.Logf("Failed loading FS without access times: %s\n", e)
+			t.FailNow()
+		}
+		checkOwnership(t, copied, "dir/file.txt", modTime, time.Time{})
+	}
+}
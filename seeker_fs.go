@@ -1,13 +1,16 @@
 // The seeker_fs library implements go1.16's fs interface in a flat binary
 // format. Create a new SeekerFS by passing an existing fs.FS to
 // CreateSeekerFS, and open an existing packed FS by passing an io.ReadSeeker
-// to LoadSeekerFS.
+// to LoadSeekerFS, or an io.ReaderAt to LoadSeekerFSReaderAt.
 package seeker_fs
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"encoding/binary"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"io/fs"
 	"strings"
@@ -18,28 +21,26 @@ import (
 // Inteneded to satisfy Go's io/fs.FS interface, and be writable to a flat
 // contiguous buffer in memory.
 type SeekerFS struct {
-	// The underlying data stream containing our FS. Offset 0 *must* be a File
-	// instance, containing a directory definition.
-	data io.ReadSeeker
+	// The underlying data stream containing our FS. Offset 0 *must* be either
+	// an ImageHeader or, for legacy images, a File instance containing a
+	// directory definition. Must be safe for concurrent use; Sub() returns a
+	// new SeekerFS sharing the same data stream.
+	data io.ReaderAt
+	// The size of the FS's data, in bytes. For images with a header, this is
+	// the image's TotalSize, which may be smaller than the data stream.
+	dataSize uint64
+	// The image's header. Will be nil for legacy images without a header.
+	header *ImageHeader
+	// The image's hash tree. Will be nil if the image doesn't have one. If
+	// non-nil, data will read through the tree, verifying everything it reads.
+	tree *hashTree
 	// The "root" file of this FS. Useful when implementing the Sub() function.
 	topFile *File
-	// A mutex preventing concurrent access to the underlying stream; without
-	// this, one reader may seek while another reader is trying to read. Must
-	// be a pointer so that Sub() can return a new SeekerFS that shares a lock
-	// for the underlying ReadSeeker.
-	lock *sync.Mutex
-}
-
-// Walks the entire FS, checking for detectable errors with the format.
-func (f *SeekerFS) Validate() error {
-	// TODO: Implement f.Validate
-	//
-	// - Call Validate() on every file.
-	// - Check that every file's data is present in the data stream (use
-	//   Seek(0, io.SeekEnd) to get the size of the data stream).
-	// - Ensure that directory entries are all present and in alphabetical
-	//   order.
-	return fmt.Errorf("Validate not yet implemented")
+	// The offset of topFile's header in the data stream.
+	topOffset uint64
+	// Caches directory entries and names. Will be nil unless the FS was
+	// loaded with the WithCache option. Shared by every Sub() view of the FS.
+	cache *entryCache
 }
 
 // Holds the size of our *File struct, used for calculating byte offsets into
@@ -48,9 +49,9 @@ var fileStructSize uint64
 
 func init() {
 	tmp := binary.Size(File{})
-	// We know the struct must be at least 8 bytes, so anything 8 or under must
-	// be an error.
-	if tmp <= 8 {
+	// File.decode() relies on the struct being exactly 64 bytes, so anything
+	// else must be an error.
+	if tmp != 64 {
 		msg := fmt.Sprintf("Internal error: couldn't determine size of File "+
 			"struct. Got incorrect result: %d bytes.", tmp)
 		panic(msg)
@@ -58,66 +59,186 @@ func init() {
 	fileStructSize = uint64(tmp)
 }
 
-// Convenience function to lock the FS's mutex.
-func (f *SeekerFS) acquireLock() {
-	f.lock.Lock()
+// Wraps an io.ReadSeeker to satisfy the io.ReaderAt interface, so that
+// LoadSeekerFS can share the rest of its implementation with
+// LoadSeekerFSReaderAt.
+type readSeekerAt struct {
+	data io.ReadSeeker
+	// A mutex preventing concurrent access to the underlying stream; without
+	// this, one reader may seek while another reader is trying to read.
+	lock sync.Mutex
 }
 
-// Unlocks the FS's mutex.
-func (f *SeekerFS) releaseLock() {
-	f.lock.Unlock()
+func (r *readSeekerAt) ReadAt(data []byte, offset int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, e := r.data.Seek(offset, io.SeekStart)
+	if e != nil {
+		return 0, e
+	}
+	return io.ReadFull(r.data, data)
 }
 
-// Seeks to the given absolute location in the data stream. Returns an error if
-// one occurs. Assumes that f.lock is held.
-func (f *SeekerFS) seek(location uint64) error {
-	_, e := f.data.Seek(int64(location), io.SeekStart)
-	return e
+// Reads exactly len(data) bytes from r into the data slice, starting at the
+// given location. Returns an error if fewer bytes were read.
+func readFullAt(r io.ReaderAt, data []byte, location uint64) error {
+	n, e := r.ReadAt(data, int64(location))
+	// The io.ReaderAt interface allows returning io.EOF along with a full read
+	// if the read ended at the end of the data.
+	if (n == len(data)) && ((e == nil) || (e == io.EOF)) {
+		return nil
+	}
+	if e == nil {
+		e = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("Failed reading %d bytes at %d: %w", len(data),
+		location, e)
 }
 
 // Tries to read len(data) bytes into the data slice, starting at the given
-// absolute location. Returns an error if one occurs. Assumes f.lock is held,
-// and may change the current offset in f.data.
+// absolute location. Returns an error if one occurs. Safe to call from
+// multiple goroutines.
 func (f *SeekerFS) readAtOffset(data []byte, location uint64) error {
-	e := f.seek(location)
+	return readFullAt(f.data, data, location)
+}
+
+// Implemented by data streams that can provide direct access to their
+// contents, such as memory-mapped files, so that we can avoid copying data.
+type byteSlicer interface {
+	// Returns a slice referring to size bytes of the underlying data, starting
+	// at the given offset. The returned slice must not be modified.
+	slice(offset, size uint64) ([]byte, error)
+}
+
+// Returns size bytes starting at the given absolute location. The returned
+// slice may refer directly to the underlying data, so it must not be modified.
+func (f *SeekerFS) getBytes(location, size uint64) ([]byte, error) {
+	// Check this first, so a corrupt size can't cause a huge allocation.
+	e := checkDataRange(location, size, f.dataSize)
 	if e != nil {
-		return fmt.Errorf("Failed seeking to offset %d: %s", location, e)
+		return nil, e
+	}
+	slicer, ok := f.data.(byteSlicer)
+	if ok {
+		return slicer.slice(location, size)
 	}
-	_, e = io.ReadFull(f.data, data)
+	toReturn := make([]byte, size)
+	e = f.readAtOffset(toReturn, location)
 	if e != nil {
-		return fmt.Errorf("Failed reading %d bytes at %d: %s", len(data),
-			location, e)
+		return nil, e
+	}
+	return toReturn, nil
+}
+
+// Reads len(files) consecutive File structs, starting at the given absolute
+// location.
+func (f *SeekerFS) readFilesAtOffset(files []File, location uint64) error {
+	raw, e := f.getBytes(location, uint64(len(files))*fileStructSize)
+	if e != nil {
+		return e
+	}
+	for i := range files {
+		files[i].decode(raw[uint64(i)*fileStructSize:])
 	}
 	return nil
 }
 
+// Holds optional settings used when loading a SeekerFS.
+type loadSettings struct {
+	// If non-nil, the image must have a hash tree with this root hash.
+	rootHash []byte
+	// If non-nil, the image must have a valid signature using this key.
+	publicKey ed25519.PublicKey
+	// The image's detached signature. Only used if publicKey is set.
+	signature []byte
+	// The maximum size of the FS's cache, in bytes. The cache is disabled if
+	// this is 0.
+	cacheSize uint64
+}
+
+// An optional setting that can be passed to LoadSeekerFS and similar
+// functions.
+type LoadOption func(s *loadSettings)
+
+// Requires the image to have a hash tree (see AddHashTree) with the given
+// root hash. The image's content will be verified against the tree as it's
+// read, so this ensures that the image hasn't been modified.
+func WithRootHash(rootHash []byte) LoadOption {
+	return func(s *loadSettings) {
+		s.rootHash = append([]byte{}, rootHash...)
+	}
+}
+
 // Returns a new SeekerFS based on the given underlying data stream. Returns an
 // error if one occurs. Note that some errors (i.e. with an incorrectly
 // formatted data stream) may not appear until files are read or opened. Must
-// have a File struct at the start of the data stream (at offset 0).
-func LoadSeekerFS(data io.ReadSeeker) (*SeekerFS, error) {
-	var topFile File
-	_, e := data.Seek(0, io.SeekStart)
+// have an ImageHeader at the start of the data stream (at offset 0), or, for
+// legacy images, the root directory's File struct. Accesses
+// to the data stream are serialized, so consider using LoadSeekerFSReaderAt
+// instead if the FS will be used by many goroutines at once.
+func LoadSeekerFS(data io.ReadSeeker, options ...LoadOption) (*SeekerFS,
+	error) {
+	size, e := data.Seek(0, io.SeekEnd)
+	if e != nil {
+		return nil, fmt.Errorf("Failed seeking to data end: %w", e)
+	}
+	return LoadSeekerFSReaderAt(&readSeekerAt{data: data}, size, options...)
+}
+
+// Like LoadSeekerFS, but reads the FS using the io.ReaderAt interface, which
+// allows files to be read concurrently without any locking. The size argument
+// must be the total size of the data, in bytes. The ReaderAt must be safe to
+// call from multiple goroutines at once, as required by its documentation.
+func LoadSeekerFSReaderAt(data io.ReaderAt, size int64,
+	options ...LoadOption) (*SeekerFS, error) {
+	var settings loadSettings
+	for _, option := range options {
+		option(&settings)
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("Invalid data size: %d", size)
+	}
+	toReturn := &SeekerFS{
+		data:      data,
+		dataSize:  uint64(size),
+		topOffset: 0,
+	}
+	header, e := toReturn.readImageHeader()
 	if e != nil {
-		return nil, fmt.Errorf("Failed seeking to data start: %w", e)
+		return nil, e
+	}
+	if header != nil {
+		toReturn.header = header
+		toReturn.dataSize = header.TotalSize
+		toReturn.topOffset = header.RootOffset
 	}
-	e = binary.Read(data, binary.LittleEndian, &topFile)
+	e = toReturn.setupHashTree(uint64(size), settings.rootHash)
 	if e != nil {
-		return nil, fmt.Errorf("Couldn't read an initial file entry at the "+
-			"data start: %s", e)
+		return nil, e
 	}
-	e = (&topFile).Validate()
+	e = toReturn.checkSignature(&settings)
 	if e != nil {
-		return nil, fmt.Errorf("Invalid file entry at the data start: %s", e)
+		return nil, e
 	}
-	if !(&topFile).IsDir() {
+	topFiles := make([]File, 1)
+	e = toReturn.readFilesAtOffset(topFiles, toReturn.topOffset)
+	if e != nil {
+		return nil, fmt.Errorf("Couldn't read the root directory's file "+
+			"entry: %s", e)
+	}
+	topFile := &(topFiles[0])
+	e = topFile.Validate()
+	if e != nil {
+		return nil, fmt.Errorf("Invalid root directory file entry: %s", e)
+	}
+	if !topFile.IsDir() {
 		return nil, fmt.Errorf("The top file entry wasn't a directory")
 	}
-	return &SeekerFS{
-		data:    data,
-		topFile: &topFile,
-		lock:    &sync.Mutex{},
-	}, nil
+	toReturn.topFile = topFile
+	if settings.cacheSize != 0 {
+		toReturn.cache = newEntryCache(settings.cacheSize)
+	}
+	return toReturn, nil
 }
 
 // Holds a SeekerFS-format file or directory. All offsets are absolute (from
@@ -125,7 +246,8 @@ func LoadSeekerFS(data io.ReadSeeker) (*SeekerFS, error) {
 type File struct {
 	// Must be the eight bytes "1337FILE"
 	Magic [8]byte
-	// The fs.FileMode bits, stored in a uint32
+	// The fs.FileMode bits, stored in the lower 32 bits. The upper 32 bits
+	// contain flags, such as FileFlagHasExtra.
 	Mode uint64
 	// The first 8 bytes of the file's name. If NameSize is less than 8, then
 	// the remaining bytes will be filled with 0.
@@ -148,6 +270,20 @@ type File struct {
 	ModTime uint64
 }
 
+// Sets the File's fields from their little-endian binary representation, as
+// written by binary.Write. The raw slice must contain at least fileStructSize
+// bytes. This avoids the overhead of using reflection in binary.Read.
+func (f *File) decode(raw []byte) {
+	copy(f.Magic[:], raw[0:8])
+	f.Mode = binary.LittleEndian.Uint64(raw[8:16])
+	copy(f.ShortName[:], raw[16:24])
+	f.NameOffset = binary.LittleEndian.Uint64(raw[24:32])
+	f.NameSize = binary.LittleEndian.Uint64(raw[32:40])
+	f.DataOffset = binary.LittleEndian.Uint64(raw[40:48])
+	f.Size = binary.LittleEndian.Uint64(raw[48:56])
+	f.ModTime = binary.LittleEndian.Uint64(raw[56:64])
+}
+
 // Returns true if and only if the File is a directory.
 func (f *File) IsDir() bool {
 	return fs.FileMode(f.Mode).IsDir()
@@ -187,9 +323,24 @@ type SeekerFSFile struct {
 	p *SeekerFS
 	// The metadata for the file itself.
 	f *File
+	// The offset of f's header in the data stream.
+	offset uint64
+	// The path that was used to open the file.
+	path string
+	// The file's extra metadata. Will be nil for directories.
+	extra *fileExtra
+	// Used to read the file's content if it's compressed. Will be nil
+	// otherwise.
+	decompressor *decompressor
 	// The current read offset into this file, or index of the next directory
 	// entry to return by ReadDir (however, ReadDir can't seek backwards).
 	readOffset uint64
+	// Computes the checksum of the file's content as it's read. Will be nil if
+	// the file doesn't have a checksum, or once the checksum has been checked.
+	checksum hash.Hash32
+	// The number of bytes at the start of the file that have been included in
+	// the checksum so far.
+	checksumOffset uint64
 }
 
 // Satisfies the fs.FileInfo interface for a SeekerFSFile, as well as the
@@ -199,6 +350,33 @@ type SeekerFSFileInfo struct {
 	FileSize    uint64
 	FileMode    fs.FileMode
 	FileModTime uint64
+	// The sub-second part of the modification time, in nanoseconds.
+	FileModTimeNsec uint32
+	// Additional metadata, returned by Sys().
+	SysInfo FileSys
+}
+
+// Holds metadata about a file in a SeekerFS that isn't available through the
+// fs.FileInfo interface. SeekerFSFileInfo.Sys() returns a *FileSys.
+type FileSys struct {
+	// Uniquely identifies the file within the image. Directory entries that
+	// are hard links to the same file have the same ID. IDs don't depend on
+	// the path used to access a file, so a file will have the same ID in any
+	// Sub() view of the FS.
+	ID uint64
+	// True if the UID and GID fields are valid.
+	HasOwner bool
+	// The numeric IDs of the user and group that own the file.
+	UID uint32
+	GID uint32
+	// The names of the user and group that own the file. Empty if they
+	// weren't recorded when the FS was created.
+	UserName  string
+	GroupName string
+	// The file's last access and status change times. Will be the zero
+	// time.Time if they weren't recorded when the FS was created.
+	AccessTime time.Time
+	ChangeTime time.Time
 }
 
 func (n *SeekerFSFileInfo) Name() string {
@@ -214,7 +392,7 @@ func (n *SeekerFSFileInfo) Mode() fs.FileMode {
 }
 
 func (n *SeekerFSFileInfo) ModTime() time.Time {
-	return time.Unix(int64(n.FileModTime), 0)
+	return time.Unix(int64(n.FileModTime), int64(n.FileModTimeNsec))
 }
 
 func (n *SeekerFSFileInfo) IsDir() bool {
@@ -232,8 +410,59 @@ func (n *SeekerFSFileInfo) Type() fs.FileMode {
 	return n.FileMode.Type()
 }
 
+// Returns a *FileSys.
 func (n *SeekerFSFileInfo) Sys() interface{} {
-	return nil
+	sysInfo := n.SysInfo
+	return &sysInfo
+}
+
+// Satisfies the fs.DirEntry interface for an entry read from a directory.
+// Only the entry's File struct and name are read up front; the rest of its
+// metadata is read from its extra record when Info() is called. This keeps
+// listing a directory from needing additional reads for every entry.
+type seekerFSDirEntry struct {
+	name string
+	f    File
+	// The offset of the entry's File struct in the data stream.
+	offset uint64
+	p      *SeekerFS
+}
+
+// Returns a directory entry for f, whose File struct is at the given offset.
+func newDirEntry(f *File, offset uint64, p *SeekerFS) (*seekerFSDirEntry,
+	error) {
+	name, e := getFileName(f, p)
+	if e != nil {
+		return nil, fmt.Errorf("Failed reading file name: %s", e)
+	}
+	return &seekerFSDirEntry{
+		name:   name,
+		f:      *f,
+		offset: offset,
+		p:      p,
+	}, nil
+}
+
+func (d *seekerFSDirEntry) Name() string {
+	return d.name
+}
+
+func (d *seekerFSDirEntry) IsDir() bool {
+	return d.f.IsDir()
+}
+
+func (d *seekerFSDirEntry) Type() fs.FileMode {
+	return fs.FileMode(d.f.Mode).Type()
+}
+
+// Returns a *SeekerFSFileInfo. Returns an error if the entry's extra metadata
+// record can't be read.
+func (d *seekerFSDirEntry) Info() (fs.FileInfo, error) {
+	info, e := getNamedFileInfo(&d.f, d.offset, d.p, d.name)
+	if e != nil {
+		return nil, e
+	}
+	return info, nil
 }
 
 // Takes a lower-level file struct and a reference to the SeekerFS containing
@@ -244,11 +473,11 @@ func getFileName(f *File, p *SeekerFS) (string, error) {
 	if length <= 8 {
 		return string(f.ShortName[0:length]), nil
 	}
+	if p.cache != nil {
+		return p.cache.getFileName(f, p)
+	}
 	// Otherwise we need to read the name from the SeekerFS' data stream.
-	name := make([]byte, length)
-	p.acquireLock()
-	e := p.readAtOffset(name, f.NameOffset)
-	p.releaseLock()
+	name, e := p.getBytes(f.NameOffset, length)
 	if e != nil {
 		return "", e
 	}
@@ -256,22 +485,80 @@ func getFileName(f *File, p *SeekerFS) (string, error) {
 }
 
 // Returns a SeekerFSFileInfo struct, which satisfies both fs.FileInfo and
-// fs.DirEntry interfaces. Returns an error if one occurs.
-func getFileInfo(f *File, p *SeekerFS) (*SeekerFSFileInfo, error) {
+// fs.DirEntry interfaces. Requires the offset of f's header in the data
+// stream. Returns an error if one occurs.
+func getFileInfo(f *File, offset uint64, p *SeekerFS) (*SeekerFSFileInfo,
+	error) {
 	name, e := getFileName(f, p)
 	if e != nil {
 		return nil, fmt.Errorf("Failed reading file name: %s", e)
 	}
-	return &SeekerFSFileInfo{
-		FileName:    name,
-		FileSize:    f.Size,
-		FileMode:    fs.FileMode(f.Mode),
-		FileModTime: f.ModTime,
-	}, nil
+	return getNamedFileInfo(f, offset, p, name)
+}
+
+// Like getFileInfo, but uses the given name rather than reading f's name.
+func getNamedFileInfo(f *File, offset uint64, p *SeekerFS,
+	name string) (*SeekerFSFileInfo, error) {
+	extra, e := getFileExtra(f, p)
+	if e != nil {
+		return nil, fmt.Errorf("Failed reading extra metadata: %w", e)
+	}
+	return newFileInfo(f, offset, name, extra), nil
+}
+
+// Returns the info for the file with the given name and extra metadata record,
+// whose File struct is at the given offset.
+func newFileInfo(f *File, offset uint64, name string,
+	extra *fileExtra) *SeekerFSFileInfo {
+	toReturn := &SeekerFSFileInfo{
+		FileName:        name,
+		FileSize:        f.Size,
+		FileMode:        fs.FileMode(f.Mode),
+		FileModTime:     f.ModTime,
+		FileModTimeNsec: extra.modTimeNsec,
+		SysInfo: FileSys{
+			ID:        extra.getFileID(offset),
+			HasOwner:  extra.hasOwner,
+			UID:       extra.owner.UID,
+			GID:       extra.owner.GID,
+			UserName:  extra.userName,
+			GroupName: extra.groupName,
+		},
+	}
+	if extra.hasAccessTime {
+		toReturn.SysInfo.AccessTime = time.Unix(0, extra.accessTime)
+	}
+	if extra.hasChangeTime {
+		toReturn.SysInfo.ChangeTime = time.Unix(0, extra.changeTime)
+	}
+	return toReturn
+}
+
+// Returns the name that a file stat'ed or opened using the given valid path
+// should report: the path's last component, even if it was a symbolic link to
+// a file with a different name. Returns an empty string for ".", in which case
+// the directory keeps its stored name.
+func requestedFileName(path string) string {
+	if path == "." {
+		return ""
+	}
+	return path[strings.LastIndexByte(path, '/')+1:]
+}
+
+// Like getFileInfo, but for a file that was resolved using the given path,
+// following symbolic links. The returned info is named after the path's last
+// component, as it would be by os.Stat.
+func getResolvedFileInfo(f *File, offset uint64, p *SeekerFS,
+	path string) (*SeekerFSFileInfo, error) {
+	name := requestedFileName(path)
+	if name == "" {
+		return getFileInfo(f, offset, p)
+	}
+	return getNamedFileInfo(f, offset, p, name)
 }
 
 func (f *SeekerFSFile) Stat() (fs.FileInfo, error) {
-	return getFileInfo(f.f, f.p)
+	return getResolvedFileInfo(f.f, f.offset, f.p, f.path)
 }
 
 // Returns true if f is a directory.
@@ -282,6 +569,12 @@ func (f *SeekerFSFile) IsDir() bool {
 func (f *SeekerFSFile) Close() error {
 	f.p = nil
 	f.f = nil
+	f.extra = nil
+	f.checksum = nil
+	if f.decompressor != nil {
+		f.decompressor.close()
+		f.decompressor = nil
+	}
 	f.readOffset = 0
 	return nil
 }
@@ -329,16 +622,56 @@ func (f *SeekerFSFile) Read(data []byte) (int, error) {
 	}
 
 	// Actually read the data.
-	e := f.p.readAtOffset(data[0:bytesToRead], f.f.DataOffset+f.readOffset)
+	var e error
+	if f.decompressor != nil {
+		e = f.decompressor.readAt(data[0:bytesToRead], f.readOffset)
+	} else {
+		e = f.p.readAtOffset(data[0:bytesToRead],
+			f.f.DataOffset+f.readOffset)
+	}
 	if e != nil {
 		// We shouldn't just pass on an EOF error here, as it would be an error
 		// for the underlying ReadSeeker rather than an error with our FS.
-		return 0, fmt.Errorf("Failed obtaining file data: %s", e)
+		return 0, fmt.Errorf("Failed obtaining file data: %w", e)
 	}
 	f.readOffset += bytesToRead
+	e = f.updateChecksum(data[0:bytesToRead], f.readOffset-bytesToRead)
+	if e != nil {
+		return int(bytesToRead), e
+	}
 	return int(bytesToRead), nil
 }
 
+// Updates the file's checksum with a chunk of content that was read starting
+// at the given offset. Only content read contiguously from the start of the
+// file is included; the checksum is checked once the last byte has been read.
+// Returns a *ChecksumError if the content was corrupt.
+func (f *SeekerFSFile) updateChecksum(chunk []byte, offset uint64) error {
+	if f.checksum == nil {
+		return nil
+	}
+	end := offset + uint64(len(chunk))
+	if (offset > f.checksumOffset) || (end <= f.checksumOffset) {
+		// The chunk doesn't extend the data we've already checksummed.
+		return nil
+	}
+	f.checksum.Write(chunk[f.checksumOffset-offset:])
+	f.checksumOffset = end
+	if f.checksumOffset < f.f.Size {
+		return nil
+	}
+	actual := f.checksum.Sum32()
+	f.checksum = nil
+	if actual != f.extra.checksum {
+		return &ChecksumError{
+			Path:     f.path,
+			Expected: f.extra.checksum,
+			Actual:   actual,
+		}
+	}
+	return nil
+}
+
 // Used to support the ReadDirFile interface. Returns a list of up to n
 // directory entries if this file is a directory, otherwise returns an error.
 // Returns all directory entries if n <= 0.
@@ -364,40 +697,66 @@ func (f *SeekerFSFile) ReadDir(n int) ([]fs.DirEntry, error) {
 	if endEntry > f.f.Size {
 		endEntry = f.f.Size
 	}
-	rawEntries := make([]File, endEntry-startEntry)
-	startOffset := f.f.DataOffset + startEntry*fileStructSize
+	toReturn, e := readDirEntries(f.f, f.p, startEntry, endEntry)
+	if e != nil {
+		return nil, e
+	}
+	f.readOffset = endEntry
+	return toReturn, nil
+}
 
-	// Finally, read the data. We'll need to take the lock here so that other
-	// readers won't seek to a different location while we do the read.
-	f.p.acquireLock()
-	e := f.p.seek(startOffset)
+// Reads the File structs for the entries of directory f with indices from
+// start up to, but not including, end, using a single read. Doesn't check
+// that f is a directory or that the indices are valid.
+func readDirFiles(f *File, p *SeekerFS, start, end uint64) ([]File, error) {
+	startOffset := f.DataOffset + start*fileStructSize
+	// Check this first, so a corrupt entry count can't cause a huge
+	// allocation.
+	e := checkDataRange(startOffset, (end-start)*fileStructSize, p.dataSize)
 	if e != nil {
-		f.p.releaseLock()
-		return nil, fmt.Errorf("Failed seeking to dir entry in data stream: "+
-			"%s", e)
+		return nil, fmt.Errorf("Failed reading dir entries in data stream: %s",
+			e)
 	}
-	e = binary.Read(f.p.data, binary.LittleEndian, rawEntries)
-	f.p.releaseLock()
+	toReturn := make([]File, end-start)
+	e = p.readFilesAtOffset(toReturn, startOffset)
 	if e != nil {
 		return nil, fmt.Errorf("Failed reading dir entries in data stream: %s",
 			e)
 	}
+	return toReturn, nil
+}
 
-	// Finally, convert each File struct to a SeekerFSFileInfo struct, which
-	// satisfies the DirEntry interface.
+// Returns the entries of directory f with indices from start up to, but not
+// including, end. Doesn't check that f is a directory or that the indices are
+// valid.
+func readDirEntries(f *File, p *SeekerFS, start, end uint64) ([]fs.DirEntry,
+	error) {
+	rawEntries, e := readDirFiles(f, p, start, end)
+	if e != nil {
+		return nil, e
+	}
+
+	// Convert each File struct to a directory entry, which only needs to
+	// read the file's name.
+	startOffset := f.DataOffset + start*fileStructSize
 	toReturn := make([]fs.DirEntry, len(rawEntries))
 	for i := range rawEntries {
-		toReturn[i], e = getFileInfo(&(rawEntries[i]), f.p)
+		offset := startOffset + uint64(i)*fileStructSize
+		toReturn[i], e = newDirEntry(&(rawEntries[i]), offset, p)
 		if e != nil {
-			return nil, fmt.Errorf("Failed getting info for file %d/%d: %s",
+			return nil, fmt.Errorf("Failed getting entry for file %d/%d: %s",
 				i+1, len(rawEntries), e)
 		}
 	}
-
-	f.readOffset = endEntry
 	return toReturn, nil
 }
 
+// Returns the offset of the File header for the entry at index n in directory
+// f. Doesn't check that n is a valid index.
+func getDirEntryOffset(f *File, n int) uint64 {
+	return f.DataOffset + uint64(n)*fileStructSize
+}
+
 // Returns the low-level File struct corresponding to the entry at index n in
 // directory f. Returns an error if f isn't a directory, if n isn't a valid
 // index, or if any other error occurs.
@@ -414,20 +773,20 @@ func getDirEntry(f *File, p *SeekerFS, n int) (*File, error) {
 	}
 
 	// Done sanity checking, now read the struct.
-	offset := f.DataOffset + uint64(n)*fileStructSize
-	p.acquireLock()
-	e := p.seek(offset)
-	if e != nil {
-		p.releaseLock()
-		return nil, fmt.Errorf("Couldn't seek to entry %d of %s: %s", n, f, e)
+	if p.cache != nil {
+		toReturn, e := p.cache.getDirEntry(f, p, n)
+		if e != nil {
+			return nil, fmt.Errorf("Error reading entry %d of %s: %w", n, f, e)
+		}
+		return toReturn, nil
 	}
-	toReturn := File{}
-	e = binary.Read(p.data, binary.LittleEndian, &toReturn)
-	p.releaseLock()
+	offset := getDirEntryOffset(f, n)
+	toReturn := make([]File, 1)
+	e := p.readFilesAtOffset(toReturn, offset)
 	if e != nil {
-		return nil, fmt.Errorf("Error reading entry %d of %s: %s", n, f, e)
+		return nil, fmt.Errorf("Error reading entry %d of %s: %w", n, f, e)
 	}
-	return &toReturn, nil
+	return &(toReturn[0]), nil
 }
 
 // Returns 0 if f's name equals toCheck. Uses string.Compare(a, b), where a is
@@ -466,17 +825,18 @@ func compareFileName(f *File, p *SeekerFS, toCheck string) (int, error) {
 	return strings.Compare(longName, toCheck), nil
 }
 
-// Returns the low-level File struct with the given name in directory f.
-// Returns an error if f isn't a directory, or ErrNotExist if f doesn't contain
-// a file with the given name. Note that the name is only a base name, and not
-// a full path.
-func getNamedDirEntry(f *File, p *SeekerFS, name string) (*File, error) {
+// Returns the low-level File struct with the given name in directory f, along
+// with the offset of its header in the data stream. Returns an error if f
+// isn't a directory, or ErrNotExist if f doesn't contain a file with the given
+// name. Note that the name is only a base name, and not a full path.
+func getNamedDirEntry(f *File, p *SeekerFS, name string) (*File, uint64,
+	error) {
 	if !f.IsDir() {
-		return nil, fmt.Errorf("File %s isn't a directory", f)
+		return nil, 0, fmt.Errorf("File %s isn't a directory", f)
 	}
 	if f.Size == 0 {
 		// The directory is empty.
-		return nil, fs.ErrNotExist
+		return nil, 0, fs.ErrNotExist
 	}
 
 	// Do a binary search on the directory entries. NOTE: we already require
@@ -492,17 +852,17 @@ func getNamedDirEntry(f *File, p *SeekerFS, name string) (*File, error) {
 		currentIndex = (beginIndex + endIndex) >> 1
 		currentEntry, e = getDirEntry(f, p, currentIndex)
 		if e != nil {
-			return nil, fmt.Errorf("Error reading entry at index %d: %w",
+			return nil, 0, fmt.Errorf("Error reading entry at index %d: %w",
 				currentIndex, e)
 		}
 		compareResult, e = compareFileName(currentEntry, p, name)
 		if e != nil {
-			return nil, fmt.Errorf("Error comparing %s's name to %s: %w",
+			return nil, 0, fmt.Errorf("Error comparing %s's name to %s: %w",
 				currentEntry, name, e)
 		}
 		if compareResult == 0 {
 			// The names are equal
-			return currentEntry, nil
+			return currentEntry, getDirEntryOffset(f, currentIndex), nil
 		}
 		if compareResult > 0 {
 			// currentEntry's name is less than name
@@ -512,20 +872,32 @@ func getNamedDirEntry(f *File, p *SeekerFS, name string) (*File, error) {
 			beginIndex = currentIndex + 1
 		}
 	}
-	return nil, fs.ErrNotExist
+	return nil, 0, fs.ErrNotExist
 }
 
-// Resolves a file path in FS p, rooted at the given topDir. Returns a
-// fs.PathError for most invalid errors.
-func resolveFilePath(topDir *File, p *SeekerFS, path string) (*File, error) {
-	var e error
+// Used to track the directories traversed while resolving a path, so that ".."
+// components in symbolic link targets can be resolved.
+type resolvedDir struct {
+	f      *File
+	offset uint64
+}
+
+// Resolves a file path in FS p, rooted at the given topDir, whose header is at
+// topOffset. Returns the resolved File and the offset of its header. Returns a
+// fs.PathError for most invalid errors. Symbolic links in the path's directory
+// components are always followed, and a link in the final component is only
+// followed if followLast is true. Absolute link targets are resolved relative
+// to topDir, and ".." components never go above topDir, as if topDir were the
+// root of a chroot.
+func resolveFilePath(topDir *File, topOffset uint64, p *SeekerFS,
+	path string, followLast bool) (*File, uint64, error) {
 	if !fs.ValidPath(path) {
-		return nil, fs.ErrInvalid
+		return nil, 0, fs.ErrInvalid
 	}
 	// "." is a shortcut for the root dir. No other path components are allowed
 	// to be named "." (ValidPath checks for this).
 	if path == "." {
-		return topDir, nil
+		return topDir, topOffset, nil
 	}
 	// The FS interface requires "/" to be the path separator. ValidPath also
 	// validates the path doesn't start or end with "/", or contain an empty
@@ -533,46 +905,215 @@ func resolveFilePath(topDir *File, p *SeekerFS, path string) (*File, error) {
 	components := strings.Split(path, "/")
 
 	// Resolve each path component in turn. getNamedDirEntry will ensure that
-	// every element before the last is a directory.
-	currentFile := topDir
-	for _, name := range components {
-		currentFile, e = getNamedDirEntry(currentFile, p, name)
+	// every element before the last is a directory. Link targets are spliced
+	// into the list of components as they're encountered.
+	dirs := []resolvedDir{{f: topDir, offset: topOffset}}
+	linksFollowed := 0
+	for len(components) != 0 {
+		name := components[0]
+		components = components[1:]
+		current := dirs[len(dirs)-1]
+		// Empty, "." and ".." components can only come from link targets.
+		if (name == "") || (name == ".") || (name == "..") {
+			if !current.f.IsDir() {
+				return nil, 0, fmt.Errorf("Failed resolving %s in path %s: "+
+					"%s isn't a directory", name, path, current.f)
+			}
+			if (name == "..") && (len(dirs) > 1) {
+				dirs = dirs[0 : len(dirs)-1]
+			}
+			continue
+		}
+		f, offset, e := getNamedDirEntry(current.f, p, name)
+		if e != nil {
+			return nil, 0, fmt.Errorf("Failed resolving %s in path %s: %w",
+				name, path, e)
+		}
+		if !f.IsSymlink() || ((len(components) == 0) && !followLast) {
+			dirs = append(dirs, resolvedDir{f: f, offset: offset})
+			continue
+		}
+		linksFollowed++
+		if linksFollowed > maxSymlinkFollows {
+			return nil, 0, fmt.Errorf("Too many levels of symbolic links in "+
+				"path %s", path)
+		}
+		target, e := readLinkTarget(f, p)
 		if e != nil {
-			return nil, fmt.Errorf("Failed resolving %s in path %s: %w", name,
-				path, e)
+			return nil, 0, fmt.Errorf("Failed resolving %s in path %s: %w",
+				name, path, e)
 		}
+		if strings.HasPrefix(target, "/") {
+			dirs = dirs[0:1]
+		}
+		components = append(strings.Split(target, "/"), components...)
 	}
-	return currentFile, nil
+	last := dirs[len(dirs)-1]
+	return last.f, last.offset, nil
 }
 
 // The primary function required to satisfy the fs.FS interface.
 func (p *SeekerFS) Open(path string) (fs.File, error) {
-	f, e := resolveFilePath(p.topFile, p, path)
+	f, offset, e := resolveFilePath(p.topFile, p.topOffset, p, path, true)
+	if e != nil {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: e}
+	}
+	toReturn, e := p.openFile(f, offset, path, nil)
 	if e != nil {
-		return nil, &fs.PathError{"open", path, e}
+		return nil, e
 	}
-	return &SeekerFSFile{
+	return toReturn, nil
+}
+
+// Opens the file f, whose File struct is at the given offset, and which was
+// found using the given path. The extra metadata record is read from the data
+// stream if extra is nil.
+func (p *SeekerFS) openFile(f *File, offset uint64, path string,
+	extra *fileExtra) (*SeekerFSFile, error) {
+	toReturn := &SeekerFSFile{
 		p:          p,
 		f:          f,
+		offset:     offset,
+		path:       path,
 		readOffset: 0,
-	}, nil
+	}
+	if f.IsDir() {
+		return toReturn, nil
+	}
+	if extra == nil {
+		var e error
+		extra, e = getFileExtra(f, p)
+		if e != nil {
+			return nil, &fs.PathError{Op: "open", Path: path, Err: e}
+		}
+	}
+	toReturn.extra = extra
+	if toReturn.extra.hasChecksum {
+		toReturn.checksum = crc32.New(crc32cTable)
+	}
+	if toReturn.extra.isCompressed() {
+		toReturn.decompressor = newDecompressor(p, f, toReturn.extra)
+	}
+	return toReturn, nil
+}
+
+// Reads all of the given file's content into an exactly-sized buffer.
+// For uncompressed files, this only requires a single read from the data
+// stream. Checks the content's checksum, if it has one.
+func readFileContent(f *File, p *SeekerFS, extra *fileExtra,
+	path string) ([]byte, error) {
+	if f.IsDir() {
+		return nil, fmt.Errorf("File is a directory")
+	}
+	// Check these first, so a corrupt size can't cause a huge allocation.
+	e := checkDataRange(f.DataOffset, extra.storedSize(f), p.dataSize)
+	if e != nil {
+		return nil, e
+	}
+	if extra.isCompressed() {
+		e = extra.compression.checkSize(f.Size)
+		if e != nil {
+			return nil, e
+		}
+	}
+	if uint64(int(f.Size)) != f.Size {
+		return nil, fmt.Errorf("File is too large to read: %d bytes", f.Size)
+	}
+	toReturn := make([]byte, f.Size)
+	if extra.isCompressed() {
+		e = newDecompressor(p, f, extra).readAt(toReturn, 0)
+	} else {
+		e = p.readAtOffset(toReturn, f.DataOffset)
+	}
+	if e != nil {
+		return nil, fmt.Errorf("Failed obtaining file data: %w", e)
+	}
+	if !extra.hasChecksum {
+		return toReturn, nil
+	}
+	actual := crc32.Checksum(toReturn, crc32cTable)
+	if actual != extra.checksum {
+		return nil, &ChecksumError{
+			Path:     path,
+			Expected: extra.checksum,
+			Actual:   actual,
+		}
+	}
+	return toReturn, nil
+}
+
+// Implements the fs.ReadFileFS interface. This is faster than opening the file
+// and reading it in chunks, since the path only needs to be resolved once and
+// uncompressed content is read all at once.
+func (p *SeekerFS) ReadFile(name string) ([]byte, error) {
+	f, _, e := resolveFilePath(p.topFile, p.topOffset, p, name, true)
+	if e != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: e}
+	}
+	extra, e := getFileExtra(f, p)
+	if e != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: e}
+	}
+	content, e := readFileContent(f, p, extra, name)
+	if e != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: e}
+	}
+	return content, nil
+}
+
+// Implements the fs.StatFS interface, returning the same information as
+// opening the file and calling its Stat() method, without the overhead of
+// opening it. Follows symbolic links.
+func (p *SeekerFS) Stat(name string) (fs.FileInfo, error) {
+	f, offset, e := resolveFilePath(p.topFile, p.topOffset, p, name, true)
+	if e != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: e}
+	}
+	info, e := getResolvedFileInfo(f, offset, p, name)
+	if e != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: e}
+	}
+	return info, nil
+}
+
+// Implements the fs.ReadDirFS interface. Directory entries are always stored
+// sorted by name, so they don't need to be sorted here. Every entry's File
+// struct is read from the data stream at once.
+func (p *SeekerFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, _, e := resolveFilePath(p.topFile, p.topOffset, p, name, true)
+	if e != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: e}
+	}
+	if !f.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name,
+			Err: fmt.Errorf("Not a directory")}
+	}
+	entries, e := readDirEntries(f, p, 0, f.Size)
+	if e != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: e}
+	}
+	return entries, nil
 }
 
 // Implement the fs.SubFS interface, since we can implement it fairly
 // efficiently.
 func (p *SeekerFS) Sub(path string) (fs.FS, error) {
-	f, e := resolveFilePath(p.topFile, p, path)
+	f, offset, e := resolveFilePath(p.topFile, p.topOffset, p, path, true)
 	if e != nil {
-		return nil, &fs.PathError{"sub", path, e}
+		return nil, &fs.PathError{Op: "sub", Path: path, Err: e}
 	}
 	if !f.IsDir() {
 		return nil, fmt.Errorf("File %s is not a directory", path)
 	}
-	// The FS shares the underlying data stream (and therefore must also share
-	// the mutex), but simply has a different top-level file.
+	// The FS shares the underlying data stream, but simply has a different
+	// top-level file.
 	return &SeekerFS{
-		data:    p.data,
-		topFile: f,
-		lock:    p.lock,
+		data:      p.data,
+		dataSize:  p.dataSize,
+		header:    p.header,
+		tree:      p.tree,
+		topFile:   f,
+		topOffset: offset,
+		cache:     p.cache,
 	}, nil
 }
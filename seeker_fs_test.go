@@ -1,16 +1,36 @@
 package seeker_fs
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/yalue/byte_utils"
 	"io"
+	"io/fs"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/fstest"
 	"time"
 )
 
-func NewSeekableBuffer() *byte_utils.SeekableBuffer {
-	return byte_utils.NewSeekableBuffer()
+// Wraps byte_utils.SeekableBuffer, which doesn't advance its offset after a
+// Write, so that it behaves like a file.
+type seekableBuffer struct {
+	*byte_utils.SeekableBuffer
+}
+
+func (b *seekableBuffer) Write(data []byte) (int, error) {
+	n, e := b.SeekableBuffer.Write(data)
+	b.Offset += int64(n)
+	return n, e
+}
+
+func NewSeekableBuffer() *seekableBuffer {
+	return &seekableBuffer{byte_utils.NewSeekableBuffer()}
 }
 
 // Used to log status messages as an io.Writer, using t.Logf
@@ -180,3 +200,618 @@ func TestCreationLimits(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+// Overwrites the data at the given offset in the buffer with newData.
+func corruptBuffer(t *testing.T, data io.WriteSeeker, offset int64,
+	newData []byte) {
+	_, e := data.Seek(offset, io.SeekStart)
+	if e != nil {
+		t.Logf("Failed seeking to offset %d: %s\n", offset, e)
+		t.FailNow()
+	}
+	_, e = data.Write(newData)
+	if e != nil {
+		t.Logf("Failed overwriting data at offset %d: %s\n", offset, e)
+		t.FailNow()
+	}
+}
+
+func TestValidate(t *testing.T) {
+	data := NewSeekableBuffer()
+	e := CreateSeekerFS(os.DirFS("test_data/test_dir"), data, nil)
+	if e != nil {
+		t.Logf("Failed creating seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	e = sfs.Validate()
+	if e != nil {
+		t.Logf("Validation of a correct FS failed: %s\n", e)
+		t.FailNow()
+	}
+
+	// Corrupt the magic of the root directory's first entry.
+	firstEntry := int64(sfs.topFile.DataOffset)
+	corruptBuffer(t, data, firstEntry, []byte("BAD!"))
+	e = sfs.Validate()
+	if e == nil {
+		t.Logf("Didn't get expected error when validating a corrupt FS.\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error when validating a corrupt FS: %s\n", e)
+
+	// Restore the magic, and instead make the first two entries' names out of
+	// order.
+	corruptBuffer(t, data, firstEntry, []byte("1337FILE"))
+	e = sfs.Validate()
+	if e != nil {
+		t.Logf("Validation failed after restoring the magic: %s\n", e)
+		t.FailNow()
+	}
+	corruptBuffer(t, data, firstEntry+16, []byte("zzz"))
+	e = sfs.Validate()
+	if e == nil {
+		t.Logf("Didn't get expected error when validating unsorted entries.\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error when validating unsorted entries: %s\n", e)
+}
+
+func TestValidationReport(t *testing.T) {
+	data := NewSeekableBuffer()
+	e := CreateSeekerFS(os.DirFS("test_data/test_dir"), data, nil)
+	if e != nil {
+		t.Logf("Failed creating seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	report := sfs.GetValidationReport()
+	if len(report.Problems) != 0 {
+		t.Logf("Got unexpected problems with a correct FS: %v\n",
+			report.Problems)
+		t.FailNow()
+	}
+	// The root dir, a, b, b/c, test1.txt, test2.txt, and the three files in
+	// b/c.
+	if report.EntriesChecked != 9 {
+		t.Logf("Expected to check 9 entries, got %d\n", report.EntriesChecked)
+		t.FailNow()
+	}
+
+	// Corrupt the first entry in the root directory, and make sure the rest of
+	// the FS is still checked.
+	firstEntry := sfs.topFile.DataOffset
+	corruptBuffer(t, data, int64(firstEntry), []byte("BAD!"))
+	report = sfs.GetValidationReport()
+	if len(report.Problems) != 1 {
+		t.Logf("Expected 1 problem, got %d: %v\n", len(report.Problems),
+			report.Problems)
+		t.FailNow()
+	}
+	problem := report.Problems[0]
+	t.Logf("Got expected problem: %s\n", problem)
+	if problem.Kind != ProblemBadHeader {
+		t.Logf("Expected a bad header, got %s\n", problem.Kind)
+		t.Fail()
+	}
+	if problem.HeaderOffset != firstEntry {
+		t.Logf("Expected the problem at offset %d, got %d\n", firstEntry,
+			problem.HeaderOffset)
+		t.Fail()
+	}
+	if (report.EntriesChecked != 9) || (report.GoodEntries != 8) {
+		t.Logf("Expected 8/9 good entries, got %d/%d\n", report.GoodEntries,
+			report.EntriesChecked)
+		t.Fail()
+	}
+}
+
+// Returns the entire contents of the given buffer as a byte slice.
+func getBufferBytes(t *testing.T, data io.ReadSeeker) []byte {
+	_, e := data.Seek(0, io.SeekStart)
+	if e != nil {
+		t.Logf("Failed seeking to start of buffer: %s\n", e)
+		t.FailNow()
+	}
+	toReturn, e := io.ReadAll(data)
+	if e != nil {
+		t.Logf("Failed reading buffer contents: %s\n", e)
+		t.FailNow()
+	}
+	return toReturn
+}
+
+func TestLoadReaderAt(t *testing.T) {
+	data := NewSeekableBuffer()
+	e := CreateSeekerFS(os.DirFS("test_data/test_dir"), data, nil)
+	if e != nil {
+		t.Logf("Failed creating seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	raw := getBufferBytes(t, data)
+	sfs, e := LoadSeekerFSReaderAt(bytes.NewReader(raw), int64(len(raw)))
+	if e != nil {
+		t.Logf("Failed loading seeker FS from a ReaderAt: %s\n", e)
+		t.FailNow()
+	}
+	e = fstest.TestFS(sfs, "test1.txt", "b/c/test2.txt", "b/c/hi.png")
+	if e != nil {
+		t.Logf("TestFS failed: %s\n", e)
+		t.FailNow()
+	}
+
+	// Read the same files from many goroutines at once; this should be run
+	// with -race to be meaningful.
+	expected, e := os.ReadFile("test_data/test_dir/b/c/hi.png")
+	if e != nil {
+		t.Logf("Failed reading original file: %s\n", e)
+		t.FailNow()
+	}
+	var wg sync.WaitGroup
+	errors := make([]error, 16)
+	for i := range errors {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			content, e := fs.ReadFile(sfs, "b/c/hi.png")
+			if e != nil {
+				errors[index] = e
+				return
+			}
+			if !bytes.Equal(content, expected) {
+				errors[index] = fmt.Errorf("Got incorrect file content")
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, e := range errors {
+		if e != nil {
+			t.Logf("Reader %d failed: %s\n", i, e)
+			t.Fail()
+		}
+	}
+}
+
+// Returns a minimal image in the original format, without an ImageHeader,
+// containing a single file named "hi" containing "Hello!".
+func getLegacyImage(t *testing.T) []byte {
+	var root, file File
+	copy(root.Magic[:], []byte("1337FILE"))
+	root.Mode = uint64(fs.ModeDir | 0755)
+	root.DataOffset = fileStructSize
+	root.Size = 1
+	copy(file.Magic[:], []byte("1337FILE"))
+	file.Mode = 0644
+	copy(file.ShortName[:], []byte("hi"))
+	file.NameSize = 2
+	file.DataOffset = 2 * fileStructSize
+	file.Size = 6
+	var buffer bytes.Buffer
+	e := binary.Write(&buffer, binary.LittleEndian, []File{root, file})
+	if e != nil {
+		t.Logf("Failed writing legacy image: %s\n", e)
+		t.FailNow()
+	}
+	buffer.WriteString("Hello!")
+	return buffer.Bytes()
+}
+
+func TestImageHeader(t *testing.T) {
+	data := NewSeekableBuffer()
+	creationTime := time.Unix(1337, 0)
+	settings := CreateFSSettings{
+		CreationTime: creationTime,
+	}
+	e := CreateSeekerFS(os.DirFS("test_data/test_dir"), data, &settings)
+	if e != nil {
+		t.Logf("Failed creating seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	raw := getBufferBytes(t, data)
+	sfs, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	header := sfs.GetImageHeader()
+	if header == nil {
+		t.Logf("Didn't get an image header for a new image.\n")
+		t.FailNow()
+	}
+	if header.Version != CurrentImageVersion {
+		t.Logf("Expected image version %d, got %d\n", CurrentImageVersion,
+			header.Version)
+		t.Fail()
+	}
+	if header.TotalSize != uint64(len(raw)) {
+		t.Logf("Expected total size %d, got %d\n", len(raw), header.TotalSize)
+		t.Fail()
+	}
+	if header.CreationTime != uint64(creationTime.Unix()) {
+		t.Logf("Got incorrect creation time: %d\n", header.CreationTime)
+		t.Fail()
+	}
+
+	// Make sure we refuse to load truncated images.
+	truncated := raw[0 : len(raw)-1]
+	_, e = LoadSeekerFSReaderAt(bytes.NewReader(truncated),
+		int64(len(truncated)))
+	if e == nil {
+		t.Logf("Didn't get expected error when loading a truncated image.\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error when loading a truncated image: %s\n", e)
+
+	// Make sure we can still load images without a header.
+	legacy := getLegacyImage(t)
+	sfs, e = LoadSeekerFSReaderAt(bytes.NewReader(legacy), int64(len(legacy)))
+	if e != nil {
+		t.Logf("Failed loading legacy image: %s\n", e)
+		t.FailNow()
+	}
+	if sfs.GetImageHeader() != nil {
+		t.Logf("Got an unexpected header for a legacy image.\n")
+		t.Fail()
+	}
+	e = sfs.Validate()
+	if e != nil {
+		t.Logf("Validating legacy image failed: %s\n", e)
+		t.Fail()
+	}
+	e = fstest.TestFS(sfs, "hi")
+	if e != nil {
+		t.Logf("TestFS failed on legacy image: %s\n", e)
+		t.Fail()
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dirFS := os.DirFS("test_data/test_dir")
+	codecs := []CompressionCodec{CompressionNone, CompressionDeflate}
+	for _, codec := range codecs {
+		data := NewSeekableBuffer()
+		settings := CreateFSSettings{
+			Compression: codec,
+		}
+		e := CreateSeekerFS(dirFS, data, &settings)
+		if e != nil {
+			t.Logf("Failed creating seeker FS using %s: %s\n", codec, e)
+			t.FailNow()
+		}
+		sfs, e := LoadSeekerFS(data)
+		if e != nil {
+			t.Logf("Failed loading seeker FS using %s: %s\n", codec, e)
+			t.FailNow()
+		}
+		paths := []string{"test1.txt", "b/c/test2.txt", "b/c/hi.png"}
+		for _, path := range paths {
+			expected, e := fs.ReadFile(dirFS, path)
+			if e != nil {
+				t.Logf("Failed reading original %s: %s\n", path, e)
+				t.FailNow()
+			}
+			content, e := sfs.ReadFile(path)
+			if e != nil {
+				t.Logf("Failed reading %s using %s: %s\n", path, codec, e)
+				t.FailNow()
+			}
+			if !bytes.Equal(content, expected) {
+				t.Logf("Got incorrect content of %s using %s\n", path, codec)
+				t.FailNow()
+			}
+			if len(content) != cap(content) {
+				t.Logf("Buffer for %s wasn't exactly sized: len %d, cap %d\n",
+					path, len(content), cap(content))
+				t.FailNow()
+			}
+		}
+		for _, path := range []string{"b/c", "b/c/test4.txt", "../a"} {
+			_, e = sfs.ReadFile(path)
+			if e == nil {
+				t.Logf("Didn't get expected error reading %s\n", path)
+				t.FailNow()
+			}
+			t.Logf("Got expected error reading %s: %s\n", path, e)
+		}
+	}
+}
+
+// Returns an error if the two FileInfo's don't contain the same information.
+func compareFileInfo(a, b fs.FileInfo) error {
+	if a.Name() != b.Name() {
+		return fmt.Errorf("Names differ: %s vs %s", a.Name(), b.Name())
+	}
+	if a.Size() != b.Size() {
+		return fmt.Errorf("Sizes differ: %d vs %d", a.Size(), b.Size())
+	}
+	if a.Mode() != b.Mode() {
+		return fmt.Errorf("Modes differ: %s vs %s", a.Mode(), b.Mode())
+	}
+	if !a.ModTime().Equal(b.ModTime()) {
+		return fmt.Errorf("Mod times differ: %s vs %s", a.ModTime(),
+			b.ModTime())
+	}
+	if *(a.Sys().(*FileSys)) != *(b.Sys().(*FileSys)) {
+		return fmt.Errorf("Sys info differs: %+v vs %+v", a.Sys(), b.Sys())
+	}
+	return nil
+}
+
+func TestStatAndReadDir(t *testing.T) {
+	data := NewSeekableBuffer()
+	e := CreateSeekerFS(os.DirFS("test_data/test_dir"), data, nil)
+	if e != nil {
+		t.Logf("Failed creating seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	for _, path := range []string{".", "b", "b/c", "b/c/hi.png", "a"} {
+		f, e := sfs.Open(path)
+		if e != nil {
+			t.Logf("Failed opening %s: %s\n", path, e)
+			t.FailNow()
+		}
+		expected, e := f.Stat()
+		if e != nil {
+			t.Logf("Failed getting info for open file %s: %s\n", path, e)
+			t.FailNow()
+		}
+		var expectedEntries []fs.DirEntry
+		if expected.IsDir() {
+			expectedEntries, e = f.(fs.ReadDirFile).ReadDir(-1)
+			if e != nil {
+				t.Logf("Failed reading open dir %s: %s\n", path, e)
+				t.FailNow()
+			}
+		}
+		f.Close()
+		info, e := sfs.Stat(path)
+		if e != nil {
+			t.Logf("Stat failed for %s: %s\n", path, e)
+			t.FailNow()
+		}
+		e = compareFileInfo(info, expected)
+		if e != nil {
+			t.Logf("Stat returned incorrect info for %s: %s\n", path, e)
+			t.FailNow()
+		}
+		entries, e := sfs.ReadDir(path)
+		if !expected.IsDir() {
+			if e == nil {
+				t.Logf("Didn't get expected error reading a regular file as "+
+					"a dir: %s\n", path)
+				t.FailNow()
+			}
+			t.Logf("Got expected error reading a regular file as a dir: %s\n",
+				e)
+			continue
+		}
+		if e != nil {
+			t.Logf("ReadDir failed for %s: %s\n", path, e)
+			t.FailNow()
+		}
+		if len(entries) != len(expectedEntries) {
+			t.Logf("ReadDir returned %d entries for %s, expected %d\n",
+				len(entries), path, len(expectedEntries))
+			t.FailNow()
+		}
+		for i := range entries {
+			a, _ := entries[i].Info()
+			b, _ := expectedEntries[i].Info()
+			e = compareFileInfo(a, b)
+			if e != nil {
+				t.Logf("ReadDir returned incorrect entry %d for %s: %s\n", i,
+					path, e)
+				t.FailNow()
+			}
+		}
+	}
+	_, e = sfs.Stat("b/c/test4.txt")
+	if !errors.Is(e, fs.ErrNotExist) {
+		t.Logf("Didn't get expected error for Stat on a missing file. Got %v "+
+			"instead.\n", e)
+		t.FailNow()
+	}
+	_, e = sfs.ReadDir("b/d")
+	if !errors.Is(e, fs.ErrNotExist) {
+		t.Logf("Didn't get expected error for ReadDir on a missing dir. Got "+
+			"%v instead.\n", e)
+		t.FailNow()
+	}
+}
+
+func TestReadDirReads(t *testing.T) {
+	raw, names := createCacheTestImage(t)
+	counter := &countingReaderAt{r: bytes.NewReader(raw)}
+	sfs, e := LoadSeekerFSReaderAt(counter, int64(len(raw)))
+	if e != nil {
+		t.Logf("Failed loading seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	atomic.StoreInt64(&counter.reads, 0)
+	entries, e := sfs.ReadDir("dir")
+	if e != nil {
+		t.Logf("ReadDir failed: %s\n", e)
+		t.FailNow()
+	}
+	// Each entry's long name needs to be read, but its extra metadata
+	// shouldn't be until Info() is called.
+	reads := atomic.LoadInt64(&counter.reads)
+	t.Logf("Read %d entries using %d reads\n", len(entries), reads)
+	if reads > int64(len(names)+2) {
+		t.Logf("ReadDir used too many reads: %d\n", reads)
+		t.FailNow()
+	}
+	for i, entry := range entries {
+		if ("dir/" + entry.Name()) != names[i] {
+			t.Logf("Got incorrect name for entry %d: %s\n", i, entry.Name())
+			t.FailNow()
+		}
+		info, e := entry.Info()
+		if e != nil {
+			t.Logf("Failed getting info for %s: %s\n", entry.Name(), e)
+			t.FailNow()
+		}
+		// Each file's content is its path.
+		size := int64(len(names[i]))
+		if (info.Name() != entry.Name()) || (info.Size() != size) {
+			t.Logf("Got incorrect info for %s: %s, %d bytes\n",
+				entry.Name(), info.Name(), info.Size())
+			t.FailNow()
+		}
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	data := NewSeekableBuffer()
+	e := CreateSeekerFS(os.DirFS("test_data/test_dir"), data, nil)
+	if e != nil {
+		t.Logf("Failed creating seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	if (sfs.GetImageHeader().Flags & ImageFlagChecksums) == 0 {
+		t.Logf("The image header doesn't indicate checksums are present.\n")
+		t.FailNow()
+	}
+	content, e := fs.ReadFile(sfs, "b/c/test1.txt")
+	if e != nil {
+		t.Logf("Failed reading uncorrupted file: %s\n", e)
+		t.FailNow()
+	}
+
+	// Flip a bit in the file's content, and make sure we detect it.
+	f, _, e := resolveFilePath(sfs.topFile, sfs.topOffset, sfs,
+		"b/c/test1.txt", true)
+	if e != nil {
+		t.Logf("Failed finding b/c/test1.txt: %s\n", e)
+		t.FailNow()
+	}
+	content[0] ^= 1
+	corruptBuffer(t, data, int64(f.DataOffset), content[0:1])
+	_, e = fs.ReadFile(sfs, "b/c/test1.txt")
+	var checksumError *ChecksumError
+	if !errors.As(e, &checksumError) {
+		t.Logf("Didn't get expected checksum error. Got %v instead.\n", e)
+		t.FailNow()
+	}
+	t.Logf("Got expected error when reading corrupt file: %s\n", e)
+	// Reading the file in chunks should also detect the corruption.
+	f2, e := sfs.Open("b/c/test1.txt")
+	if e != nil {
+		t.Logf("Failed opening corrupt file: %s\n", e)
+		t.FailNow()
+	}
+	_, e = io.ReadAll(f2)
+	f2.Close()
+	if !errors.As(e, &checksumError) {
+		t.Logf("Didn't get expected checksum error when reading corrupt "+
+			"file in chunks. Got %v instead.\n", e)
+		t.FailNow()
+	}
+
+	// Make sure we can disable checksums when creating an FS.
+	data = NewSeekableBuffer()
+	settings := CreateFSSettings{
+		DisableChecksums: true,
+	}
+	e = CreateSeekerFS(os.DirFS("test_data/test_dir"), data, &settings)
+	if e != nil {
+		t.Logf("Failed creating seeker FS without checksums: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e = LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading seeker FS without checksums: %s\n", e)
+		t.FailNow()
+	}
+	if sfs.GetImageHeader().Flags != 0 {
+		t.Logf("Got unexpected image flags: 0x%x\n",
+			sfs.GetImageHeader().Flags)
+		t.Fail()
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	content := strings.Repeat("Duplicated content. ", 1000)
+	baseFS := fstest.MapFS(make(map[string]*fstest.MapFile))
+	baseFS["a.txt"] = newMapFile(content)
+	baseFS["b.txt"] = newMapFile(content)
+	baseFS["dir/c.txt"] = newMapFile(content)
+	baseFS["dir/different.txt"] = newMapFile(content + "!")
+	baseFS["empty1.txt"] = newMapFile("")
+	baseFS["empty2.txt"] = newMapFile("")
+	getImage := func(settings *CreateFSSettings) *seekableBuffer {
+		settings.StatusLog = &testLogger{t}
+		data := NewSeekableBuffer()
+		e := CreateSeekerFS(baseFS, data, settings)
+		if e != nil {
+			t.Logf("Failed creating seeker FS: %s\n", e)
+			t.FailNow()
+		}
+		return data
+	}
+	plainSize := len(getBufferBytes(t, getImage(&CreateFSSettings{})))
+	for _, codec := range []CompressionCodec{CompressionNone,
+		CompressionDeflate} {
+		data := getImage(&CreateFSSettings{
+			Deduplicate: true,
+			Compression: codec,
+		})
+		dedupSize := len(getBufferBytes(t, data))
+		t.Logf("Image size with codec %s: %d bytes (%d without "+
+			"deduplication)\n", codec, dedupSize, plainSize)
+		if dedupSize >= plainSize-len(content) {
+			t.Logf("Deduplication didn't save enough space.\n")
+			t.FailNow()
+		}
+		sfs, e := LoadSeekerFS(data)
+		if e != nil {
+			t.Logf("Failed loading deduplicated FS: %s\n", e)
+			t.FailNow()
+		}
+		e = sfs.Validate()
+		if e != nil {
+			t.Logf("Validating deduplicated FS failed: %s\n", e)
+			t.FailNow()
+		}
+		e = fstest.TestFS(sfs, "a.txt", "b.txt", "dir/c.txt",
+			"dir/different.txt", "empty1.txt", "empty2.txt")
+		if e != nil {
+			t.Logf("TestFS failed on deduplicated FS: %s\n", e)
+			t.FailNow()
+		}
+		getDataOffset := func(path string) uint64 {
+			f, e := sfs.Open(path)
+			if e != nil {
+				t.Logf("Failed opening %s: %s\n", path, e)
+				t.FailNow()
+			}
+			defer f.Close()
+			return f.(*SeekerFSFile).f.DataOffset
+		}
+		aOffset := getDataOffset("a.txt")
+		cOffset := getDataOffset("dir/c.txt")
+		if aOffset != cOffset {
+			t.Logf("Duplicate files have different data offsets: %d vs %d\n",
+				aOffset, cOffset)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package seeker_fs
+
+// This file contains code for creating and checking detached signatures of
+// images.
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io"
+)
+
+// Prepended to the root hash to form the message that's signed, so that image
+// signatures can't be confused with signatures of other data.
+const signatureContext = "seeker_fs image signature v1\x00"
+
+// Returns the message that's signed for an image with the given root hash.
+func getSignedMessage(rootHash []byte) []byte {
+	return append([]byte(signatureContext), rootHash...)
+}
+
+// Returns a detached ed25519 signature of the given image, which must have a
+// hash tree (see AddHashTree). The signature covers the tree's root hash, and
+// therefore the entire image, including its header. Pass the signature to
+// WithSignature when loading the image to check it.
+func SignImage(image io.ReadSeeker, key ed25519.PrivateKey) ([]byte,
+	error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("Invalid private key size: %d", len(key))
+	}
+	sfs, e := LoadSeekerFS(image)
+	if e != nil {
+		return nil, fmt.Errorf("Failed loading image: %w", e)
+	}
+	rootHash := sfs.GetRootHash()
+	if rootHash == nil {
+		return nil, fmt.Errorf("The image must have a hash tree to be signed")
+	}
+	return ed25519.Sign(key, getSignedMessage(rootHash)), nil
+}
+
+// Requires the image to have a valid signature, created by SignImage using
+// the private key corresponding to the given public key. Since the signature
+// covers the image's hash tree, the image's content will also be verified
+// against the tree as it's read.
+func WithSignature(key ed25519.PublicKey, signature []byte) LoadOption {
+	return func(s *loadSettings) {
+		s.publicKey = append(ed25519.PublicKey{}, key...)
+		s.signature = append([]byte{}, signature...)
+	}
+}
+
+// Returns an error if the FS's signature, as specified in the settings, isn't
+// valid. Does nothing if the settings don't require a signature. Must be
+// called after the FS's hash tree has been loaded.
+func (f *SeekerFS) checkSignature(settings *loadSettings) error {
+	if settings.publicKey == nil {
+		return nil
+	}
+	if len(settings.publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("Invalid public key size: %d",
+			len(settings.publicKey))
+	}
+	if f.tree == nil {
+		return fmt.Errorf("A signature is required, but the image doesn't " +
+			"have a hash tree")
+	}
+	message := getSignedMessage(f.tree.rootHash())
+	if !ed25519.Verify(settings.publicKey, message, settings.signature) {
+		return fmt.Errorf("The image's signature isn't valid")
+	}
+	return nil
+}
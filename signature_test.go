@@ -0,0 +1,62 @@
+package seeker_fs
+
+import (
+	"crypto/ed25519"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSignature(t *testing.T) {
+	publicKey, privateKey, e := ed25519.GenerateKey(nil)
+	if e != nil {
+		t.Logf("Failed generating key: %s\n", e)
+		t.FailNow()
+	}
+	data := NewSeekableBuffer()
+	e = CreateSeekerFS(os.DirFS("test_data/test_dir"), data, nil)
+	if e != nil {
+		t.Logf("Failed creating seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	_, e = SignImage(data, privateKey)
+	if e == nil {
+		t.Logf("Didn't get expected error when signing an image without a " +
+			"hash tree.\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error when signing image without a tree: %s\n", e)
+	_, e = AddHashTree(data, 0)
+	if e != nil {
+		t.Logf("Failed adding hash tree: %s\n", e)
+		t.FailNow()
+	}
+	signature, e := SignImage(data, privateKey)
+	if e != nil {
+		t.Logf("Failed signing image: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e := LoadSeekerFS(data, WithSignature(publicKey, signature))
+	if e != nil {
+		t.Logf("Failed loading signed image: %s\n", e)
+		t.FailNow()
+	}
+	e = fstest.TestFS(sfs, "test1.txt", "b/c/test2.txt", "b/c/hi.png")
+	if e != nil {
+		t.Logf("TestFS failed on signed image: %s\n", e)
+		t.FailNow()
+	}
+
+	// Make sure a different key doesn't work.
+	otherKey, _, e := ed25519.GenerateKey(nil)
+	if e != nil {
+		t.Logf("Failed generating second key: %s\n", e)
+		t.FailNow()
+	}
+	_, e = LoadSeekerFS(data, WithSignature(otherKey, signature))
+	if e == nil {
+		t.Logf("Didn't get expected error when using the wrong key.\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error when using the wrong key: %s\n", e)
+}
@@ -0,0 +1,77 @@
+//go:build linux
+// +build linux
+
+package seeker_fs
+
+// This file contains Linux-specific code for getting information about files
+// in the FS passed to CreateSeekerFS, such as hard links and ownership.
+import (
+	"io/fs"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Returns the identity of the given file in the source FS, if the FS provides
+// it (e.g. os.DirFS) and the file has more than one hard link. Returns false
+// otherwise.
+func getSourceFileID(info fs.FileInfo) (sourceFileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || (stat.Nlink <= 1) {
+		return sourceFileID{}, false
+	}
+	return sourceFileID{
+		device: uint64(stat.Dev),
+		inode:  uint64(stat.Ino),
+	}, true
+}
+
+// Returns the name of the user with the given ID, or an empty string if it
+// can't be found.
+func (q *outputQueue) lookupUserName(uid uint32) string {
+	name, ok := q.userNames[uid]
+	if ok {
+		return name
+	}
+	u, e := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if e == nil {
+		name = u.Username
+	}
+	q.userNames[uid] = name
+	return name
+}
+
+// Returns the name of the group with the given ID, or an empty string if it
+// can't be found.
+func (q *outputQueue) lookupGroupName(gid uint32) string {
+	name, ok := q.groupNames[gid]
+	if ok {
+		return name
+	}
+	g, e := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10))
+	if e == nil {
+		name = g.Name
+	}
+	q.groupNames[gid] = name
+	return name
+}
+
+// Sets the ownership and timestamp fields in the extra metadata record from
+// the given info, if the source FS provides them (e.g. os.DirFS).
+func (q *outputQueue) setHostMetadata(info fs.FileInfo, extra *fileExtra) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	extra.hasOwner = true
+	extra.owner = fileOwner{
+		UID: stat.Uid,
+		GID: stat.Gid,
+	}
+	extra.userName = q.lookupUserName(stat.Uid)
+	extra.groupName = q.lookupGroupName(stat.Gid)
+	extra.hasAccessTime = true
+	extra.accessTime = stat.Atim.Nano()
+	extra.hasChangeTime = true
+	extra.changeTime = stat.Ctim.Nano()
+}
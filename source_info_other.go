@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package seeker_fs
+
+// This file contains stand-ins for the Linux-specific code for getting
+// information about files in the FS passed to CreateSeekerFS.
+import (
+	"io/fs"
+)
+
+// Hard links in the source FS are only detected on Linux, so this always
+// returns false.
+func getSourceFileID(info fs.FileInfo) (sourceFileID, bool) {
+	return sourceFileID{}, false
+}
+
+// Ownership and timestamps other than the modification time are only read
+// from the source FS on Linux, so this does nothing.
+func (q *outputQueue) setHostMetadata(info fs.FileInfo, extra *fileExtra) {
+}
@@ -0,0 +1,80 @@
+package seeker_fs
+
+// This file contains code related to symbolic links. A symbolic link is stored
+// like a regular file with fs.ModeSymlink set in its mode, where the file's
+// (uncompressed) content is the link's target.
+import (
+	"fmt"
+	"io/fs"
+)
+
+// Mirrors the fs.ReadLinkFS interface from newer versions of Go. If the FS
+// passed to CreateSeekerFS implements this, symbolic links will be stored as
+// links rather than as copies of their targets. SeekerFS also implements this.
+// (os.DirFS satisfies this interface in Go 1.25 and later; see NewDirFS for
+// older versions.)
+type ReadLinkFS interface {
+	fs.FS
+	// Returns the destination of the named symbolic link.
+	ReadLink(name string) (string, error)
+	// Returns information about the named file without following a symbolic
+	// link in the final path component.
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+// The maximum number of symbolic links that will be followed when resolving a
+// single path. This is the same limit that Linux uses.
+const maxSymlinkFollows = 40
+
+// Returns true if the File is a symbolic link.
+func (f *File) IsSymlink() bool {
+	return (fs.FileMode(f.Mode) & fs.ModeSymlink) != 0
+}
+
+// Returns the target of the given symbolic link. Returns an error if f isn't a
+// symbolic link.
+func readLinkTarget(f *File, p *SeekerFS) (string, error) {
+	if !f.IsSymlink() {
+		return "", fmt.Errorf("File %s isn't a symbolic link", f)
+	}
+	if f.Size == 0 {
+		return "", fmt.Errorf("Symbolic link %s has an empty target", f)
+	}
+	target, e := p.getBytes(f.DataOffset, f.Size)
+	if e != nil {
+		return "", fmt.Errorf("Failed reading target of link %s: %w", f, e)
+	}
+	return string(target), nil
+}
+
+// Returns the target of the named symbolic link. Like the fs.ReadLinkFS
+// interface, this only follows links in the path's directory components.
+func (p *SeekerFS) ReadLink(name string) (string, error) {
+	f, _, e := resolveFilePath(p.topFile, p.topOffset, p, name, false)
+	if e != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: e}
+	}
+	if !f.IsSymlink() {
+		return "", &fs.PathError{Op: "readlink", Path: name,
+			Err: fs.ErrInvalid}
+	}
+	target, e := readLinkTarget(f, p)
+	if e != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: e}
+	}
+	return target, nil
+}
+
+// Returns information about the named file. Unlike fs.Stat, this doesn't
+// follow a symbolic link in the final path component.
+func (p *SeekerFS) Lstat(name string) (fs.FileInfo, error) {
+	f, offset, e := resolveFilePath(p.topFile, p.topOffset, p, name, false)
+	if e != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: e}
+	}
+	info, e := getFileInfo(f, offset, p)
+	if e != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: e}
+	}
+	return info, nil
+}
@@ -0,0 +1,181 @@
+package seeker_fs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// Creates a directory tree containing several kinds of symbolic links, and
+// returns the path to its root.
+func createSymlinkTree(t *testing.T) string {
+	dir := t.TempDir()
+	check := func(e error) {
+		if e != nil {
+			t.Logf("Failed creating test directory tree: %s\n", e)
+			t.FailNow()
+		}
+	}
+	check(os.MkdirAll(filepath.Join(dir, "a/b"), 0755))
+	check(os.MkdirAll(filepath.Join(dir, "bad"), 0755))
+	check(os.WriteFile(filepath.Join(dir, "a/b/target.txt"),
+		[]byte("Link target content"), 0644))
+	check(os.Symlink("b/target.txt", filepath.Join(dir, "a/relative_link")))
+	check(os.Symlink("/a/b", filepath.Join(dir, "absolute_link")))
+	check(os.Symlink("../b", filepath.Join(dir, "a/b/parent_link")))
+	// These links can't be followed in some or all views of the FS.
+	check(os.Symlink("../../a/b/target.txt",
+		filepath.Join(dir, "bad/escape_link")))
+	check(os.Symlink("loop2", filepath.Join(dir, "bad/loop1")))
+	check(os.Symlink("loop1", filepath.Join(dir, "bad/loop2")))
+	check(os.Symlink("does_not_exist", filepath.Join(dir, "bad/dangling")))
+	return dir
+}
+
+func TestSymlinks(t *testing.T) {
+	data := NewSeekableBuffer()
+	e := CreateSeekerFS(NewDirFS(createSymlinkTree(t)), data,
+		&CreateFSSettings{
+			StatusLog: &testLogger{t},
+		})
+	if e != nil {
+		t.Logf("Failed creating FS with symlinks: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading FS with symlinks: %s\n", e)
+		t.FailNow()
+	}
+	e = sfs.Validate()
+	if e != nil {
+		t.Logf("Validating FS with symlinks failed: %s\n", e)
+		t.FailNow()
+	}
+
+	// Make sure each link resolves to the expected content.
+	expected := "Link target content"
+	paths := []string{"a/relative_link", "absolute_link/target.txt",
+		"a/b/parent_link/target.txt", "bad/escape_link",
+		"absolute_link/parent_link/parent_link/target.txt"}
+	for _, path := range paths {
+		content, e := fs.ReadFile(sfs, path)
+		if e != nil {
+			t.Logf("Failed reading %s: %s\n", path, e)
+			t.FailNow()
+		}
+		if string(content) != expected {
+			t.Logf("Got incorrect content for %s: %q\n", path, content)
+			t.FailNow()
+		}
+	}
+
+	// Check ReadLink and Lstat.
+	target, e := sfs.ReadLink("a/relative_link")
+	if e != nil {
+		t.Logf("ReadLink failed: %s\n", e)
+		t.FailNow()
+	}
+	if target != "b/target.txt" {
+		t.Logf("Got incorrect link target: %s\n", target)
+		t.FailNow()
+	}
+	_, e = sfs.ReadLink("a/b/target.txt")
+	if !errors.Is(e, fs.ErrInvalid) {
+		t.Logf("Didn't get expected error for ReadLink on a regular file. "+
+			"Got %v instead.\n", e)
+		t.FailNow()
+	}
+	info, e := sfs.Lstat("bad/dangling")
+	if e != nil {
+		t.Logf("Lstat failed for dangling link: %s\n", e)
+		t.FailNow()
+	}
+	if info.Mode().Type() != fs.ModeSymlink {
+		t.Logf("Lstat returned incorrect mode: %s\n", info.Mode())
+		t.FailNow()
+	}
+	// Unlike Lstat, Stat and ReadDir follow links.
+	info, e = sfs.Stat("a/relative_link")
+	if e != nil {
+		t.Logf("Stat failed for a link: %s\n", e)
+		t.FailNow()
+	}
+	if !info.Mode().IsRegular() || (info.Size() != int64(len(expected))) {
+		t.Logf("Stat didn't follow a link: mode %s, size %d\n", info.Mode(),
+			info.Size())
+		t.FailNow()
+	}
+	// As with os.Stat, the info should be named after the link, not its
+	// target.
+	if info.Name() != "relative_link" {
+		t.Logf("Stat of a link returned incorrect name: %s\n", info.Name())
+		t.FailNow()
+	}
+	f, e := sfs.Open("absolute_link")
+	if e != nil {
+		t.Logf("Failed opening a link: %s\n", e)
+		t.FailNow()
+	}
+	info, e = f.Stat()
+	f.Close()
+	if e != nil {
+		t.Logf("Failed getting info for an opened link: %s\n", e)
+		t.FailNow()
+	}
+	if !info.IsDir() || (info.Name() != "absolute_link") {
+		t.Logf("Opened link has incorrect info: name %s, mode %s\n",
+			info.Name(), info.Mode())
+		t.FailNow()
+	}
+	entries, e := sfs.ReadDir("absolute_link")
+	if e != nil {
+		t.Logf("ReadDir failed for a link: %s\n", e)
+		t.FailNow()
+	}
+	if (len(entries) != 2) || (entries[1].Name() != "target.txt") {
+		t.Logf("ReadDir returned incorrect entries for a link: %v\n", entries)
+		t.FailNow()
+	}
+	_, e = sfs.Open("bad/dangling")
+	if !errors.Is(e, fs.ErrNotExist) {
+		t.Logf("Didn't get expected error opening dangling link. Got %v "+
+			"instead.\n", e)
+		t.FailNow()
+	}
+	_, e = sfs.Open("bad/loop1")
+	if e == nil {
+		t.Logf("Didn't get expected error when opening a link loop.\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error when opening a link loop: %s\n", e)
+
+	// Links shouldn't be able to escape the top of a Sub view.
+	sub, e := sfs.Sub("bad")
+	if e != nil {
+		t.Logf("Failed getting sub FS: %s\n", e)
+		t.FailNow()
+	}
+	_, e = fs.ReadFile(sub, "escape_link")
+	if e == nil {
+		t.Logf("Didn't get expected error following a link above the top " +
+			"of a sub FS.\n")
+		t.FailNow()
+	}
+
+	sub, e = sfs.Sub("a")
+	if e != nil {
+		t.Logf("Failed getting sub FS: %s\n", e)
+		t.FailNow()
+	}
+	// Only list top-level files here, so that TestFS doesn't check a Sub view
+	// of "b", where parent_link can't be followed.
+	e = fstest.TestFS(sub, "relative_link", "b")
+	if e != nil {
+		t.Logf("TestFS failed on FS with symlinks: %s\n", e)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,372 @@
+package seeker_fs
+
+// This file contains code for checking that an existing SeekerFS is correctly
+// formatted.
+import (
+	"fmt"
+	"strings"
+)
+
+// Identifies the kind of problem found while validating a SeekerFS.
+type ProblemKind int
+
+const (
+	// A File header or name couldn't be read from the data stream.
+	ProblemReadError ProblemKind = iota
+	// A File header failed File.Validate(), e.g. due to an incorrect magic.
+	ProblemBadHeader
+	// A file's name extends past the end of the data stream.
+	ProblemBadNameLocation
+	// A file's name isn't allowed as a directory entry, e.g. contains a '/'.
+	ProblemBadName
+	// A file's data, or a directory's entries, extend past the end of the
+	// data stream.
+	ProblemBadDataLocation
+	// A directory entry's name sorts before the previous entry's name.
+	ProblemUnsortedEntry
+	// A directory entry has the same name as the previous entry.
+	ProblemDuplicateEntry
+	// A directory's entries were already referenced by a different directory.
+	ProblemDirectoryCycle
+	// The top-level file isn't a directory.
+	ProblemNotADirectory
+	// A file's extra metadata record couldn't be read or decoded.
+	ProblemBadExtra
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case ProblemReadError:
+		return "read error"
+	case ProblemBadHeader:
+		return "bad header"
+	case ProblemBadNameLocation:
+		return "bad name location"
+	case ProblemBadName:
+		return "bad name"
+	case ProblemBadDataLocation:
+		return "bad data location"
+	case ProblemUnsortedEntry:
+		return "unsorted entry"
+	case ProblemDuplicateEntry:
+		return "duplicate entry"
+	case ProblemDirectoryCycle:
+		return "directory cycle"
+	case ProblemNotADirectory:
+		return "not a directory"
+	case ProblemBadExtra:
+		return "bad extra metadata"
+	}
+	return fmt.Sprintf("unknown problem %d", int(k))
+}
+
+// Describes a single problem found while validating a SeekerFS. Satisfies the
+// error interface.
+type ValidationProblem struct {
+	// The path to the file with the problem. If the file's name couldn't be
+	// determined, the last component of the path will be "<entry N>", where N
+	// is the file's index in its parent directory.
+	Path string
+	// The offset of the problematic file's File header in the data stream.
+	HeaderOffset uint64
+	// The category of the problem.
+	Kind ProblemKind
+	// Contains more details about the problem.
+	Err error
+}
+
+func (p *ValidationProblem) Error() string {
+	return fmt.Sprintf("%s: %s (header at offset %d): %s", p.Kind, p.Path,
+		p.HeaderOffset, p.Err)
+}
+
+func (p *ValidationProblem) Unwrap() error {
+	return p.Err
+}
+
+// Holds the results of checking an entire SeekerFS.
+type ValidationReport struct {
+	// Every problem that was found, in the order it was encountered. Will be
+	// empty if the FS is valid.
+	Problems []*ValidationProblem
+	// The number of File headers that were checked, including the top-level
+	// directory. Files in directories with unusable headers can't be found,
+	// so they won't be counted.
+	EntriesChecked uint64
+	// The number of checked files and directories without any problems.
+	GoodEntries uint64
+	// The total size of the data in the regular files without any problems.
+	GoodBytes uint64
+}
+
+// Holds a directory that still needs to have its entries checked during
+// validation.
+type dirToValidate struct {
+	// The directory's File header.
+	dir *File
+	// The path to the directory. Will be "." for the top-level directory.
+	path string
+}
+
+// Tracks the state of an in-progress validation.
+type validator struct {
+	// The FS being validated.
+	p *SeekerFS
+	// The size of p's underlying data stream.
+	dataSize uint64
+	// The offsets of directory contents we've already seen, so that cycles
+	// will be reported as problems rather than causing an infinite loop.
+	visited map[uint64]bool
+	// A stack of directories that still need to be checked.
+	unchecked []dirToValidate
+	// The report we're building.
+	report *ValidationReport
+}
+
+func (v *validator) addProblem(path string, offset uint64, kind ProblemKind,
+	e error) {
+	v.report.Problems = append(v.report.Problems, &ValidationProblem{
+		Path:         path,
+		HeaderOffset: offset,
+		Kind:         kind,
+		Err:          e,
+	})
+}
+
+// Returns an error if the region of the given size starting at offset doesn't
+// fit in a data stream of dataSize bytes.
+func checkDataRange(offset, size, dataSize uint64) error {
+	end := offset + size
+	if (end < offset) || (end > dataSize) {
+		return fmt.Errorf("Region of %d bytes at offset %d extends past the "+
+			"end of the %d-byte data stream", size, offset, dataSize)
+	}
+	return nil
+}
+
+// Returns an error if name isn't allowed as a name of a directory entry.
+func checkEntryName(name string) error {
+	if (name == "") || (name == ".") || (name == "..") {
+		return fmt.Errorf("Invalid file name: \"%s\"", name)
+	}
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("File name \"%s\" contains a '/'", name)
+	}
+	return nil
+}
+
+// Returns the path of the entry with the given name in the directory with the
+// given path.
+func joinPath(dirPath, name string) string {
+	if dirPath == "." {
+		return name
+	}
+	return dirPath + "/" + name
+}
+
+// Checks an entry's File header, recording a problem and returning false if
+// it's invalid. Nothing else about an entry can be trusted if this fails.
+func (v *validator) checkHeader(entry *File, offset uint64,
+	path string) bool {
+	e := entry.Validate()
+	if e != nil {
+		v.addProblem(path, offset, ProblemBadHeader, e)
+		return false
+	}
+	return true
+}
+
+// Reads and checks an entry's name. Returns the name, or an empty string if
+// it couldn't be read. The placeholder path is used when reporting problems.
+// Also returns false if any problems were found.
+func (v *validator) checkName(entry *File, offset uint64,
+	placeholder string) (string, bool) {
+	if entry.NameSize > 8 {
+		e := checkDataRange(entry.NameOffset, entry.NameSize, v.dataSize)
+		if e != nil {
+			v.addProblem(placeholder, offset, ProblemBadNameLocation, e)
+			return "", false
+		}
+	}
+	name, e := getFileName(entry, v.p)
+	if e != nil {
+		v.addProblem(placeholder, offset, ProblemReadError, e)
+		return "", false
+	}
+	e = checkEntryName(name)
+	if e != nil {
+		v.addProblem(placeholder, offset, ProblemBadName, e)
+		return "", false
+	}
+	return name, true
+}
+
+// Makes sure the entry's extra metadata record, if it has one, can be read.
+// Returns the record, or nil if a problem was found.
+func (v *validator) checkExtra(entry *File, offset uint64,
+	path string) *fileExtra {
+	extra, e := getFileExtra(entry, v.p)
+	if e != nil {
+		v.addProblem(path, offset, ProblemBadExtra, e)
+		return nil
+	}
+	return extra
+}
+
+// Makes sure the entry's data (or directory entries) are present in the data
+// stream. Returns false if a problem was found. The extra metadata may be nil
+// if it couldn't be read.
+func (v *validator) checkDataLocation(entry *File, extra *fileExtra,
+	offset uint64, path string) bool {
+	var e error
+	if entry.IsDir() {
+		// We already know Size is at most 0x7fffffff for directories, so this
+		// can't overflow.
+		e = checkDataRange(entry.DataOffset, entry.Size*fileStructSize,
+			v.dataSize)
+	} else if extra != nil {
+		e = checkDataRange(entry.DataOffset, extra.storedSize(entry),
+			v.dataSize)
+	} else {
+		// We can't tell where the data ends if we couldn't read the extra
+		// metadata, but we can at least check where it starts.
+		e = checkDataRange(entry.DataOffset, 0, v.dataSize)
+	}
+	if e != nil {
+		v.addProblem(path, offset, ProblemBadDataLocation, e)
+		return false
+	}
+	return true
+}
+
+// Adds the directory to the stack of directories to check, unless its
+// contents have already been visited. Returns false if a problem was found.
+func (v *validator) enqueueDir(dir *File, offset uint64, path string) bool {
+	if dir.Size == 0 {
+		return true
+	}
+	if v.visited[dir.DataOffset] {
+		v.addProblem(path, offset, ProblemDirectoryCycle, fmt.Errorf(
+			"Contents at offset %d are referenced more than once",
+			dir.DataOffset))
+		return false
+	}
+	v.visited[dir.DataOffset] = true
+	v.unchecked = append(v.unchecked, dirToValidate{
+		dir:  dir,
+		path: path,
+	})
+	return true
+}
+
+// Records that the given entry was checked, and whether it was OK.
+func (v *validator) countEntry(entry *File, good bool) {
+	v.report.EntriesChecked++
+	if !good {
+		return
+	}
+	v.report.GoodEntries++
+	if !entry.IsDir() {
+		v.report.GoodBytes += entry.Size
+	}
+}
+
+// Checks every entry in the given directory, and makes sure that the entries
+// are sorted by name with no duplicates. Enqueues any subdirectories that
+// still need to be checked.
+func (v *validator) checkDir(d *dirToValidate) {
+	dir := d.dir
+	previousName := ""
+	for i := 0; i < int(dir.Size); i++ {
+		offset := getDirEntryOffset(dir, i)
+		placeholder := joinPath(d.path, fmt.Sprintf("<entry %d>", i))
+		entry, e := getDirEntry(dir, v.p, i)
+		if e != nil {
+			v.addProblem(placeholder, offset, ProblemReadError, e)
+			v.report.EntriesChecked++
+			continue
+		}
+		if !v.checkHeader(entry, offset, placeholder) {
+			v.countEntry(entry, false)
+			continue
+		}
+		name, good := v.checkName(entry, offset, placeholder)
+		path := placeholder
+		if name != "" {
+			path = joinPath(d.path, name)
+			if (previousName != "") && (name < previousName) {
+				v.addProblem(path, offset, ProblemUnsortedEntry, fmt.Errorf(
+					"\"%s\" follows \"%s\"", name, previousName))
+				good = false
+			} else if name == previousName {
+				v.addProblem(path, offset, ProblemDuplicateEntry, fmt.Errorf(
+					"\"%s\" appears more than once", name))
+				good = false
+			}
+			previousName = name
+		}
+		extra := v.checkExtra(entry, offset, path)
+		if extra == nil {
+			good = false
+		}
+		if !v.checkDataLocation(entry, extra, offset, path) {
+			v.countEntry(entry, false)
+			continue
+		}
+		if entry.IsDir() && !v.enqueueDir(entry, offset, path) {
+			good = false
+		}
+		v.countEntry(entry, good)
+	}
+}
+
+// Walks the entire FS, checking for detectable errors with the format, and
+// returns a report listing every problem that was found. Unlike Validate(),
+// this continues past problems wherever possible, so the report also
+// indicates how much of a damaged FS is still usable. Failing to read part of
+// the data stream doesn't stop the check; it's reported as a ProblemReadError
+// and the rest of the FS is still checked.
+func (f *SeekerFS) GetValidationReport() *ValidationReport {
+	v := validator{
+		p:         f,
+		dataSize:  f.dataSize,
+		visited:   make(map[uint64]bool),
+		unchecked: make([]dirToValidate, 0, 64),
+		report:    &ValidationReport{},
+	}
+	// We don't check the top-level directory's name, since it isn't used.
+	good := v.checkHeader(f.topFile, f.topOffset, ".")
+	if good {
+		extra := v.checkExtra(f.topFile, f.topOffset, ".")
+		good = extra != nil
+		if !f.topFile.IsDir() {
+			v.addProblem(".", f.topOffset, ProblemNotADirectory,
+				fmt.Errorf("The top-level file isn't a directory"))
+			good = false
+		} else if v.checkDataLocation(f.topFile, extra, f.topOffset, ".") {
+			v.enqueueDir(f.topFile, f.topOffset, ".")
+		} else {
+			good = false
+		}
+	}
+	v.countEntry(f.topFile, good)
+	for len(v.unchecked) != 0 {
+		current := v.unchecked[len(v.unchecked)-1]
+		v.unchecked = v.unchecked[0 : len(v.unchecked)-1]
+		v.checkDir(&current)
+	}
+	return v.report
+}
+
+// Walks the entire FS, checking for detectable errors with the format. Every
+// File header is validated, every file's name and data must be present in the
+// data stream, and every directory's entries must be strictly sorted by name.
+// Returns nil if no problems were found, or the first *ValidationProblem
+// otherwise. Use GetValidationReport() to get a list of all problems.
+func (f *SeekerFS) Validate() error {
+	report := f.GetValidationReport()
+	if len(report.Problems) != 0 {
+		return report.Problems[0]
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package seeker_fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+)
+
+// Walks the FS using the given walk function, and returns a description of
+// each call to the callback. Returns fs.SkipDir for any path in skip, and
+// stops walking with an error at the path in stop.
+func recordWalk(walk func(string, fs.WalkDirFunc) error, root string,
+	skip map[string]bool, stop string) []string {
+	var calls []string
+	e := walk(root, func(path string, d fs.DirEntry, e error) error {
+		call := fmt.Sprintf("%s: error %v", path, e != nil)
+		if d != nil {
+			call += fmt.Sprintf(", name %s, type %s", d.Name(), d.Type())
+		}
+		calls = append(calls, call)
+		if path == stop {
+			return fmt.Errorf("Stopped at %s", path)
+		}
+		if skip[path] {
+			return fs.SkipDir
+		}
+		return e
+	})
+	return append(calls, fmt.Sprintf("Result: %v", e))
+}
+
+// Checks that SeekerFS.WalkDir behaves the same as fs.WalkDir for the given
+// arguments.
+func checkWalk(t *testing.T, sfs *SeekerFS, root string,
+	skip map[string]bool, stop string) {
+	expected := recordWalk(func(root string, fn fs.WalkDirFunc) error {
+		return fs.WalkDir(sfs, root, fn)
+	}, root, skip, stop)
+	actual := recordWalk(sfs.WalkDir, root, skip, stop)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Logf("WalkDir from %s with skip %v and stop %q was incorrect.\n",
+			root, skip, stop)
+		t.Logf("Got:\n%q\nExpected:\n%q\n", actual, expected)
+		t.FailNow()
+	}
+}
+
+func TestWalkDir(t *testing.T) {
+	data := NewSeekableBuffer()
+	e := CreateSeekerFS(os.DirFS("test_data/test_dir"), data, nil)
+	if e != nil {
+		t.Logf("Failed creating seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	checkWalk(t, sfs, ".", nil, "")
+	checkWalk(t, sfs, "b", nil, "")
+	checkWalk(t, sfs, "b/c/test1.txt", nil, "")
+	checkWalk(t, sfs, "missing", nil, "")
+	checkWalk(t, sfs, ".", map[string]bool{"b/c": true}, "")
+	checkWalk(t, sfs, ".", map[string]bool{"b/c/hi.png": true}, "")
+	checkWalk(t, sfs, ".", map[string]bool{".": true}, "")
+	checkWalk(t, sfs, ".", nil, "b/c/test1.txt")
+
+	// Only the root should be followed if it's a symbolic link.
+	data = NewSeekableBuffer()
+	e = CreateSeekerFS(NewDirFS(createSymlinkTree(t)), data, nil)
+	if e != nil {
+		t.Logf("Failed creating FS with symlinks: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e = LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading FS with symlinks: %s\n", e)
+		t.FailNow()
+	}
+	checkWalk(t, sfs, ".", nil, "")
+	checkWalk(t, sfs, "absolute_link", nil, "")
+	checkWalk(t, sfs, "bad/loop1", nil, "")
+
+	// Make sure errors reading a directory are reported, by corrupting the
+	// entry count of a directory.
+	_, offset, e := resolveFilePath(sfs.topFile, sfs.topOffset, sfs, "a/b",
+		false)
+	if e != nil {
+		t.Logf("Failed finding a/b: %s\n", e)
+		t.FailNow()
+	}
+	// The Size field is at offset 48 in the File struct.
+	newSize := make([]byte, 8)
+	binary.LittleEndian.PutUint64(newSize, 0x7fffffff)
+	corruptBuffer(t, data, int64(offset)+48, newSize)
+	sfs, e = LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading corrupted FS: %s\n", e)
+		t.FailNow()
+	}
+	checkWalk(t, sfs, ".", nil, "")
+	var walkErrors []error
+	e = sfs.WalkDir(".", func(path string, d fs.DirEntry, e error) error {
+		if e != nil {
+			walkErrors = append(walkErrors, e)
+		}
+		return nil
+	})
+	if e != nil {
+		t.Logf("WalkDir failed on corrupted FS: %s\n", e)
+		t.FailNow()
+	}
+	if len(walkErrors) != 1 {
+		t.Logf("Got %d errors walking corrupted FS, expected 1\n",
+			len(walkErrors))
+		t.FailNow()
+	}
+	var pathError *fs.PathError
+	if !errors.As(walkErrors[0], &pathError) || (pathError.Path != "a/b") {
+		t.Logf("Got incorrect error walking corrupted FS: %s\n",
+			walkErrors[0])
+		t.FailNow()
+	}
+	t.Logf("Got expected error walking corrupted FS: %s\n", walkErrors[0])
+}
+
+func TestWalkDirBadName(t *testing.T) {
+	data := NewSeekableBuffer()
+	e := CreateSeekerFS(fstest.MapFS{
+		"a.txt":    newMapFile("Content"),
+		"zz/x.txt": newMapFile("Content"),
+		"zzz.txt":  newMapFile("Content"),
+	}, data, nil)
+	if e != nil {
+		t.Logf("Failed creating seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	_, offset, e := resolveFilePath(sfs.topFile, sfs.topOffset, sfs, "zz",
+		false)
+	if e != nil {
+		t.Logf("Failed finding zz: %s\n", e)
+		t.FailNow()
+	}
+	// The ShortName field is at offset 16 in the File struct.
+	corruptBuffer(t, data, int64(offset)+16, []byte(".."))
+	var paths []string
+	var walkErrors []error
+	e = sfs.WalkDir(".", func(path string, d fs.DirEntry, e error) error {
+		if e != nil {
+			walkErrors = append(walkErrors, e)
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if e != nil {
+		t.Logf("WalkDir failed: %s\n", e)
+		t.FailNow()
+	}
+	if len(walkErrors) != 1 {
+		t.Logf("Got %d errors for an entry named .., expected 1\n",
+			len(walkErrors))
+		t.FailNow()
+	}
+	t.Logf("Got expected error for an entry named ..: %s\n", walkErrors[0])
+	// The bad entry's siblings should still be visited.
+	expected := []string{".", "a.txt", "zzz.txt"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Logf("WalkDir visited %v, expected %v\n", paths, expected)
+		t.FailNow()
+	}
+
+	// Returning an error when the bad entry is reported should stop the walk.
+	paths = nil
+	e = sfs.WalkDir(".", func(path string, d fs.DirEntry, e error) error {
+		if e != nil {
+			return e
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if e == nil {
+		t.Logf("Didn't get expected error from WalkDir\n")
+		t.FailNow()
+	}
+	if !reflect.DeepEqual(paths, expected[0:2]) {
+		t.Logf("WalkDir didn't stop at the bad entry: visited %v\n", paths)
+		t.FailNow()
+	}
+}
+
+func TestWalkDirReads(t *testing.T) {
+	raw, names := createCacheTestImage(t)
+	counter := &countingReaderAt{r: bytes.NewReader(raw)}
+	sfs, e := LoadSeekerFSReaderAt(counter, int64(len(raw)))
+	if e != nil {
+		t.Logf("Failed loading seeker FS: %s\n", e)
+		t.FailNow()
+	}
+	atomic.StoreInt64(&counter.reads, 0)
+	visited := 0
+	e = sfs.WalkDir(".", func(path string, d fs.DirEntry, e error) error {
+		visited++
+		return e
+	})
+	if e != nil {
+		t.Logf("WalkDir failed: %s\n", e)
+		t.FailNow()
+	}
+	// Each file's long name needs to be read, but its extra metadata
+	// shouldn't be, as the callback never calls Info().
+	reads := atomic.LoadInt64(&counter.reads)
+	t.Logf("Visited %d paths using %d reads\n", visited, reads)
+	if visited != (len(names) + 2) {
+		t.Logf("Visited %d paths, expected %d\n", visited, len(names)+2)
+		t.FailNow()
+	}
+	if reads > int64(len(names)+4) {
+		t.Logf("WalkDir used too many reads: %d\n", reads)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,193 @@
+package seeker_fs
+
+// This file contains code for writing the contents of a SeekerFS to tar and
+// zip archives.
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// Returns the File struct and its offset for an entry passed to a WalkDir
+// callback, so that the file doesn't need to be found by its path again.
+func (p *SeekerFS) getWalkedFile(path string, d fs.DirEntry) (*File, uint64,
+	error) {
+	entry, ok := d.(*seekerFSDirEntry)
+	if ok {
+		return &entry.f, entry.offset, nil
+	}
+	// Only the root of the walk isn't a *seekerFSDirEntry.
+	return resolveFilePath(p.topFile, p.topOffset, p, path, true)
+}
+
+// Copies the content of the given regular file to the output.
+func (p *SeekerFS) copyFileContent(output io.Writer, f *File, offset uint64,
+	path string, extra *fileExtra) error {
+	file, e := p.openFile(f, offset, path, extra)
+	if e != nil {
+		return e
+	}
+	defer file.Close()
+	_, e = io.Copy(output, file)
+	return e
+}
+
+// Returns the tar header for the file f, at the given path. The links map
+// contains the paths of regular files that have already been written, keyed
+// by their IDs. Files that have already been written are returned as hard
+// links.
+func (p *SeekerFS) getTarHeader(path string, f *File, info fs.FileInfo,
+	extra *fileExtra, links map[uint64]string) (*tar.Header, error) {
+	var e error
+	target := ""
+	if (info.Mode() & fs.ModeSymlink) != 0 {
+		target, e = readLinkTarget(f, p)
+		if e != nil {
+			return nil, e
+		}
+	}
+	h, e := tar.FileInfoHeader(info, target)
+	if e != nil {
+		return nil, e
+	}
+	// Sub-second timestamps and extended attributes need the PAX format.
+	h.Format = tar.FormatPAX
+	h.Name = path
+	if info.IsDir() {
+		h.Name = path + "/"
+		if path == "." {
+			h.Name = "./"
+		}
+	}
+	sysInfo := info.Sys().(*FileSys)
+	if sysInfo.HasOwner {
+		h.Uid = int(sysInfo.UID)
+		h.Gid = int(sysInfo.GID)
+	}
+	h.Uname = sysInfo.UserName
+	h.Gname = sysInfo.GroupName
+	h.AccessTime = sysInfo.AccessTime
+	h.ChangeTime = sysInfo.ChangeTime
+	if info.Mode().IsRegular() {
+		existing, isLink := links[sysInfo.ID]
+		if isLink {
+			h.Typeflag = tar.TypeLink
+			h.Linkname = existing
+			h.Size = 0
+			return h, nil
+		}
+		links[sysInfo.ID] = path
+	}
+	if len(extra.xattrs) != 0 {
+		h.PAXRecords = make(map[string]string)
+	}
+	for _, x := range extra.xattrs {
+		h.PAXRecords[paxXattrPrefix+x.name] = string(x.value)
+	}
+	return h, nil
+}
+
+// Writes the contents of the FS to the output as a tar archive, in the PAX
+// format. Each file's mode, modification and access times, ownership, and
+// extended attributes are preserved, along with symbolic and hard links. The
+// root directory is written as "./", so that its metadata is also preserved.
+// The archive can be converted back using CreateSeekerFSFromTar.
+func (p *SeekerFS) WriteTar(output io.Writer) error {
+	w := tar.NewWriter(output)
+	links := make(map[uint64]string)
+	e := p.WalkDir(".", func(path string, d fs.DirEntry, e error) error {
+		if e != nil {
+			return e
+		}
+		f, offset, e := p.getWalkedFile(path, d)
+		if e != nil {
+			return fmt.Errorf("Failed finding %s: %w", path, e)
+		}
+		extra, e := getFileExtra(f, p)
+		if e != nil {
+			return fmt.Errorf("Failed reading metadata for %s: %w", path, e)
+		}
+		info := newFileInfo(f, offset, d.Name(), extra)
+		h, e := p.getTarHeader(path, f, info, extra, links)
+		if e != nil {
+			return fmt.Errorf("Failed getting tar header for %s: %w", path, e)
+		}
+		e = w.WriteHeader(h)
+		if e != nil {
+			return fmt.Errorf("Failed writing tar header for %s: %w", path, e)
+		}
+		if (h.Typeflag != tar.TypeReg) || (h.Size == 0) {
+			return nil
+		}
+		e = p.copyFileContent(w, f, offset, path, extra)
+		if e != nil {
+			return fmt.Errorf("Failed writing content of %s: %w", path, e)
+		}
+		return nil
+	})
+	if e != nil {
+		return e
+	}
+	return w.Close()
+}
+
+// Writes the contents of the FS to the output as a zip archive. Zip archives
+// only preserve each file's mode and modification time, to the nearest second.
+// Regular files are compressed using deflate, and symbolic links are stored
+// with their targets as their content. Hard links are written as separate
+// copies of the file.
+func (p *SeekerFS) WriteZip(output io.Writer) error {
+	w := zip.NewWriter(output)
+	e := p.WalkDir(".", func(path string, d fs.DirEntry, e error) error {
+		if e != nil {
+			return e
+		}
+		// Zip archives don't contain an entry for the root directory.
+		if path == "." {
+			return nil
+		}
+		f, offset, e := p.getWalkedFile(path, d)
+		if e != nil {
+			return fmt.Errorf("Failed finding %s: %w", path, e)
+		}
+		extra, e := getFileExtra(f, p)
+		if e != nil {
+			return fmt.Errorf("Failed reading metadata for %s: %w", path, e)
+		}
+		info := newFileInfo(f, offset, d.Name(), extra)
+		h, e := zip.FileInfoHeader(info)
+		if e != nil {
+			return fmt.Errorf("Failed getting zip header for %s: %w", path, e)
+		}
+		h.Name = path
+		if info.IsDir() {
+			h.Name = path + "/"
+		}
+		if info.Mode().IsRegular() {
+			h.Method = zip.Deflate
+		}
+		fileWriter, e := w.CreateHeader(h)
+		if e != nil {
+			return fmt.Errorf("Failed writing zip header for %s: %w", path, e)
+		}
+		if info.Mode().IsRegular() {
+			e = p.copyFileContent(fileWriter, f, offset, path, extra)
+		} else if (info.Mode() & fs.ModeSymlink) != 0 {
+			var target string
+			target, e = readLinkTarget(f, p)
+			if e == nil {
+				_, e = fileWriter.Write([]byte(target))
+			}
+		}
+		if e != nil {
+			return fmt.Errorf("Failed writing content of %s: %w", path, e)
+		}
+		return nil
+	})
+	if e != nil {
+		return e
+	}
+	return w.Close()
+}
@@ -0,0 +1,235 @@
+package seeker_fs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io/fs"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Returns a SeekerFS containing various types of files and metadata, created
+// from a tar archive.
+func createArchiveTestFS(t *testing.T) *SeekerFS {
+	modTime := time.Unix(1234567890, 123456789)
+	headers := []*tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0750},
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		{
+			Name:       "dir/owned.txt",
+			Typeflag:   tar.TypeReg,
+			Mode:       0640,
+			Uid:        1000,
+			Gid:        1001,
+			Uname:      "someone",
+			Gname:      "some_group",
+			AccessTime: time.Unix(1300000000, 1000),
+			ChangeTime: time.Unix(1300000001, 2000),
+			PAXRecords: map[string]string{
+				"SCHILY.xattr.user.a": "value a",
+				"SCHILY.xattr.user.b": "value b",
+			},
+		},
+		{Name: "dir/empty.txt", Typeflag: tar.TypeReg, Mode: 0600},
+		{Name: "dir/sub/", Typeflag: tar.TypeDir, Mode: 0700},
+		{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "../a.txt"},
+		{Name: "dir/hard_link.txt", Typeflag: tar.TypeLink, Linkname: "a.txt"},
+	}
+	for _, h := range headers {
+		h.ModTime = modTime
+	}
+	archive := createTestTar(t, headers, map[string]string{
+		"dir/owned.txt": "Owned content",
+		"a.txt":         "Linked content",
+	})
+	data := NewSeekableBuffer()
+	e := CreateSeekerFSFromTar(bytes.NewReader(archive), data,
+		&CreateFSSettings{StoreAccessTimes: true})
+	if e != nil {
+		t.Logf("Failed creating FS from tar: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading FS created from tar: %s\n", e)
+		t.FailNow()
+	}
+	return sfs
+}
+
+// Returns the paths in the FS mapped to their info, without following links.
+func getAllFileInfo(t *testing.T, f fs.FS) map[string]fs.FileInfo {
+	toReturn := make(map[string]fs.FileInfo)
+	e := fs.WalkDir(f, ".", func(path string, d fs.DirEntry, e error) error {
+		if e != nil {
+			return e
+		}
+		toReturn[path], e = d.Info()
+		return e
+	})
+	if e != nil {
+		t.Logf("Failed walking FS: %s\n", e)
+		t.FailNow()
+	}
+	return toReturn
+}
+
+// Checks that both FS's contain the same paths, with the same content, modes,
+// and modification times, truncated to the given precision. Only compares
+// directories' metadata if checkDirs is true.
+func compareArchivedFS(t *testing.T, a, b *SeekerFS, precision time.Duration,
+	checkDirs bool) {
+	infoA := getAllFileInfo(t, a)
+	infoB := getAllFileInfo(t, b)
+	if len(infoA) != len(infoB) {
+		t.Logf("Original FS had %d files, but copy has %d\n", len(infoA),
+			len(infoB))
+		t.FailNow()
+	}
+	for path, expected := range infoA {
+		actual := infoB[path]
+		if actual == nil {
+			t.Logf("The copied FS is missing %s\n", path)
+			t.FailNow()
+		}
+		if expected.IsDir() && !checkDirs {
+			continue
+		}
+		if actual.Mode() != expected.Mode() {
+			t.Logf("%s has mode %s in the copy, expected %s\n", path,
+				actual.Mode(), expected.Mode())
+			t.FailNow()
+		}
+		expectedTime := expected.ModTime().Truncate(precision)
+		if !actual.ModTime().Equal(expectedTime) {
+			t.Logf("%s has mod time %s in the copy, expected %s\n", path,
+				actual.ModTime(), expectedTime)
+			t.FailNow()
+		}
+		if !expected.Mode().IsRegular() {
+			continue
+		}
+		expectedData, e := fs.ReadFile(a, path)
+		if e != nil {
+			t.Logf("Failed reading %s: %s\n", path, e)
+			t.FailNow()
+		}
+		actualData, e := fs.ReadFile(b, path)
+		if e != nil {
+			t.Logf("Failed reading %s from the copy: %s\n", path, e)
+			t.FailNow()
+		}
+		if !bytes.Equal(expectedData, actualData) {
+			t.Logf("%s has different content in the copy\n", path)
+			t.FailNow()
+		}
+	}
+}
+
+func TestWriteTar(t *testing.T) {
+	original := createArchiveTestFS(t)
+	var archive bytes.Buffer
+	e := original.WriteTar(&archive)
+	if e != nil {
+		t.Logf("Failed writing tar: %s\n", e)
+		t.FailNow()
+	}
+	data := NewSeekableBuffer()
+	e = CreateSeekerFSFromTar(&archive, data,
+		&CreateFSSettings{StoreAccessTimes: true})
+	if e != nil {
+		t.Logf("Failed creating FS from written tar: %s\n", e)
+		t.FailNow()
+	}
+	copied, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading FS created from written tar: %s\n", e)
+		t.FailNow()
+	}
+	compareArchivedFS(t, original, copied, 0, true)
+
+	// The tar format should preserve everything else, too.
+	for path, expected := range getAllFileInfo(t, original) {
+		info, e := copied.Lstat(path)
+		if e != nil {
+			t.Logf("Failed getting info for %s: %s\n", path, e)
+			t.FailNow()
+		}
+		expectedSys := *(expected.Sys().(*FileSys))
+		actualSys := *(info.Sys().(*FileSys))
+		// IDs are only compared among links in the same FS.
+		expectedSys.ID = 0
+		actualSys.ID = 0
+		if !reflect.DeepEqual(expectedSys, actualSys) {
+			t.Logf("%s has different metadata in the copy: %+v vs %+v\n",
+				path, actualSys, expectedSys)
+			t.FailNow()
+		}
+	}
+	names, e := copied.ListXattr("dir/owned.txt")
+	if e != nil {
+		t.Logf("Failed listing extended attributes: %s\n", e)
+		t.FailNow()
+	}
+	if !reflect.DeepEqual(names, []string{"user.a", "user.b"}) {
+		t.Logf("Got incorrect extended attributes: %v\n", names)
+		t.FailNow()
+	}
+	target, e := copied.ReadLink("dir/link")
+	if e != nil {
+		t.Logf("Failed reading link: %s\n", e)
+		t.FailNow()
+	}
+	if target != "../a.txt" {
+		t.Logf("Got incorrect link target: %s\n", target)
+		t.FailNow()
+	}
+	if getFileSysID(t, copied, "a.txt") !=
+		getFileSysID(t, copied, "dir/hard_link.txt") {
+		t.Logf("Hard links weren't preserved in the tar archive\n")
+		t.FailNow()
+	}
+}
+
+// Returns the ID from the FileSys of the given path's info.
+func getFileSysID(t *testing.T, f *SeekerFS, path string) uint64 {
+	info, e := f.Lstat(path)
+	if e != nil {
+		t.Logf("Failed getting info for %s: %s\n", path, e)
+		t.FailNow()
+	}
+	return info.Sys().(*FileSys).ID
+}
+
+func TestWriteZip(t *testing.T) {
+	original := createArchiveTestFS(t)
+	var archive bytes.Buffer
+	e := original.WriteZip(&archive)
+	if e != nil {
+		t.Logf("Failed writing zip: %s\n", e)
+		t.FailNow()
+	}
+	zipFS, e := zip.NewReader(bytes.NewReader(archive.Bytes()),
+		int64(archive.Len()))
+	if e != nil {
+		t.Logf("Failed reading written zip: %s\n", e)
+		t.FailNow()
+	}
+	data := NewSeekableBuffer()
+	e = CreateSeekerFS(zipFS, data, nil)
+	if e != nil {
+		t.Logf("Failed creating FS from written zip: %s\n", e)
+		t.FailNow()
+	}
+	copied, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading FS created from written zip: %s\n", e)
+		t.FailNow()
+	}
+	// Zip archives don't contain the root directory, and zip.Reader doesn't
+	// report the metadata of other directories.
+	compareArchivedFS(t, original, copied, time.Second, false)
+}
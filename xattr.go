@@ -0,0 +1,148 @@
+package seeker_fs
+
+// This file contains code related to storing and reading extended attributes.
+// A file's extended attributes are stored in a single field of its extra
+// metadata record.
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+)
+
+// Implemented by filesystems that provide extended attributes. If the FS
+// passed to CreateSeekerFS implements this, the extended attributes of every
+// regular file, directory, and symbolic link will be stored. Like Linux's
+// llistxattr and lgetxattr, neither method follows a symbolic link in the last
+// component of the name, so a link's own attributes can be read. SeekerFS
+// implements this, and so does DirFS on Linux.
+type XattrFS interface {
+	fs.FS
+	// Returns the names of the named file's extended attributes.
+	ListXattr(name string) ([]string, error)
+	// Returns the value of the named file's extended attribute. Returns an
+	// error wrapping ErrNoXattr if the file doesn't have the attribute.
+	GetXattr(name, attr string) ([]byte, error)
+}
+
+// Returned (wrapped in an *fs.PathError) by GetXattr if a file doesn't have
+// the requested extended attribute.
+var ErrNoXattr = errors.New("Extended attribute not found")
+
+// The maximum total size of a single file's encoded extended attributes.
+// Linux limits a file's attributes to 64 KiB, so this is generous.
+const maxXattrTableSize = 16 * 1024 * 1024
+
+// A single extended attribute.
+type fileXattr struct {
+	name  string
+	value []byte
+}
+
+// Precedes each attribute's name and value in an extraTagXattrs field. The
+// attributes are sorted by name.
+type xattrHeader struct {
+	NameSize  uint32
+	ValueSize uint32
+}
+
+// Returns the content of an extraTagXattrs field holding the given attributes,
+// which must already be sorted by name.
+func encodeXattrs(xattrs []fileXattr) []byte {
+	size := 0
+	for i := range xattrs {
+		size += 8 + len(xattrs[i].name) + len(xattrs[i].value)
+	}
+	toReturn := make([]byte, 0, size)
+	var header [8]byte
+	for i := range xattrs {
+		a := &(xattrs[i])
+		binary.LittleEndian.PutUint32(header[0:4], uint32(len(a.name)))
+		binary.LittleEndian.PutUint32(header[4:8], uint32(len(a.value)))
+		toReturn = append(toReturn, header[:]...)
+		toReturn = append(toReturn, a.name...)
+		toReturn = append(toReturn, a.value...)
+	}
+	return toReturn
+}
+
+// Parses the content of an extraTagXattrs field. Returns an error if the
+// content is truncated or the attributes aren't sorted by unique names.
+func decodeXattrs(raw []byte) ([]fileXattr, error) {
+	var toReturn []fileXattr
+	for len(raw) != 0 {
+		if len(raw) < 8 {
+			return nil, fmt.Errorf("Truncated extended attribute header")
+		}
+		nameSize := uint64(binary.LittleEndian.Uint32(raw[0:4]))
+		valueSize := uint64(binary.LittleEndian.Uint32(raw[4:8]))
+		raw = raw[8:]
+		if uint64(len(raw)) < (nameSize + valueSize) {
+			return nil, fmt.Errorf("Truncated extended attribute")
+		}
+		a := fileXattr{
+			name:  string(raw[0:nameSize]),
+			value: raw[nameSize : nameSize+valueSize],
+		}
+		raw = raw[nameSize+valueSize:]
+		if a.name == "" {
+			return nil, fmt.Errorf("Empty extended attribute name")
+		}
+		if (len(toReturn) != 0) && (a.name <= toReturn[len(toReturn)-1].name) {
+			return nil, fmt.Errorf("Extended attribute %s is out of order",
+				a.name)
+		}
+		toReturn = append(toReturn, a)
+	}
+	return toReturn, nil
+}
+
+// Reads the extra metadata record for the named file, without following a
+// symbolic link in the last path component. The op is used in any returned
+// *fs.PathError.
+func (p *SeekerFS) getNamedFileExtra(name, op string) (*fileExtra, error) {
+	f, _, e := resolveFilePath(p.topFile, p.topOffset, p, name, false)
+	if e != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: e}
+	}
+	extra, e := getFileExtra(f, p)
+	if e != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: e}
+	}
+	return extra, nil
+}
+
+// Returns the names of the named file's extended attributes, in sorted order.
+// Doesn't follow a symbolic link in the last path component.
+func (p *SeekerFS) ListXattr(name string) ([]string, error) {
+	extra, e := p.getNamedFileExtra(name, "listxattr")
+	if e != nil {
+		return nil, e
+	}
+	toReturn := make([]string, len(extra.xattrs))
+	for i := range extra.xattrs {
+		toReturn[i] = extra.xattrs[i].name
+	}
+	return toReturn, nil
+}
+
+// Returns the value of the named file's extended attribute. Doesn't follow a
+// symbolic link in the last path component. Returns an error wrapping
+// ErrNoXattr if the file doesn't have the attribute.
+func (p *SeekerFS) GetXattr(name, attr string) ([]byte, error) {
+	extra, e := p.getNamedFileExtra(name, "getxattr")
+	if e != nil {
+		return nil, e
+	}
+	xattrs := extra.xattrs
+	i := sort.Search(len(xattrs), func(i int) bool {
+		return xattrs[i].name >= attr
+	})
+	if (i >= len(xattrs)) || (xattrs[i].name != attr) {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: ErrNoXattr}
+	}
+	toReturn := make([]byte, len(xattrs[i].value))
+	copy(toReturn, xattrs[i].value)
+	return toReturn, nil
+}
@@ -0,0 +1,243 @@
+package seeker_fs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestXattrs(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "file.txt")
+	e := os.WriteFile(filePath, []byte("File with attributes"), 0644)
+	if e != nil {
+		t.Logf("Failed creating test file: %s\n", e)
+		t.FailNow()
+	}
+	expected := map[string]string{
+		"user.b_attribute": "Value B",
+		"user.a_attribute": "Value A",
+		"user.empty":       "",
+	}
+	for name, value := range expected {
+		e = syscall.Setxattr(filePath, name, []byte(value), 0)
+		if errors.Is(e, syscall.ENOTSUP) {
+			t.Skipf("Extended attributes aren't supported here: %s\n", e)
+		}
+		if e != nil {
+			t.Logf("Failed setting attribute %s: %s\n", name, e)
+			t.FailNow()
+		}
+	}
+	e = syscall.Setxattr(dir, "user.dir_attribute", []byte("Dir value"), 0)
+	if e != nil {
+		t.Logf("Failed setting directory attribute: %s\n", e)
+		t.FailNow()
+	}
+
+	data := NewSeekableBuffer()
+	e = CreateSeekerFS(NewDirFS(dir), data, nil)
+	if e != nil {
+		t.Logf("Failed creating FS with attributes: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading FS with attributes: %s\n", e)
+		t.FailNow()
+	}
+	e = sfs.Validate()
+	if e != nil {
+		t.Logf("Validating FS with attributes failed: %s\n", e)
+		t.FailNow()
+	}
+
+	names, e := sfs.ListXattr("file.txt")
+	if e != nil {
+		t.Logf("Failed listing attributes: %s\n", e)
+		t.FailNow()
+	}
+	if len(names) != len(expected) {
+		t.Logf("Expected %d attributes, got %v\n", len(expected), names)
+		t.FailNow()
+	}
+	for i, name := range names {
+		if (i > 0) && (name <= names[i-1]) {
+			t.Logf("Attribute names aren't sorted: %v\n", names)
+			t.FailNow()
+		}
+		value, e := sfs.GetXattr("file.txt", name)
+		if e != nil {
+			t.Logf("Failed getting attribute %s: %s\n", name, e)
+			t.FailNow()
+		}
+		if string(value) != expected[name] {
+			t.Logf("Attribute %s has value %q, expected %q\n", name, value,
+				expected[name])
+			t.FailNow()
+		}
+	}
+	_, e = sfs.GetXattr("file.txt", "user.missing")
+	if !errors.Is(e, ErrNoXattr) {
+		t.Logf("Didn't get expected error for a missing attribute. Got %v "+
+			"instead.\n", e)
+		t.FailNow()
+	}
+	value, e := sfs.GetXattr(".", "user.dir_attribute")
+	if e != nil {
+		t.Logf("Failed getting directory attribute: %s\n", e)
+		t.FailNow()
+	}
+	if string(value) != "Dir value" {
+		t.Logf("Got incorrect directory attribute value: %q\n", value)
+		t.FailNow()
+	}
+
+	// Copying the SeekerFS should keep the attributes.
+	data = NewSeekableBuffer()
+	e = CreateSeekerFS(sfs, data, nil)
+	if e != nil {
+		t.Logf("Failed copying FS: %s\n", e)
+		t.FailNow()
+	}
+	copied, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading copied FS: %s\n", e)
+		t.FailNow()
+	}
+	value, e = copied.GetXattr("file.txt", "user.b_attribute")
+	if e != nil {
+		t.Logf("Failed getting attribute from copied FS: %s\n", e)
+		t.FailNow()
+	}
+	if string(value) != expected["user.b_attribute"] {
+		t.Logf("Got incorrect attribute value from copied FS: %q\n", value)
+		t.FailNow()
+	}
+}
+
+// Sets an extended attribute on a symbolic link itself, which the syscall
+// package doesn't support. Linux only allows this for some namespaces, such as
+// "trusted.", and only for privileged users.
+func lsetxattr(path, attr string, value []byte) error {
+	pathPtr, e := syscall.BytePtrFromString(path)
+	if e != nil {
+		return e
+	}
+	attrPtr, e := syscall.BytePtrFromString(attr)
+	if e != nil {
+		return e
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR,
+		uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(attrPtr)),
+		bufferPointer(value), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func TestSymlinkXattrs(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "file.txt")
+	e := os.WriteFile(filePath, []byte("Link target"), 0644)
+	if e != nil {
+		t.Logf("Failed creating test file: %s\n", e)
+		t.FailNow()
+	}
+	e = syscall.Setxattr(filePath, "user.file_attribute", []byte("File"), 0)
+	if errors.Is(e, syscall.ENOTSUP) {
+		t.Skipf("Extended attributes aren't supported here: %s\n", e)
+	}
+	if e != nil {
+		t.Logf("Failed setting file attribute: %s\n", e)
+		t.FailNow()
+	}
+	e = os.Symlink("file.txt", filepath.Join(dir, "link"))
+	if e != nil {
+		t.Logf("Failed creating link: %s\n", e)
+		t.FailNow()
+	}
+	e = os.Symlink("missing.txt", filepath.Join(dir, "dangling"))
+	if e != nil {
+		t.Logf("Failed creating dangling link: %s\n", e)
+		t.FailNow()
+	}
+	// Setting an attribute on the link itself requires privileges, so only
+	// check for it if this succeeds.
+	e = lsetxattr(filepath.Join(dir, "link"), "trusted.link_attribute",
+		[]byte("Link"))
+	linkHasXattr := e == nil
+	if !linkHasXattr {
+		t.Logf("Couldn't set an attribute on the link: %s\n", e)
+	}
+
+	data := NewSeekableBuffer()
+	e = CreateSeekerFS(NewDirFS(dir), data, nil)
+	if e != nil {
+		t.Logf("Failed creating FS with symlinks: %s\n", e)
+		t.FailNow()
+	}
+	sfs, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading FS with symlinks: %s\n", e)
+		t.FailNow()
+	}
+	// Copying the FS should keep the link's attributes, too.
+	data = NewSeekableBuffer()
+	e = CreateSeekerFS(sfs, data, nil)
+	if e != nil {
+		t.Logf("Failed copying FS with symlinks: %s\n", e)
+		t.FailNow()
+	}
+	copied, e := LoadSeekerFS(data)
+	if e != nil {
+		t.Logf("Failed loading copied FS: %s\n", e)
+		t.FailNow()
+	}
+	for _, f := range []*SeekerFS{sfs, copied} {
+		// The link shouldn't report the attributes of its target.
+		names, e := f.ListXattr("link")
+		if e != nil {
+			t.Logf("Failed listing link attributes: %s\n", e)
+			t.FailNow()
+		}
+		expectedCount := 0
+		if linkHasXattr {
+			expectedCount = 1
+		}
+		if len(names) != expectedCount {
+			t.Logf("Got incorrect link attributes: %v\n", names)
+			t.FailNow()
+		}
+		_, e = f.GetXattr("link", "user.file_attribute")
+		if !errors.Is(e, ErrNoXattr) {
+			t.Logf("Didn't get expected error getting the target's "+
+				"attribute from the link. Got %v instead.\n", e)
+			t.FailNow()
+		}
+		if linkHasXattr {
+			value, e := f.GetXattr("link", "trusted.link_attribute")
+			if e != nil {
+				t.Logf("Failed getting link attribute: %s\n", e)
+				t.FailNow()
+			}
+			if string(value) != "Link" {
+				t.Logf("Got incorrect link attribute value: %q\n", value)
+				t.FailNow()
+			}
+		}
+		names, e = f.ListXattr("dangling")
+		if e != nil {
+			t.Logf("Failed listing dangling link attributes: %s\n", e)
+			t.FailNow()
+		}
+		if len(names) != 0 {
+			t.Logf("Got unexpected dangling link attributes: %v\n", names)
+			t.FailNow()
+		}
+	}
+}